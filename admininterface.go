@@ -13,20 +13,26 @@ type AdminInterface interface {
 	AdminGetAccount(username string) (Account, error)
 	AdminUpdAccount(Account) error
 	AdminResetUserPassword(username string) error
+	AdminRecoveryCodesLeft(username string) (int, error)
+	AdminListAPIKeys(username string) ([]APIKey, error)
+	AdminRevokeAPIKey(username, id string) error
+	AdminListAccounts(q ListQuery) (accounts []Account, next string, err error)
 }
 
 // Admin is a struct to implement AdminInterface
 type admininterface struct {
 	UserAccountStorage
 	PasswordHasher
+	opts options
 }
 
 // NewAdminInterface creates instance of AdminInterface
-func NewAdminInterface(st UserAccountStorage) (AdminInterface, error) {
+func NewAdminInterface(st UserAccountStorage, opts ...Option) (AdminInterface, error) {
 	if st == nil {
 		return nil, fmt.Errorf("error: storage is nil")
 	}
-	return &admininterface{st, globalHasher}, nil
+	o := newOptions(opts)
+	return &admininterface{NewPolicyStorage(st, o.usernamePolicy), o.passwordHasher(), o}, nil
 }
 
 // AdminGetUserInfo returns stored UerInfo if available in the storage
@@ -35,7 +41,8 @@ func (ad *admininterface) AdminGetAccount(username string) (Account, error) {
 }
 
 // AdminAddUser add new user (if storage allows )
-func (ad *admininterface) AdminAddAccount(username string) error {
+func (ad *admininterface) AdminAddAccount(username string) (err error) {
+	defer func() { ad.opts.emit(EventUserCreated, SourceAdmin, username, err) }()
 	if _, err := ad.Get(username); err == nil {
 		return ErrUserExists
 	}
@@ -45,21 +52,50 @@ func (ad *admininterface) AdminAddAccount(username string) error {
 
 // AdminDelUser deletes user
 func (ad *admininterface) AdminDelAccount(username string) error {
-	return ad.Del(username)
+	err := ad.Del(username)
+	ad.opts.emit(EventUserDeleted, SourceAdmin, username, err)
+	return err
 }
 
-// AdminUpdateUserInfo updates userinfo in underlying USerInfoStorage
+// AdminUpdateUserInfo updates userinfo in underlying USerInfoStorage.
+// If account.Version is set, the update fails with ErrConflict unless
+// stored account has the same version. Zero Version overwrites the account
+// regardless of concurrent changes. Password hash, verification codes,
+// TOTP secret, recovery codes and API keys are never changed. Email and
+// EmailVerified are taken as given, so admin may verify an address out of band.
 func (ad *admininterface) AdminUpdAccount(account Account) error {
+	var err error
+	if account.Version != 0 {
+		err = ad.adminUpdAccount(account)
+	} else {
+		err = retryOnConflict(func() error { return ad.adminUpdAccount(account) })
+	}
+	ad.opts.emit(EventAccountUpdated, SourceAdmin, account.UserName, err)
+	return err
+}
+
+func (ad *admininterface) adminUpdAccount(account Account) error {
 	existing, err := ad.Get(account.UserName)
 	if err != nil {
 		return err
 	}
-	account.PasswordHash = existing.PasswordHash
+	if account.Version == 0 {
+		account.Version = existing.Version
+	} else if account.Version != existing.Version {
+		return ErrConflict
+	}
+	keepSecrets(&account, existing)
 	return ad.Upd(account)
 }
 
 // AdminUpdateUserPassword updates user's password hash in underlying storage
 func (ad *admininterface) AdminResetUserPassword(username string) error {
+	err := retryOnConflict(func() error { return ad.adminResetUserPassword(username) })
+	ad.opts.emit(EventPasswordReset, SourceAdmin, username, err)
+	return err
+}
+
+func (ad *admininterface) adminResetUserPassword(username string) error {
 	account, err := ad.Get(username)
 	if err != nil {
 		return err
@@ -68,3 +104,16 @@ func (ad *admininterface) AdminResetUserPassword(username string) error {
 	account.MustChangePassword = true
 	return ad.Upd(account)
 }
+
+// keepSecrets copies fields which must not be changed with AdminUpdAccount
+// from existing account to account.
+func keepSecrets(account *Account, existing Account) {
+	account.PasswordHash = existing.PasswordHash
+	account.VerificationCodeHash = existing.VerificationCodeHash
+	account.VerificationCodeExpires = existing.VerificationCodeExpires
+	account.VerificationAttempts = existing.VerificationAttempts
+	account.TOTPSecret = existing.TOTPSecret
+	account.TOTPLastStep = existing.TOTPLastStep
+	account.RecoveryCodes = existing.RecoveryCodes
+	account.APIKeys = existing.APIKeys
+}
@@ -0,0 +1,241 @@
+package basicauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidAPIKey is returned when API key is malformed, unknown or revoked
+	ErrInvalidAPIKey = errors.New("auth error: invalid api key")
+	// ErrAPIKeyExpired is returned when API key has expired
+	ErrAPIKeyExpired = errors.New("auth error: api key has expired")
+	// ErrNoSuchAPIKey is returned when trying to revoke non-existing API key
+	ErrNoSuchAPIKey = errors.New("auth error: no such api key")
+)
+
+const (
+	apiKeyPrefix     = "bak"
+	apiKeyIDSize     = 6
+	apiKeySecretSize = 32
+)
+
+// APIKey describes API key issued to user for machine access. Full key
+// is only returned once by CreateAPIKey, only its hash is stored.
+// Key without scopes is allowed to do anything.
+type APIKey struct {
+	ID       string
+	Name     string    `json:",omitempty"`
+	Hash     string    `json:",omitempty"`
+	Scopes   []string  `json:",omitempty"`
+	Created  time.Time `json:",omitempty"`
+	Expires  time.Time `json:",omitempty"`
+	LastUsed time.Time `json:",omitempty"`
+	// UserName is only filled in by CheckAPIKey
+	UserName string `json:",omitempty"`
+}
+
+// HasScope reports whether key is allowed to be used for scope.
+func (k APIKey) HasScope(scope string) bool {
+	if len(k.Scopes) == 0 || scope == "" {
+		return true
+	}
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefix returns public part of the key which identifies it
+// without revealing the secret.
+func (k APIKey) Prefix(username string) string {
+	return apiKeyPrefix + "." + base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + k.ID
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAPIKey splits key of form bak.<base64 username>.<id>.<secret>
+func parseAPIKey(key string) (username, id string, err error) {
+	parts := strings.SplitN(key, ".", 4)
+	if len(parts) != 4 || parts[0] != apiKeyPrefix {
+		return "", "", ErrInvalidAPIKey
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", ErrInvalidAPIKey
+	}
+	return string(name), parts[2], nil
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// stripAPIKeyHashes returns copy of keys with hashes removed
+func stripAPIKeyHashes(keys []APIKey) []APIKey {
+	out := make([]APIKey, len(keys))
+	for i, k := range keys {
+		k.Hash = ""
+		out[i] = k
+	}
+	return out
+}
+
+// CreateAPIKey issues new API key for user. Zero expires means key never expires.
+// The returned key is not stored and can not be recovered later.
+func (app *appinterface) CreateAPIKey(username, password, name string, expires time.Time, scopes []string) (key string, err error) {
+	err = retryOnConflict(func() error {
+		key, err = app.createAPIKey(username, password, name, expires, scopes)
+		return err
+	})
+	return key, err
+}
+
+func (app *appinterface) createAPIKey(username, password, name string, expires time.Time, scopes []string) (string, error) {
+	account, err := app.Get(username)
+	if err != nil {
+		return "", err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return "", ErrInvalidPassword
+	}
+	id, err := randomString(apiKeyIDSize)
+	if err != nil {
+		return "", err
+	}
+	secret, err := randomString(apiKeySecretSize)
+	if err != nil {
+		return "", err
+	}
+	k := APIKey{ID: id, Name: name, Scopes: scopes, Created: app.opts.now(), Expires: expires}
+	key := k.Prefix(account.UserName) + "." + secret
+	k.Hash = hashAPIKey(key)
+	n := len(account.APIKeys)
+	account.APIKeys = append(account.APIKeys[:n:n], k)
+	if err := app.Upd(account); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns API keys of user with hashes removed.
+func (app *appinterface) ListAPIKeys(username, password string) ([]APIKey, error) {
+	account, err := app.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return nil, ErrInvalidPassword
+	}
+	return stripAPIKeyHashes(account.APIKeys), nil
+}
+
+// RevokeAPIKey deletes user's API key with specified ID.
+func (app *appinterface) RevokeAPIKey(username, password, id string) error {
+	return retryOnConflict(func() error { return app.revokeAPIKey(username, password, id) })
+}
+
+func (app *appinterface) revokeAPIKey(username, password, id string) error {
+	account, err := app.Get(username)
+	if err != nil {
+		return err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return ErrInvalidPassword
+	}
+	return revokeAPIKey(app, account, id)
+}
+
+func revokeAPIKey(st UserAccountStorage, account Account, id string) error {
+	for i, k := range account.APIKeys {
+		if k.ID == id {
+			account.APIKeys = append(account.APIKeys[:i:i], account.APIKeys[i+1:]...)
+			return st.Upd(account)
+		}
+	}
+	return ErrNoSuchAPIKey
+}
+
+// CheckAPIKey returns description of the key (with UserName set) if key
+// is valid and has not expired.
+func (app *appinterface) CheckAPIKey(key string) (k APIKey, err error) {
+	err = retryOnConflict(func() error {
+		k, err = app.checkAPIKey(key)
+		return err
+	})
+	return k, err
+}
+
+func (app *appinterface) checkAPIKey(key string) (APIKey, error) {
+	username, id, err := parseAPIKey(key)
+	if err != nil {
+		return APIKey{}, err
+	}
+	account, err := app.Get(username)
+	if err != nil {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	hash := hashAPIKey(key)
+	for i, k := range account.APIKeys {
+		if k.ID != id || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		t := app.opts.now()
+		if !k.Expires.IsZero() && t.After(k.Expires) {
+			return APIKey{}, ErrAPIKeyExpired
+		}
+		// copy the slice so that storage's memory is not changed
+		// before Upd succeeds
+		keys := append([]APIKey(nil), account.APIKeys...)
+		keys[i].LastUsed = t
+		account.APIKeys = keys
+		if e := app.Upd(account); errors.Is(e, ErrConflict) {
+			return APIKey{}, e
+		} else if e != nil {
+			log.Printf("error putting userinfo: %v", e)
+		}
+		k.Hash = ""
+		k.LastUsed = t
+		k.UserName = account.UserName
+		return k, nil
+	}
+	return APIKey{}, ErrInvalidAPIKey
+}
+
+// AdminListAPIKeys returns API keys of user with hashes removed.
+func (ad *admininterface) AdminListAPIKeys(username string) ([]APIKey, error) {
+	account, err := ad.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	return stripAPIKeyHashes(account.APIKeys), nil
+}
+
+// AdminRevokeAPIKey deletes user's API key with specified ID.
+func (ad *admininterface) AdminRevokeAPIKey(username, id string) error {
+	return retryOnConflict(func() error { return ad.adminRevokeAPIKey(username, id) })
+}
+
+func (ad *admininterface) adminRevokeAPIKey(username, id string) error {
+	account, err := ad.Get(username)
+	if err != nil {
+		return err
+	}
+	return revokeAPIKey(ad, account, id)
+}
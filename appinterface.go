@@ -16,6 +16,9 @@ var (
 	ErrSamePassword = errors.New("auth error: old password and new password must not match")
 	// ErrUserExists is returned when trying to add user with existing username
 	ErrUserExists = errors.New("auth error: user already exists")
+	// ErrAccountLocked is returned when user has reached the limit
+	// of failed login attempts set with WithLockout
+	ErrAccountLocked = errors.New("auth error: account is locked after too many failed login attempts")
 )
 
 // ExposedInterface is an interface intended to be exposed to outside world / client application
@@ -29,20 +32,35 @@ type AppInterface interface {
 	DelUser(username string, password string) error
 	GetUserInfo(username, password string) (UserInfo, error)
 	UpdateUserInfo(username, password string, newinfo UserInfo) error
+	SetUserEmail(username, password, email string) error
+	RequestEmailVerification(username, password string) error
+	ConfirmEmail(username, code string) error
+	EnrollTOTP(username, password string) (uri string, err error)
+	ConfirmTOTP(username, password, code string) error
+	DisableTOTP(username, password, code string) error
+	CheckUserTOTP(username, password, code string) error
+	GenerateRecoveryCodes(username, password string) ([]string, error)
+	RecoveryCodesLeft(username, password string) (int, error)
+	CreateAPIKey(username, password, name string, expires time.Time, scopes []string) (key string, err error)
+	ListAPIKeys(username, password string) ([]APIKey, error)
+	RevokeAPIKey(username, password, id string) error
+	CheckAPIKey(key string) (APIKey, error)
 }
 
 // Exposed holds ExposedInterface
 type appinterface struct {
 	UserAccountStorage
 	PasswordHasher
+	opts options
 }
 
 // NewExposedInterface creates instnce of Exposed
-func NewAppInterface(st UserAccountStorage) (AppInterface, error) {
+func NewAppInterface(st UserAccountStorage, opts ...Option) (AppInterface, error) {
 	if st == nil {
 		return nil, fmt.Errorf("error: storage is nil")
 	}
-	return &appinterface{st, globalHasher}, nil
+	o := newOptions(opts)
+	return &appinterface{NewPolicyStorage(st, o.usernamePolicy), o.passwordHasher(), o}, nil
 }
 
 // CheckUserPassword fetches UserInfo from underlying UserInfoStorage and uses
@@ -50,29 +68,83 @@ func NewAppInterface(st UserAccountStorage) (AppInterface, error) {
 // Returns nil is password checks out else error.
 // If fetch from starage fails returns underlying error.
 func (app *appinterface) CheckUserPassword(username string, password string) error {
+	err := retryOnConflict(func() error { return app.checkUserPassword(username, password) })
+	app.opts.emit(EventLogin, SourceApp, username, err)
+	return err
+}
+
+func (app *appinterface) checkUserPassword(username string, password string) error {
 	account, err := app.Get(username)
 	if err != nil {
 		return err
 	}
+	if app.lockedOut(account) {
+		return ErrAccountLocked
+	}
 	if account.MustChangePassword {
 		return ErrMustChangePassword
 	}
-	err = app.CompareUserPasswordWithHash(account.PasswordHash, password)
-	if err != nil {
-		account.FailedLoginAttempts++
-		err = ErrInvalidPassword
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return app.loginFailed(account, ErrInvalidPassword)
+	}
+	if app.opts.requireVerifiedEmail && !account.EmailVerified {
+		err = ErrEmailNotVerified
 	} else {
-		account.Lastlogin = time.Now()
+		account.Lastlogin = app.opts.now()
+		// users with two-factor authentication have not
+		// logged in until they provide one-time code
+		if app.opts.lockout > 0 && !account.TOTPConfirmed {
+			account.FailedLoginAttempts = 0
+		}
+		app.rehashIfNeeded(&account, password)
 	}
-	if e := app.Upd(account); e != nil {
+	if e := app.Upd(account); errors.Is(e, ErrConflict) {
+		return e
+	} else if e != nil {
 		log.Printf("error putting userinfo: %v", e)
 	}
 	return err
 }
 
+// lockedOut reports whether account has reached the limit of WithLockout
+func (app *appinterface) lockedOut(account Account) bool {
+	return app.opts.lockout > 0 && account.FailedLoginAttempts >= app.opts.lockout
+}
+
+// loginFailed counts failed password or one-time code check of account
+// and emits EventAccountLocked when the limit of WithLockout is reached.
+// It returns cause unless account was changed concurrently.
+func (app *appinterface) loginFailed(account Account, cause error) error {
+	account.FailedLoginAttempts++
+	if err := app.Upd(account); errors.Is(err, ErrConflict) {
+		return err
+	} else if err != nil {
+		log.Printf("error putting userinfo: %v", err)
+	} else if app.lockedOut(account) {
+		app.opts.emit(EventAccountLocked, SourceApp, account.UserName, nil)
+	}
+	return cause
+}
+
+// rehashIfNeeded replaces outdated password hash after
+// user has provided correct password
+func (app *appinterface) rehashIfNeeded(account *Account, password string) {
+	rh, ok := app.PasswordHasher.(PasswordRehasher)
+	if !ok || !rh.NeedsRehash(account.PasswordHash) {
+		return
+	}
+	hash, err := app.HashPassword(password)
+	if err != nil {
+		log.Printf("error rehashing password of %v: %v", account.UserName, err)
+		return
+	}
+	account.PasswordHash = hash
+}
+
 // AddUser adds new UserInfo to underlying IserInfoStorage.
-func (app *appinterface) AddUser(username string, password string) error {
-	_, err := app.Get(username)
+func (app *appinterface) AddUser(username string, password string) (err error) {
+	defer func() { app.opts.emit(EventUserCreated, SourceApp, username, err) }()
+	_, err = app.Get(username)
 	if err == nil {
 		return ErrUserExists
 	}
@@ -80,7 +152,7 @@ func (app *appinterface) AddUser(username string, password string) error {
 	if err != nil {
 		return err
 	}
-	t := time.Now()
+	t := app.opts.now()
 	var account Account
 	account.UserName = username
 	account.PasswordHash = hash
@@ -92,13 +164,14 @@ func (app *appinterface) AddUser(username string, password string) error {
 
 // DelUser deletes UserInfo with UserName == username from underlying
 // UserInfoStorage.
-func (app *appinterface) DelUser(username string, password string) error {
+func (app *appinterface) DelUser(username string, password string) (err error) {
+	defer func() { app.opts.emit(EventUserDeleted, SourceApp, username, err) }()
 	account, err := app.Get(username)
 	if err != nil {
 		return err
 	}
 	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
-		return err
+		return ErrInvalidPassword
 	}
 	return app.Del(username)
 }
@@ -106,6 +179,12 @@ func (app *appinterface) DelUser(username string, password string) error {
 // ChangeUserPassword fetches UserInfo for username from storage, verifies user current password,
 // hashes new password and updates UserInfo in underlying storage.
 func (app *appinterface) ChangeUserPassword(username string, oldpassword string, newpassword string) error {
+	err := retryOnConflict(func() error { return app.changeUserPassword(username, oldpassword, newpassword) })
+	app.opts.emit(EventPasswordChanged, SourceApp, username, err)
+	return err
+}
+
+func (app *appinterface) changeUserPassword(username string, oldpassword string, newpassword string) error {
 	if oldpassword == newpassword {
 		return ErrSamePassword
 	}
@@ -116,7 +195,7 @@ func (app *appinterface) ChangeUserPassword(username string, oldpassword string,
 	if !account.MustChangePassword {
 		err := app.CompareUserPasswordWithHash(account.PasswordHash, oldpassword)
 		if err != nil {
-			return err
+			return ErrInvalidPassword
 		}
 	}
 	hash, err := app.HashPassword(newpassword)
@@ -124,7 +203,7 @@ func (app *appinterface) ChangeUserPassword(username string, oldpassword string,
 		return err
 	}
 	account.PasswordHash = hash
-	account.DateChanged = time.Now()
+	account.DateChanged = app.opts.now()
 	account.MustChangePassword = false
 	return app.Upd(account)
 }
@@ -141,6 +220,10 @@ func (app *appinterface) GetUserInfo(username, password string) (UserInfo, error
 }
 
 func (app *appinterface) UpdateUserInfo(username, password string, newinfo UserInfo) error {
+	return retryOnConflict(func() error { return app.updateUserInfo(username, password, newinfo) })
+}
+
+func (app *appinterface) updateUserInfo(username, password string, newinfo UserInfo) error {
 	account, err := app.Get(username)
 	if err != nil {
 		return err
@@ -149,6 +232,6 @@ func (app *appinterface) UpdateUserInfo(username, password string, newinfo UserI
 		return ErrInvalidPassword
 	}
 	account.User = newinfo
-	account.DateChanged = time.Now()
-	return app.Put(account)
+	account.DateChanged = app.opts.now()
+	return app.Upd(account)
 }
@@ -1,8 +1,10 @@
 package basicauth_test
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/dmfed/basicauth"
@@ -57,3 +59,109 @@ func TestExposedInterface(t *testing.T) {
 	st.Close()
 	os.Remove(filename)
 }
+
+func TestEmailVerification(t *testing.T) {
+	fmt.Println("Testing email verification...")
+	filename := "./test_verify.json"
+	st, err := storage.NewJSONPasswordKeeper(filename)
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed", err)
+		t.FailNow()
+	}
+	defer os.Remove(filename)
+	defer st.Close()
+	var outbox bytes.Buffer
+	ex, _ := basicauth.NewAppInterface(st, basicauth.WithNotifier(basicauth.NewWriterNotifier(&outbox)), basicauth.WithRequireVerifiedEmail(true))
+	ex.AddUser("joe", "passwd")
+	if err := ex.RequestEmailVerification("joe", "passwd"); err != basicauth.ErrNoEmail {
+		fmt.Println("RequestEmailVerification without email returned:", err)
+		t.Fail()
+	}
+	if err := ex.SetUserEmail("joe", "passwd", "joe@example.com"); err != nil {
+		fmt.Println("SetUserEmail returned:", err)
+		t.Fail()
+	}
+	if err := ex.CheckUserPassword("joe", "passwd"); err != basicauth.ErrEmailNotVerified {
+		fmt.Println("CheckUserPassword for unverified user returned:", err)
+		t.Fail()
+	}
+	if err := ex.RequestEmailVerification("joe", "passwd"); err != nil {
+		fmt.Println("RequestEmailVerification returned:", err)
+		t.Fail()
+	}
+	var code string
+	if i := strings.Index(outbox.String(), "code is: "); i >= 0 {
+		code = outbox.String()[i+9 : i+15]
+	}
+	if err := ex.ConfirmEmail("joe", "not a code"); err != basicauth.ErrInvalidVerificationCode {
+		fmt.Println("ConfirmEmail with invalid code returned:", err)
+		t.Fail()
+	}
+	if err := ex.ConfirmEmail("joe", code); err != nil {
+		fmt.Println("ConfirmEmail with valid code returned:", err)
+		t.Fail()
+	}
+	if err := ex.CheckUserPassword("joe", "passwd"); err != nil {
+		fmt.Println("CheckUserPassword for verified user returned:", err)
+		t.Fail()
+	}
+}
+
+// racingStorage changes the account behind the back of
+// the interface before the first Upd
+type racingStorage struct {
+	basicauth.UserAccountStorage
+	raced bool
+}
+
+func (rs *racingStorage) Upd(account basicauth.Account) error {
+	if !rs.raced {
+		rs.raced = true
+		other, _ := rs.Get(account.UserName)
+		other.User.Comment = "changed by admin"
+		rs.UserAccountStorage.Upd(other)
+	}
+	return rs.UserAccountStorage.Upd(account)
+}
+
+func TestConflictRetry(t *testing.T) {
+	fmt.Println("Testing retries on concurrent changes...")
+	filename := "./test_conflict.json"
+	defer os.Remove(filename)
+	st, _ := storage.NewJSONPasswordKeeper(filename)
+	rs := &racingStorage{UserAccountStorage: st}
+	app, _ := basicauth.NewAppInterface(rs)
+	app.AddUser("joe", "passwd")
+	if err := app.CheckUserPassword("joe", "wrong"); err != basicauth.ErrInvalidPassword {
+		fmt.Println("CheckUserPassword with wrong password returned:", err)
+		t.Fail()
+	}
+	account, _ := st.Get("joe")
+	if account.User.Comment != "changed by admin" || account.FailedLoginAttempts != 1 || account.Version != 2 {
+		fmt.Println("concurrent change was lost:", account.User.Comment, account.FailedLoginAttempts, account.Version)
+		t.Fail()
+	}
+	admin, _ := basicauth.NewAdminInterface(st)
+	stale := account
+	account.User.Name = "Joe"
+	if err := admin.AdminUpdAccount(account); err != nil {
+		fmt.Println("AdminUpdAccount returned:", err)
+		t.Fail()
+	}
+	if err := admin.AdminUpdAccount(stale); err != basicauth.ErrConflict {
+		fmt.Println("AdminUpdAccount with stale version returned:", err)
+		t.Fail()
+	}
+	accounts, _, _ := admin.AdminListAccounts(basicauth.ListQuery{})
+	if len(accounts) != 1 || accounts[0].PasswordHash != "" {
+		fmt.Println("AdminListAccounts returned password hash")
+		t.FailNow()
+	}
+	account = accounts[0]
+	account.User.Name = "Joseph"
+	admin.AdminUpdAccount(account)
+	if err := app.CheckUserPassword("joe", "passwd"); err != nil {
+		fmt.Println("CheckUserPassword after AdminUpdAccount with stripped account returned:", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,297 @@
+// Package audit keeps tamper-evident trail of security relevant actions.
+//
+// Log is an append-only file of JSON lines. Every entry carries sequence
+// number and HMAC-SHA-256 of its content chained with hash of the previous
+// entry, so that removed, reordered or edited entries are detected by Verify.
+// The HMAC key must be kept outside of the log file, e.g. in configuration
+// of the server, as anyone who has the key can forge the whole chain.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+var (
+	// ErrTampered is returned by Verify and OpenLog when the chain of
+	// entries is broken: an entry was edited, removed or inserted
+	ErrTampered = errors.New("audit error: log has been tampered with")
+	// ErrTornTail is returned by Verify when the last line of the log is
+	// not terminated, as left by a crash in the middle of Append. OpenLog
+	// truncates such line.
+	ErrTornTail = errors.New("audit error: log ends with incomplete entry")
+	// ErrClosed is returned when appending to closed Log
+	ErrClosed = errors.New("audit error: log is closed")
+	// ErrNoKey is returned when empty HMAC key is given
+	ErrNoKey = errors.New("audit error: key is empty")
+)
+
+// writeLog writes entry to log file, replaced in tests to simulate failures
+var writeLog = (*os.File).Write
+
+// Entry is a single record of the audit log
+type Entry struct {
+	Seq  uint64
+	Time time.Time
+	// Actor is who performed the action, e.g. "admin:<token id>" for
+	// requests to auth server or event source for basicauth events
+	Actor        string
+	IP           string `json:",omitempty"`
+	ForwardedFor string `json:",omitempty"`
+	Realm        string `json:",omitempty"`
+	RequestID    string `json:",omitempty"`
+	Action       string
+	UserName     string `json:",omitempty"`
+	Success      bool
+	Error        string `json:",omitempty"`
+	PrevHash     string
+	Hash         string
+}
+
+// hash returns hex encoded HMAC-SHA-256 of entry content with Hash field cleared
+func (e Entry) hash(key []byte) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Log appends entries to a file. It is safe for concurrent use.
+type Log struct {
+	file     *os.File
+	key      []byte
+	seq      uint64
+	lasthash string
+	now      func() time.Time
+	mutex    sync.Mutex
+}
+
+// OpenLog opens (or creates) audit log kept in filename. Entries are hashed
+// with HMAC key, which must be the same every time the log is opened.
+// Existing entries are verified, OpenLog returns error wrapping ErrTampered
+// if the chain is broken so that new entries are never chained to forged ones.
+// Incomplete last entry left by a crash is truncated with a warning.
+func OpenLog(filename string, key []byte) (*Log, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("empty filename provided. will do nothing")
+	}
+	if len(key) == 0 {
+		return nil, ErrNoKey
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{file: f, key: append([]byte(nil), key...), now: time.Now}
+	last, _, size, err := verify(io.NewSectionReader(f, 0, 1<<62), l.key)
+	if errors.Is(err, ErrTornTail) {
+		log.Printf("audit: truncating incomplete entry at the end of %v at offset %v", filename, size)
+		if err = f.Truncate(size); err == nil {
+			err = f.Sync()
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.seq, l.lasthash = last.Seq, last.Hash
+	return l, nil
+}
+
+// Append fills in Seq, hashes and Time (unless set) and writes e to
+// the log. The write is synced to disk before Append returns. If the
+// write fails the log is truncated back, so that partial entry does not
+// break the chain.
+func (l *Log) Append(e Entry) (Entry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return Entry{}, ErrClosed
+	}
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+	e.Time = e.Time.UTC()
+	e.Seq = l.seq + 1
+	e.PrevHash = l.lasthash
+	e.Hash = e.hash(l.key)
+	data, err := json.Marshal(e)
+	if err != nil {
+		return Entry{}, err
+	}
+	data = append(data, '\n')
+	offset, err := l.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Entry{}, err
+	}
+	if _, err := writeLog(l.file, data); err != nil {
+		return Entry{}, l.rollback(offset, err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return Entry{}, l.rollback(offset, err)
+	}
+	l.seq, l.lasthash = e.Seq, e.Hash
+	return e, nil
+}
+
+// rollback truncates log file to offset after failed write and returns err.
+// It is called with mutex held.
+func (l *Log) rollback(offset int64, err error) error {
+	if terr := l.file.Truncate(offset); terr != nil {
+		log.Printf("audit: error truncating log after failed write: %v", terr)
+	}
+	return err
+}
+
+// Emit records basicauth.Event, so that Log can be passed to
+// basicauth.WithEventSink. Write errors are logged.
+func (l *Log) Emit(ev basicauth.Event) {
+	e := Entry{Time: ev.Time, Actor: ev.Source, IP: ev.ClientIP, Realm: ev.Realm, RequestID: ev.RequestID, Action: string(ev.Type), UserName: ev.UserName, Success: ev.Success, Error: ev.Error}
+	if _, err := l.Append(e); err != nil {
+		log.Printf("audit: error recording event %v of %v: %v", ev.Type, ev.UserName, err)
+	}
+}
+
+// Verify checks the whole log and returns number of entries in it
+func (l *Log) Verify() (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return 0, ErrClosed
+	}
+	_, n, _, err := verify(io.NewSectionReader(l.file, 0, 1<<62), l.key)
+	return n, err
+}
+
+// Query returns entries matching q in log order
+func (l *Log) Query(q Query) ([]Entry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil, ErrClosed
+	}
+	return Read(io.NewSectionReader(l.file, 0, 1<<62), q)
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Verify reads log from r and checks that entries are numbered without gaps,
+// that each one is chained to the previous one and that no entry was edited.
+// key is HMAC key the log was written with. It returns the last entry and
+// number of entries read. Entries removed from the end of the log are only
+// detected by comparing the last entry with one recorded elsewhere.
+// Unterminated last line is reported with ErrTornTail: Append writes
+// the line with its newline at once, so such entry was never recorded.
+func Verify(r io.Reader, key []byte) (last Entry, n int, err error) {
+	last, n, _, err = verify(r, key)
+	return last, n, err
+}
+
+// verify is Verify which also returns size of verified part of the log
+func verify(r io.Reader, key []byte) (last Entry, n int, size int64, err error) {
+	if len(key) == 0 {
+		return last, n, size, ErrNoKey
+	}
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			return last, n, size, nil
+		}
+		if err != nil && err != io.EOF {
+			return last, n, size, err
+		}
+		torn := err == io.EOF
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			if torn {
+				return last, n, size, fmt.Errorf("%w: line %d: %v", ErrTornTail, line, err)
+			}
+			return last, n, size, fmt.Errorf("%w: line %d: %v", ErrTampered, line, err)
+		}
+		switch {
+		case e.Seq != last.Seq+1:
+			return last, n, size, fmt.Errorf("%w: line %d: expected entry %d, got %d", ErrTampered, line, last.Seq+1, e.Seq)
+		case e.PrevHash != last.Hash:
+			return last, n, size, fmt.Errorf("%w: line %d: entry %d is not chained to the previous one", ErrTampered, line, e.Seq)
+		case !hmac.Equal([]byte(e.Hash), []byte(e.hash(key))) || !canonical(e, data):
+			return last, n, size, fmt.Errorf("%w: line %d: entry %d has been edited", ErrTampered, line, e.Seq)
+		case torn:
+			return last, n, size, fmt.Errorf("%w: line %d: entry %d is not terminated", ErrTornTail, line, e.Seq)
+		}
+		last = e
+		n++
+		size += int64(len(data))
+	}
+}
+
+// canonical reports whether data is exactly what Append writes for e.
+// It catches edits which do not change decoded entry such as added fields.
+func canonical(e Entry, data []byte) bool {
+	encoded, err := json.Marshal(e)
+	return err == nil && bytes.Equal(encoded, bytes.TrimSuffix(data, []byte("\n")))
+}
+
+// Query selects audit entries. Zero fields match everything.
+type Query struct {
+	UserName string
+	Action   string
+	// Since and Until limit time of entries, Until is exclusive
+	Since time.Time
+	Until time.Time
+	// Limit is maximum number of entries returned
+	Limit int
+}
+
+func (q Query) match(e Entry) bool {
+	return (q.UserName == "" || e.UserName == q.UserName) &&
+		(q.Action == "" || e.Action == q.Action) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// Read returns entries of log read from r which match q.
+// It does not verify the log.
+func Read(r io.Reader, q Query) ([]Entry, error) {
+	var entries []Entry
+	dec := json.NewDecoder(r)
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, err
+		}
+		if !q.match(e) {
+			continue
+		}
+		entries = append(entries, e)
+		if q.Limit > 0 && len(entries) >= q.Limit {
+			return entries, nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+func TestLog(t *testing.T) {
+	fmt.Println("Testing audit log...")
+	filename := "./test_audit.log"
+	defer os.Remove(filename)
+	key := []byte("auditkey")
+	if _, err := OpenLog(filename, nil); err != ErrNoKey {
+		fmt.Println("OpenLog without key returned:", err)
+		t.Fail()
+	}
+	l, err := OpenLog(filename, key)
+	if err != nil {
+		fmt.Println("OpenLog returned:", err)
+		t.FailNow()
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.Append(Entry{Time: start, Actor: "admin:01", IP: "10.0.0.1", Action: "adminaddaccount", UserName: "joe", Success: true})
+	l.Append(Entry{Time: start.Add(time.Hour), Actor: "app:02", IP: "10.0.0.2", Action: "login", UserName: "joe", Error: "auth error: invalid password"})
+	l.Emit(basicauth.Event{Type: basicauth.EventPasswordChanged, UserName: "ann", Time: start.Add(2 * time.Hour), Success: true, Source: basicauth.SourceApp})
+	if n, err := l.Verify(); err != nil || n != 3 {
+		fmt.Println("Verify of valid log returned:", n, err)
+		t.Fail()
+	}
+	l.Close()
+
+	// reopened log continues the chain
+	l, err = OpenLog(filename, key)
+	if err != nil {
+		fmt.Println("OpenLog of existing log returned:", err)
+		t.FailNow()
+	}
+	if e, _ := l.Append(Entry{Time: start.Add(3 * time.Hour), Actor: "app:02", Action: "logout", UserName: "joe", Success: true}); e.Seq != 4 || e.PrevHash == "" {
+		fmt.Println("entry appended after reopen:", e)
+		t.Fail()
+	}
+	entries, _ := l.Query(Query{UserName: "joe", Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)})
+	if len(entries) != 1 || entries[0].Action != "login" || entries[0].IP != "10.0.0.2" {
+		fmt.Println("Query by user and time returned:", entries)
+		t.Fail()
+	}
+	if entries, _ := l.Query(Query{UserName: "joe", Limit: 2}); len(entries) != 2 {
+		fmt.Println("Query with limit returned:", entries)
+		t.Fail()
+	}
+
+	// failed write must not leave partial entry in the log
+	writeLog = func(f *os.File, data []byte) (int, error) {
+		n, _ := f.Write(data[:len(data)/2])
+		return n, fmt.Errorf("simulated failure")
+	}
+	_, err = l.Append(Entry{Actor: "app:02", Action: "login", UserName: "ann"})
+	writeLog = (*os.File).Write
+	if err == nil {
+		fmt.Println("Append did not return error when write failed")
+		t.Fail()
+	}
+	if e, err := l.Append(Entry{Actor: "app:02", Action: "login", UserName: "ann"}); err != nil || e.Seq != 5 {
+		fmt.Println("Append after failed write returned:", e, err)
+		t.Fail()
+	}
+	if n, err := l.Verify(); err != nil || n != 5 {
+		fmt.Println("Verify after failed write returned:", n, err)
+		t.Fail()
+	}
+	l.Close()
+	if _, err := l.Append(Entry{Action: "login"}); err != ErrClosed {
+		fmt.Println("Append to closed log returned:", err)
+		t.Fail()
+	}
+
+	data, _ := os.ReadFile(filename)
+	lines := strings.SplitAfter(string(data), "\n")
+	tampered := map[string]string{
+		"edited":    strings.Join(lines[:1], "") + strings.Replace(lines[1], `"Success":false`, `"Success":true`, 1) + strings.Join(lines[2:], ""),
+		"removed":   lines[0] + strings.Join(lines[2:], ""),
+		"reordered": lines[1] + lines[0] + strings.Join(lines[2:], ""),
+		"extended":  lines[0] + strings.Replace(lines[1], `{`, `{"Note":"x",`, 1) + strings.Join(lines[2:], ""),
+	}
+	for name, log := range tampered {
+		if _, _, err := Verify(bytes.NewReader([]byte(log)), key); !errors.Is(err, ErrTampered) {
+			fmt.Printf("Verify of %v log returned: %v\n", name, err)
+			t.Fail()
+		}
+	}
+	// chain can not be recomputed without the key
+	if _, err := OpenLog(filename, []byte("otherkey")); !errors.Is(err, ErrTampered) {
+		fmt.Println("OpenLog with wrong key returned:", err)
+		t.Fail()
+	}
+	os.WriteFile(filename, []byte(tampered["removed"]), 0600)
+	if _, err := OpenLog(filename, key); !errors.Is(err, ErrTampered) {
+		fmt.Println("OpenLog of tampered log returned:", err)
+		t.Fail()
+	}
+
+	// crash in the middle of Append leaves incomplete last line
+	torn := string(data) + lines[1][:len(lines[1])/2]
+	if _, _, err := Verify(strings.NewReader(torn), key); !errors.Is(err, ErrTornTail) {
+		fmt.Println("Verify of log with incomplete last line returned:", err)
+		t.Fail()
+	}
+	if _, _, err := Verify(strings.NewReader(tampered["edited"]+lines[1][:10]), key); !errors.Is(err, ErrTampered) {
+		fmt.Println("Verify of edited log with incomplete last line returned:", err)
+		t.Fail()
+	}
+	os.WriteFile(filename, []byte(torn), 0600)
+	l, err = OpenLog(filename, key)
+	if err != nil {
+		fmt.Println("OpenLog of log with incomplete last line returned:", err)
+		t.FailNow()
+	}
+	if e, err := l.Append(Entry{Actor: "app:02", Action: "logout", UserName: "ann"}); err != nil || e.Seq != 6 {
+		fmt.Println("Append after truncating incomplete line returned:", e, err)
+		t.Fail()
+	}
+	if n, err := l.Verify(); err != nil || n != 6 {
+		fmt.Println("Verify after truncating incomplete line returned:", n, err)
+		t.Fail()
+	}
+	l.Close()
+}
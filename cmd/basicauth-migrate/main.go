@@ -0,0 +1,154 @@
+// Command basicauth-migrate copies accounts between basicauth storages
+// and exports or imports them as NDJSON.
+//
+// Storages are given as kind:path where kind is one of json, journal,
+// bolt, sqlite, htpasswd, remote or remotetls. Path of remote storage is
+// host:port of auth server, storage token is read from BASICAUTH_STORAGE_TOKEN.
+// For example:
+//
+//	basicauth-migrate -from json:users.json -to bolt:users.db -dry-run
+//	basicauth-migrate -from json:users.json -export backup.ndjson
+//	basicauth-migrate -import backup.ndjson -to sqlite:users.sqlite -conflict overwrite
+//	basicauth-migrate -from htpasswd:/etc/apache2/.htpasswd -to json:users.json
+//	basicauth-migrate -from remote:10.0.0.5:8080 -export backup.ndjson
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/migrate"
+	authnet "github.com/dmfed/basicauth/net"
+	"github.com/dmfed/basicauth/storage"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// errUsage makes main print usage and exit with status 2
+var errUsage = errors.New("usage")
+
+func main() {
+	if err := run(); err == errUsage {
+		flag.Usage()
+		os.Exit(2)
+	} else if err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+// run does the work of main and returns, so that storages
+// and files are closed before main exits with error status
+func run() error {
+	var (
+		from     = flag.String("from", "", "source storage as kind:path")
+		to       = flag.String("to", "", "destination storage as kind:path")
+		export   = flag.String("export", "", "export source storage to file (- for stdout)")
+		imp      = flag.String("import", "", "import file (- for stdin) into destination storage")
+		dryrun   = flag.Bool("dry-run", false, "report what would be done without writing")
+		conflict = flag.String("conflict", "skip", "what to do with existing accounts: skip, overwrite or fail")
+	)
+	flag.Parse()
+	policy, err := migrate.ParseConflictPolicy(*conflict)
+	if err != nil {
+		return err
+	}
+	opts := migrate.Options{DryRun: *dryrun, Conflict: policy}
+	switch {
+	case *from != "" && *export != "":
+		src, err := open(*from)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		w := io.Writer(os.Stdout)
+		if *export != "-" {
+			f, err := os.Create(*export)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return printReport(migrate.Export(src, w))
+	case *imp != "" && *to != "":
+		dst, err := open(*to)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		r := io.Reader(os.Stdin)
+		if *imp != "-" {
+			f, err := os.Open(*imp)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		return printReport(migrate.Import(r, dst, opts))
+	case *from != "" && *to != "":
+		src, err := open(*from)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := open(*to)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		return printReport(migrate.Migrate(src, dst, opts))
+	}
+	return errUsage
+}
+
+// printReport prints report to stderr and passes err through
+func printReport(report migrate.Report, err error) error {
+	fmt.Fprintln(os.Stderr, report)
+	return err
+}
+
+func open(spec string) (basicauth.UserAccountStorage, error) {
+	st, err := openStorage(spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %v: %w", spec, err)
+	}
+	return st, nil
+}
+
+func openStorage(spec string) (basicauth.UserAccountStorage, error) {
+	kind, path := "json", spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, path = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "json":
+		return storage.OpenJSONPasswordKeeper(path)
+	case "journal":
+		return storage.OpenJournalStorage(path)
+	case "bolt":
+		return storage.OpenBoltStorage(path)
+	case "sqlite":
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			return nil, err
+		}
+		return storage.OpenSQLStorage(db, storage.SQLite)
+	case "htpasswd":
+		return storage.OpenHtpasswdStorage(path)
+	case "remote", "remotetls":
+		i := strings.LastIndex(path, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("remote storage must be given as host:port")
+		}
+		return authnet.NewRemoteStorage(path[:i], path[i+1:], os.Getenv("BASICAUTH_STORAGE_TOKEN"), kind == "remotetls")
+	}
+	return nil, fmt.Errorf("unknown storage kind %q", kind)
+}
@@ -0,0 +1,260 @@
+package basicauth
+
+import "context"
+
+// ContextStorage is implemented by storages which can abort operations
+// when context is done, such as SQL and remote storages.
+type ContextStorage interface {
+	GetContext(ctx context.Context, username string) (Account, error)
+	PutContext(ctx context.Context, account Account) error
+	DelContext(ctx context.Context, username string) error
+	UpdContext(ctx context.Context, account Account) error
+}
+
+// ContextLister is Lister which can abort listing when context is done
+type ContextLister interface {
+	ListContext(ctx context.Context, q ListQuery) (accounts []Account, next string, err error)
+}
+
+// ContextTokenKeeper is TokenKeeper which can abort operations when context is done
+type ContextTokenKeeper interface {
+	NewUserTokenContext(ctx context.Context, username string) (token string, err error)
+	GetUserTokenContext(ctx context.Context, username string) (token string, err error)
+	DelUserTokenContext(ctx context.Context, username string) error
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	clientIPKey
+)
+
+// WithRequestID returns copy of ctx carrying request ID. Interfaces bound
+// to such context put the ID into events, remote clients send it to server.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns request ID set with WithRequestID or empty string
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithClientIP returns copy of ctx carrying address of the client
+// on whose behalf the call is made
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// ClientIP returns client address set with WithClientIP or empty string
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey).(string)
+	return ip
+}
+
+// AppWithContext returns app bound to ctx: storage and token operations made
+// by returned AppInterface are aborted when ctx is done and its events carry
+// request ID and client IP of ctx. Implementations without WithContext method
+// are returned as is.
+func AppWithContext(ctx context.Context, app AppInterface) AppInterface {
+	switch a := app.(type) {
+	case interface {
+		WithContext(context.Context) AppInterface
+	}:
+		return a.WithContext(ctx)
+	case interface {
+		WithContext(context.Context) LoginInterface
+	}:
+		return a.WithContext(ctx)
+	}
+	return app
+}
+
+// LoginWithContext is AppWithContext for LoginInterface
+func LoginWithContext(ctx context.Context, lm LoginInterface) LoginInterface {
+	if l, ok := lm.(interface {
+		WithContext(context.Context) LoginInterface
+	}); ok {
+		return l.WithContext(ctx)
+	}
+	return lm
+}
+
+// AdminWithContext is AppWithContext for AdminInterface
+func AdminWithContext(ctx context.Context, ad AdminInterface) AdminInterface {
+	if a, ok := ad.(interface {
+		WithContext(context.Context) AdminInterface
+	}); ok {
+		return a.WithContext(ctx)
+	}
+	return ad
+}
+
+// WithContext implements AppWithContext
+func (app *appinterface) WithContext(ctx context.Context) AppInterface {
+	bound := *app
+	bound.UserAccountStorage = StorageWithContext(ctx, app.UserAccountStorage)
+	bound.opts.ctx = ctx
+	return &bound
+}
+
+// WithContext implements LoginWithContext
+func (lm *logininterface) WithContext(ctx context.Context) LoginInterface {
+	bound := *lm
+	bound.app = lm.app.WithContext(ctx).(*appinterface)
+	bound.AppInterface = bound.app
+	bound.TokenKeeper = TokenKeeperWithContext(ctx, lm.TokenKeeper)
+	bound.st = StorageWithContext(ctx, lm.st)
+	bound.pending = TokenKeeperWithContext(ctx, lm.pending)
+	bound.opts.ctx = ctx
+	return &bound
+}
+
+// WithContext implements AdminWithContext
+func (ad *admininterface) WithContext(ctx context.Context) AdminInterface {
+	bound := *ad
+	bound.UserAccountStorage = StorageWithContext(ctx, ad.UserAccountStorage)
+	bound.opts.ctx = ctx
+	return &bound
+}
+
+// StorageWithContext returns UserAccountStorage which performs operations of
+// st with ctx. Storages implementing ContextStorage (and ContextLister) get ctx
+// passed, others are only called if ctx is not done yet.
+func StorageWithContext(ctx context.Context, st UserAccountStorage) UserAccountStorage {
+	return &contextStorage{st, ctx}
+}
+
+type contextStorage struct {
+	UserAccountStorage
+	ctx context.Context
+}
+
+func (cs *contextStorage) Get(username string) (Account, error) {
+	return cs.GetContext(cs.ctx, username)
+}
+
+func (cs *contextStorage) Put(account Account) error {
+	return cs.PutContext(cs.ctx, account)
+}
+
+func (cs *contextStorage) Del(username string) error {
+	return cs.DelContext(cs.ctx, username)
+}
+
+func (cs *contextStorage) Upd(account Account) error {
+	return cs.UpdContext(cs.ctx, account)
+}
+
+func (cs *contextStorage) List(q ListQuery) ([]Account, string, error) {
+	return cs.ListContext(cs.ctx, q)
+}
+
+func (cs *contextStorage) GetContext(ctx context.Context, username string) (Account, error) {
+	if c, ok := cs.UserAccountStorage.(ContextStorage); ok {
+		return c.GetContext(ctx, username)
+	}
+	if err := ctx.Err(); err != nil {
+		return Account{}, err
+	}
+	return cs.UserAccountStorage.Get(username)
+}
+
+func (cs *contextStorage) PutContext(ctx context.Context, account Account) error {
+	if c, ok := cs.UserAccountStorage.(ContextStorage); ok {
+		return c.PutContext(ctx, account)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cs.UserAccountStorage.Put(account)
+}
+
+func (cs *contextStorage) DelContext(ctx context.Context, username string) error {
+	if c, ok := cs.UserAccountStorage.(ContextStorage); ok {
+		return c.DelContext(ctx, username)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cs.UserAccountStorage.Del(username)
+}
+
+func (cs *contextStorage) UpdContext(ctx context.Context, account Account) error {
+	if c, ok := cs.UserAccountStorage.(ContextStorage); ok {
+		return c.UpdContext(ctx, account)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cs.UserAccountStorage.Upd(account)
+}
+
+func (cs *contextStorage) ListContext(ctx context.Context, q ListQuery) ([]Account, string, error) {
+	if c, ok := cs.UserAccountStorage.(ContextLister); ok {
+		return c.ListContext(ctx, q)
+	}
+	l, ok := cs.UserAccountStorage.(Lister)
+	if !ok {
+		return nil, "", ErrNotSupported
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	return l.List(q)
+}
+
+// TokenKeeperWithContext returns TokenKeeper which performs operations
+// of tk with ctx the same way as StorageWithContext does.
+func TokenKeeperWithContext(ctx context.Context, tk TokenKeeper) TokenKeeper {
+	return &contextTokenKeeper{tk, ctx}
+}
+
+type contextTokenKeeper struct {
+	TokenKeeper
+	ctx context.Context
+}
+
+func (ct *contextTokenKeeper) NewUserToken(username string) (string, error) {
+	return ct.NewUserTokenContext(ct.ctx, username)
+}
+
+func (ct *contextTokenKeeper) GetUserToken(username string) (string, error) {
+	return ct.GetUserTokenContext(ct.ctx, username)
+}
+
+func (ct *contextTokenKeeper) DelUserToken(username string) error {
+	return ct.DelUserTokenContext(ct.ctx, username)
+}
+
+func (ct *contextTokenKeeper) NewUserTokenContext(ctx context.Context, username string) (string, error) {
+	if c, ok := ct.TokenKeeper.(ContextTokenKeeper); ok {
+		return c.NewUserTokenContext(ctx, username)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return ct.TokenKeeper.NewUserToken(username)
+}
+
+func (ct *contextTokenKeeper) GetUserTokenContext(ctx context.Context, username string) (string, error) {
+	if c, ok := ct.TokenKeeper.(ContextTokenKeeper); ok {
+		return c.GetUserTokenContext(ctx, username)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return ct.TokenKeeper.GetUserToken(username)
+}
+
+func (ct *contextTokenKeeper) DelUserTokenContext(ctx context.Context, username string) error {
+	if c, ok := ct.TokenKeeper.(ContextTokenKeeper); ok {
+		return c.DelUserTokenContext(ctx, username)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return ct.TokenKeeper.DelUserToken(username)
+}
@@ -0,0 +1,112 @@
+package basicauth_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+// ctxRecorder is a context aware storage which remembers request IDs of contexts it gets
+type ctxRecorder struct {
+	basicauth.UserAccountStorage
+	ids []string
+}
+
+func (cr *ctxRecorder) GetContext(ctx context.Context, username string) (basicauth.Account, error) {
+	cr.ids = append(cr.ids, basicauth.RequestID(ctx))
+	if err := ctx.Err(); err != nil {
+		return basicauth.Account{}, err
+	}
+	return cr.UserAccountStorage.Get(username)
+}
+
+func (cr *ctxRecorder) PutContext(ctx context.Context, account basicauth.Account) error {
+	cr.ids = append(cr.ids, basicauth.RequestID(ctx))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cr.UserAccountStorage.Put(account)
+}
+
+func (cr *ctxRecorder) DelContext(ctx context.Context, username string) error {
+	cr.ids = append(cr.ids, basicauth.RequestID(ctx))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cr.UserAccountStorage.Del(username)
+}
+
+func (cr *ctxRecorder) UpdContext(ctx context.Context, account basicauth.Account) error {
+	cr.ids = append(cr.ids, basicauth.RequestID(ctx))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cr.UserAccountStorage.Upd(account)
+}
+
+func (cr *ctxRecorder) List(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	return cr.UserAccountStorage.(basicauth.Lister).List(q)
+}
+
+func TestContext(t *testing.T) {
+	fmt.Println("Testing context binding...")
+	filename := "./test_context.json"
+	st, err := storage.NewJSONPasswordKeeper(filename)
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed", err)
+		t.FailNow()
+	}
+	defer os.Remove(filename)
+	defer st.Close()
+	rec := &ctxRecorder{UserAccountStorage: st}
+	var events eventRecorder
+	lm, _ := basicauth.NewLoginManager(rec, time.Hour, basicauth.WithEventSink(&events), basicauth.WithUsernamePolicy(&basicauth.UsernamePolicy{FoldCase: true}))
+	lm.AddUser("joe", "passwd")
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := basicauth.AppWithContext(canceled, lm).CheckUserPassword("joe", "passwd"); !errors.Is(err, context.Canceled) {
+		fmt.Println("CheckUserPassword with canceled context returned:", err)
+		t.Fail()
+	}
+	if _, err := basicauth.LoginWithContext(canceled, lm).Login("joe", "passwd"); !errors.Is(err, context.Canceled) {
+		fmt.Println("Login with canceled context returned:", err)
+		t.Fail()
+	}
+	if err := lm.CheckUserPassword("joe", "passwd"); err != nil {
+		fmt.Println("CheckUserPassword of unbound interface returned:", err)
+		t.Fail()
+	}
+
+	rec.ids = nil
+	ctx := basicauth.WithClientIP(basicauth.WithRequestID(context.Background(), "req-1"), "10.0.0.1")
+	if _, err := basicauth.LoginWithContext(ctx, lm).Login("JOE", "passwd"); err != nil {
+		fmt.Println("Login with context returned:", err)
+		t.Fail()
+	}
+	if len(rec.ids) == 0 || rec.ids[0] != "req-1" {
+		fmt.Println("storage did not get request context:", rec.ids)
+		t.Fail()
+	}
+	e := events.events[len(events.events)-1]
+	if e.Type != basicauth.EventSessionStarted || e.RequestID != "req-1" || e.ClientIP != "10.0.0.1" {
+		fmt.Println("event of bound interface:", e)
+		t.Fail()
+	}
+
+	ad, _ := basicauth.NewAdminInterface(rec, basicauth.WithEventSink(&events))
+	if err := basicauth.AdminWithContext(canceled, ad).AdminResetUserPassword("joe"); !errors.Is(err, context.Canceled) {
+		fmt.Println("AdminResetUserPassword with canceled context returned:", err)
+		t.Fail()
+	}
+	if _, _, err := basicauth.AdminWithContext(ctx, ad).AdminListAccounts(basicauth.ListQuery{}); err != nil {
+		fmt.Println("AdminListAccounts with context returned:", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,145 @@
+package basicauth
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType tells what happened to account or session
+type EventType string
+
+// Events emitted by AppInterface, AdminInterface and LoginInterface
+const (
+	EventUserCreated     EventType = "user_created"
+	EventUserDeleted     EventType = "user_deleted"
+	EventAccountUpdated  EventType = "account_updated"
+	EventLogin           EventType = "login" // password or one-time code check, see Success
+	EventPasswordChanged EventType = "password_changed"
+	EventPasswordReset   EventType = "password_reset"
+	EventAccountLocked   EventType = "account_locked"
+	EventSessionStarted  EventType = "session_started"
+	EventSessionEnded    EventType = "session_ended"
+)
+
+// Sources of events
+const (
+	SourceApp   = "app"
+	SourceAdmin = "admin"
+	SourceLogin = "login"
+)
+
+// Event describes a change of account or session. Events are emitted for
+// failed operations too, Error then holds the reason.
+type Event struct {
+	Type     EventType
+	UserName string
+	Time     time.Time
+	Success  bool
+	Error    string `json:",omitempty"`
+	Source   string
+	// Realm is set by auth server which serves several realms
+	Realm string `json:",omitempty"`
+	// RequestID and ClientIP come from context the interface
+	// was bound to (see AppWithContext)
+	RequestID string `json:",omitempty"`
+	ClientIP  string `json:",omitempty"`
+}
+
+// EventSink receives events. Emit is called synchronously
+// by the interfaces, slow sinks should be wrapped with NewAsyncSink.
+type EventSink interface {
+	Emit(Event)
+}
+
+// EventSinkFunc allows to use ordinary function as EventSink
+type EventSinkFunc func(Event)
+
+// Emit calls f(e)
+func (f EventSinkFunc) Emit(e Event) {
+	f(e)
+}
+
+type multiSink []EventSink
+
+// MultiSink returns EventSink which passes every event to all sinks in order
+func MultiSink(sinks ...EventSink) EventSink {
+	return multiSink(sinks)
+}
+
+func (ms multiSink) Emit(e Event) {
+	for _, sink := range ms {
+		sink.Emit(e)
+	}
+}
+
+// AsyncSink delivers events to another sink in background
+type AsyncSink struct {
+	sink    EventSink
+	events  chan Event
+	done    chan struct{}
+	mutex   sync.Mutex
+	closed  bool
+	dropped int64
+}
+
+// NewAsyncSink returns sink which queues up to buffer events and passes them
+// to sink from a separate goroutine. Events are dropped when the queue is full,
+// so that slow sink never blocks authentication.
+func NewAsyncSink(sink EventSink, buffer int) *AsyncSink {
+	as := &AsyncSink{sink: sink, events: make(chan Event, buffer), done: make(chan struct{})}
+	go func() {
+		defer close(as.done)
+		for e := range as.events {
+			as.sink.Emit(e)
+		}
+	}()
+	return as
+}
+
+// Emit queues e or drops it if the queue is full
+func (as *AsyncSink) Emit(e Event) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	if as.closed {
+		as.dropped++
+		return
+	}
+	select {
+	case as.events <- e:
+	default:
+		as.dropped++
+	}
+}
+
+// Dropped returns number of events dropped so far
+func (as *AsyncSink) Dropped() int64 {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	return as.dropped
+}
+
+// Close delivers queued events and stops the sink
+func (as *AsyncSink) Close() {
+	as.mutex.Lock()
+	if !as.closed {
+		as.closed = true
+		close(as.events)
+	}
+	as.mutex.Unlock()
+	<-as.done
+}
+
+// emit sends event to configured sink if any
+func (o options) emit(t EventType, source, username string, err error) {
+	if o.events == nil {
+		return
+	}
+	e := Event{Type: t, UserName: username, Time: o.now(), Success: err == nil, Source: source}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if o.ctx != nil {
+		e.RequestID, e.ClientIP = RequestID(o.ctx), ClientIP(o.ctx)
+	}
+	o.events.Emit(e)
+}
@@ -0,0 +1,186 @@
+package basicauth_test
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []basicauth.Event
+}
+
+func (r *eventRecorder) Emit(e basicauth.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *eventRecorder) types() []basicauth.EventType {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var types []basicauth.EventType
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestEvents(t *testing.T) {
+	fmt.Println("Testing events...")
+	filename := "./test_events.json"
+	st, err := storage.NewJSONPasswordKeeper(filename)
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed", err)
+		t.FailNow()
+	}
+	defer os.Remove(filename)
+	defer st.Close()
+	var rec eventRecorder
+	lm, _ := basicauth.NewLoginManager(st, time.Hour, basicauth.WithEventSink(&rec))
+	lm.AddUser("joe", "passwd")
+	lm.Login("joe", "wrong")
+	lm.Login("joe", "passwd")
+	lm.Logout("joe")
+	lm.ChangeUserPassword("joe", "passwd", "newpasswd")
+	ad, _ := basicauth.NewAdminInterface(st, basicauth.WithEventSink(&rec))
+	ad.AdminResetUserPassword("joe")
+	ad.AdminDelAccount("joe")
+	want := []basicauth.EventType{
+		basicauth.EventUserCreated,
+		basicauth.EventLogin,
+		basicauth.EventLogin,
+		basicauth.EventSessionStarted,
+		basicauth.EventSessionEnded,
+		basicauth.EventPasswordChanged,
+		basicauth.EventPasswordReset,
+		basicauth.EventUserDeleted,
+	}
+	if got := rec.types(); fmt.Sprint(got) != fmt.Sprint(want) {
+		fmt.Println("unexpected events:", got)
+		t.FailNow()
+	}
+	if e := rec.events[1]; e.Success || e.Error == "" || e.UserName != "joe" || e.Source != basicauth.SourceApp {
+		fmt.Println("failed login reported as:", e)
+		t.Fail()
+	}
+	if e := rec.events[3]; !e.Success || e.Source != basicauth.SourceLogin || e.Time.IsZero() {
+		fmt.Println("session start reported as:", e)
+		t.Fail()
+	}
+	if e := rec.events[7]; !e.Success || e.Source != basicauth.SourceAdmin {
+		fmt.Println("admin delete reported as:", e)
+		t.Fail()
+	}
+}
+
+func TestLockout(t *testing.T) {
+	fmt.Println("Testing lockout...")
+	filename := "./test_lockout.json"
+	st, err := storage.NewJSONPasswordKeeper(filename)
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed", err)
+		t.FailNow()
+	}
+	defer os.Remove(filename)
+	defer st.Close()
+	var rec eventRecorder
+	ex, _ := basicauth.NewAppInterface(st, basicauth.WithLockout(3), basicauth.WithEventSink(&rec))
+	ex.AddUser("joe", "passwd")
+	ex.CheckUserPassword("joe", "wrong")
+	ex.CheckUserPassword("joe", "wrong")
+	if err := ex.CheckUserPassword("joe", "passwd"); err != nil {
+		fmt.Println("CheckUserPassword with valid password returned:", err)
+		t.Fail()
+	}
+	if account, _ := st.Get("joe"); account.FailedLoginAttempts != 0 {
+		fmt.Println("FailedLoginAttempts not reset after successful check:", account.FailedLoginAttempts)
+		t.Fail()
+	}
+	for i := 0; i < 3; i++ {
+		ex.CheckUserPassword("joe", "wrong")
+	}
+	if err := ex.CheckUserPassword("joe", "passwd"); err != basicauth.ErrAccountLocked {
+		fmt.Println("CheckUserPassword for locked account returned:", err)
+		t.Fail()
+	}
+	if account, _ := st.Get("joe"); account.Disabled {
+		fmt.Println("lockout disabled account")
+		t.Fail()
+	}
+	account, _ := st.Get("joe")
+	account.FailedLoginAttempts = 0
+	st.Upd(account)
+	if err := ex.CheckUserPassword("joe", "passwd"); err != nil {
+		fmt.Println("CheckUserPassword after unlock returned:", err)
+		t.Fail()
+	}
+
+	// failed one-time codes count towards the limit as well
+	ex.EnrollTOTP("joe", "passwd")
+	account, _ = st.Get("joe")
+	code, _ := basicauth.TOTPCode(account.TOTPSecret, time.Now())
+	ex.ConfirmTOTP("joe", "passwd", code)
+	for i := 0; i < 3; i++ {
+		if err := ex.CheckUserTOTP("joe", "passwd", "000000"); err == nil {
+			fmt.Println("CheckUserTOTP accepted invalid code")
+			t.Fail()
+		}
+	}
+	code, _ = basicauth.TOTPCode(account.TOTPSecret, time.Now().Add(30*time.Second))
+	if err := ex.CheckUserTOTP("joe", "passwd", code); err != basicauth.ErrAccountLocked {
+		fmt.Println("CheckUserTOTP for locked account returned:", err)
+		t.Fail()
+	}
+	locked, failed := 0, 0
+	for _, e := range rec.events {
+		if e.Type == basicauth.EventAccountLocked {
+			locked++
+		}
+		if e.Type == basicauth.EventLogin && !e.Success {
+			failed++
+		}
+	}
+	if locked != 2 {
+		fmt.Println("expected two EventAccountLocked, got", locked)
+		t.Fail()
+	}
+	if failed != 10 {
+		fmt.Println("expected 10 failed EventLogin, got", failed)
+		t.Fail()
+	}
+}
+
+func TestSinks(t *testing.T) {
+	fmt.Println("Testing event sinks...")
+	var a, b eventRecorder
+	sink := basicauth.MultiSink(&a, &b)
+	sink.Emit(basicauth.Event{Type: basicauth.EventLogin})
+	if len(a.events) != 1 || len(b.events) != 1 {
+		fmt.Println("MultiSink did not deliver event to all sinks")
+		t.Fail()
+	}
+	release := make(chan struct{})
+	var c eventRecorder
+	blocking := basicauth.EventSinkFunc(func(e basicauth.Event) {
+		<-release
+		c.Emit(e)
+	})
+	as := basicauth.NewAsyncSink(blocking, 2)
+	for i := 0; i < 5; i++ {
+		as.Emit(basicauth.Event{Type: basicauth.EventLogin})
+	}
+	close(release)
+	as.Close()
+	// first event may be taken by delivery goroutine before the buffer fills
+	if delivered := len(c.events); delivered < 2 || delivered > 3 || int64(delivered)+as.Dropped() != 5 {
+		fmt.Println("AsyncSink delivered", delivered, "dropped", as.Dropped())
+		t.Fail()
+	}
+}
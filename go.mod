@@ -2,4 +2,10 @@ module github.com/dmfed/basicauth
 
 go 1.16
 
-require golang.org/x/crypto v0.0.0-20210317152858-513c2a44f670
+require (
+	github.com/mattn/go-sqlite3 v1.14.16
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20210317152858-513c2a44f670
+	golang.org/x/sys v0.0.0-20210320140829-1e4c9ba3b0c4 // indirect
+	golang.org/x/text v0.3.6
+)
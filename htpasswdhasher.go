@@ -0,0 +1,131 @@
+package basicauth
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrUnsupportedHash is returned when stored hash uses algorithm
+// the hasher can not verify
+var ErrUnsupportedHash = errors.New("auth error: unsupported password hash algorithm")
+
+// PasswordRehasher is optionally implemented by PasswordHasher. If NeedsRehash
+// returns true for hash of the user who has just provided correct password, the
+// hash is replaced with a new one made with HashPassword.
+type PasswordRehasher interface {
+	NeedsRehash(hash string) bool
+}
+
+const (
+	apr1Magic = "$apr1$"
+	shaPrefix = "{SHA}"
+)
+
+type htpasswdHasher struct {
+	defaultBcryptHasher
+}
+
+// NewHtpasswdHasher returns PasswordHasher which verifies hashes found in Apache
+// htpasswd files: bcrypt ($2y$, $2a$, $2b$), apr1-MD5 ($apr1$) and SHA1 ({SHA}).
+// New hashes are always bcrypt and outdated ones are replaced on successful login
+// (it implements PasswordRehasher).
+func NewHtpasswdHasher() PasswordHasher {
+	return &htpasswdHasher{}
+}
+
+func (h *htpasswdHasher) CompareUserPasswordWithHash(hash string, password string) error {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return h.defaultBcryptHasher.CompareUserPasswordWithHash(hash, password)
+	case strings.HasPrefix(hash, apr1Magic):
+		salt := strings.TrimPrefix(hash, apr1Magic)
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1(password, salt)
+	case strings.HasPrefix(hash, shaPrefix):
+		sum := sha1.Sum([]byte(password))
+		computed = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return ErrUnsupportedHash
+	}
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) != 1 {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+func (h *htpasswdHasher) NeedsRehash(hash string) bool {
+	return !strings.HasPrefix(hash, "$2")
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 implements Apache variant of MD5-crypt
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(apr1Magic))
+	ctx.Write([]byte(salt))
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altsum := alt.Sum(nil)
+	for i := len(pw); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		ctx.Write(altsum[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 == 1 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 == 1 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+	var out strings.Builder
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return apr1Magic + salt + "$" + out.String()
+}
@@ -0,0 +1,38 @@
+package basicauth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHtpasswdHasher(t *testing.T) {
+	fmt.Println("Testing htpasswd hasher...")
+	h := NewHtpasswdHasher()
+	bcrypthash, _ := h.HashPassword("password")
+	valid := []string{
+		"$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0",
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		bcrypthash,
+		"$2y$" + strings.TrimPrefix(bcrypthash, "$2a$"),
+	}
+	for _, hash := range valid {
+		if err := h.CompareUserPasswordWithHash(hash, "password"); err != nil {
+			fmt.Println("CompareUserPasswordWithHash", hash, "returned:", err)
+			t.Fail()
+		}
+		if err := h.CompareUserPasswordWithHash(hash, "wrong"); err == nil {
+			fmt.Println("CompareUserPasswordWithHash", hash, "accepted wrong password")
+			t.Fail()
+		}
+	}
+	if got := apr1("hello world", "abc"); got != "$apr1$abc$ZEEdPzlAiMxg.FG8GWQ24/" {
+		fmt.Println("apr1 returned:", got)
+		t.Fail()
+	}
+	rh := h.(PasswordRehasher)
+	if !rh.NeedsRehash(valid[0]) || rh.NeedsRehash(bcrypthash) {
+		fmt.Println("NeedsRehash returned unexpected results")
+		t.Fail()
+	}
+}
@@ -1,14 +1,38 @@
 package basicauth
 
 import (
+	"errors"
 	"fmt"
 	"time"
 )
 
+// ErrConflict is returned by Upd when stored account has
+// been changed since it was read
+var ErrConflict = errors.New("auth error: account was changed concurrently")
+
+// conflictRetries is how many times an operation is attempted
+// when account keeps being changed concurrently
+const conflictRetries = 3
+
+// retryOnConflict runs op again while it fails with ErrConflict. op must
+// read the account anew and must have no side effects before Upd succeeds.
+func retryOnConflict(op func() error) (err error) {
+	for i := 0; i < conflictRetries; i++ {
+		if err = op(); !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
 // UserInfoStorage is required to keep UserInfo
 // this can be either local file, a DB or any remote
 // storage. basicauth/jsonstorage contains simple implementation
 // with JSON file as storage
+//
+// Storages supporting optimistic concurrency control compare Version
+// of account passed to Upd with the stored one, return ErrConflict if
+// they differ and otherwise store the account with Version incremented.
 type UserAccountStorage interface {
 	Get(username string) (Account, error)
 	Put(Account) error
@@ -38,19 +62,41 @@ func (u UserInfo) String() string {
 	return out
 }
 
+// Account is a record of user kept in UserAccountStorage. Account holds
+// slices and is not comparable with ==, use reflect.DeepEqual instead.
 type Account struct {
 	UserName            string
+	Version             int64 `json:",omitempty"` // incremented by storage on every Upd
 	PasswordHash        string
 	DateCreated         time.Time `json:",omitempty"`
 	DateChanged         time.Time `json:",omitempty"`
 	Lastlogin           time.Time `json:",omitempty"`
 	FailedLoginAttempts int       `json:",omitempty"`
 	MustChangePassword  bool      `json:",omitempty"`
+	Disabled            bool      `json:",omitempty"` // set by administrator for ListQuery.OnlyDisabled, has no effect on login
 	User                UserInfo  `json:",omitempty"`
+	// Email is a contact address of the user. It is considered
+	// unverified until user confirms it with a code sent by Notifier.
+	Email                   string    `json:",omitempty"`
+	EmailVerified           bool      `json:",omitempty"`
+	EmailVerifiedAt         time.Time `json:",omitempty"`
+	VerificationCodeHash    string    `json:",omitempty"`
+	VerificationCodeExpires time.Time `json:",omitempty"`
+	VerificationAttempts    int       `json:",omitempty"`
+	// TOTPSecret is base32 encoded secret for one-time codes. Two-factor
+	// authentication is enabled once TOTPConfirmed is set. TOTPLastStep
+	// holds time step of last accepted code to prevent replay.
+	TOTPSecret    string `json:",omitempty"`
+	TOTPConfirmed bool   `json:",omitempty"`
+	TOTPLastStep  int64  `json:",omitempty"`
+	// RecoveryCodes are accepted once each instead of TOTP code
+	RecoveryCodes []RecoveryCode `json:",omitempty"`
+	// APIKeys are keys issued to user for machine access
+	APIKeys []APIKey `json:",omitempty"`
 }
 
 func (acc Account) String() string {
-	out := fmt.Sprintf("username: %v\npwdhash: %v\ncreated: %v\nchanged: %v\nlogin: %v\nfailed: %v\nmustchange: %v\ninfo:\n%v",
-		acc.UserName, acc.PasswordHash, acc.DateCreated, acc.DateChanged, acc.Lastlogin, acc.FailedLoginAttempts, acc.MustChangePassword, acc.User)
+	out := fmt.Sprintf("username: %v\npwdhash: %v\ncreated: %v\nchanged: %v\nlogin: %v\nfailed: %v\nmustchange: %v\ndisabled: %v\nemail: %v (verified: %v)\ntotp: %v\ninfo:\n%v",
+		acc.UserName, acc.PasswordHash, acc.DateCreated, acc.DateChanged, acc.Lastlogin, acc.FailedLoginAttempts, acc.MustChangePassword, acc.Disabled, acc.Email, acc.EmailVerified, acc.TOTPConfirmed, acc.User)
 	return out
 }
@@ -0,0 +1,113 @@
+package basicauth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrNotSupported is returned when storage does not support requested operation
+var ErrNotSupported = errors.New("auth error: operation is not supported by storage")
+
+// DefaultListLimit is number of accounts returned by Lister when ListQuery.Limit is zero
+const DefaultListLimit = 100
+
+// Lister is an optional interface of UserAccountStorage which allows
+// to enumerate accounts. Accounts are returned ordered by username
+// in pages. Next is the cursor to pass in ListQuery to get the next
+// page, it is empty when there are no more accounts.
+type Lister interface {
+	List(q ListQuery) (accounts []Account, next string, err error)
+}
+
+// ListQuery selects accounts returned by Lister. Zero value of
+// ListQuery returns first DefaultListLimit accounts.
+type ListQuery struct {
+	// Cursor is username after which listing starts
+	Cursor string `json:",omitempty"`
+	Limit  int    `json:",omitempty"`
+	// Prefix limits listing to usernames starting with Prefix
+	Prefix string `json:",omitempty"`
+	// OnlyDisabled and OnlyMustChangePassword limit listing to accounts
+	// with the respective flag set
+	OnlyDisabled           bool `json:",omitempty"`
+	OnlyMustChangePassword bool `json:",omitempty"`
+	// LastLoginBefore limits listing to accounts which have not
+	// logged in since the time (including those who never did)
+	LastLoginBefore time.Time `json:",omitempty"`
+}
+
+// PageSize returns Limit or DefaultListLimit if Limit is not set
+func (q ListQuery) PageSize() int {
+	if q.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return q.Limit
+}
+
+// Match reports whether account passes filters of q. Cursor
+// and Limit are not considered.
+func (q ListQuery) Match(account Account) bool {
+	if !strings.HasPrefix(account.UserName, q.Prefix) {
+		return false
+	}
+	if q.OnlyDisabled && !account.Disabled {
+		return false
+	}
+	if q.OnlyMustChangePassword && !account.MustChangePassword {
+		return false
+	}
+	if !q.LastLoginBefore.IsZero() && !account.Lastlogin.Before(q.LastLoginBefore) {
+		return false
+	}
+	return true
+}
+
+// stripSecrets removes password hash and other secrets from account
+func stripSecrets(account Account) Account {
+	account.PasswordHash = ""
+	account.VerificationCodeHash = ""
+	account.TOTPSecret = ""
+	account.RecoveryCodes = nil
+	account.APIKeys = stripAPIKeyHashes(account.APIKeys)
+	return account
+}
+
+// List normalizes Prefix and Cursor of q with policy and passes the call
+// to underlying storage if it implements Lister
+func (ps *policyStorage) List(q ListQuery) ([]Account, string, error) {
+	if l, ok := ps.UserAccountStorage.(Lister); ok {
+		var err error
+		if q.Prefix, err = ps.policy.normalize(q.Prefix); err != nil {
+			return nil, "", nil // no username can start with such prefix
+		}
+		if q.Cursor, err = ps.policy.normalize(q.Cursor); err != nil {
+			return nil, "", err
+		}
+		return l.List(q)
+	}
+	return nil, "", ErrNotSupported
+}
+
+// ListContext passes the call to underlying storage with ctx
+func (ps *policyStorage) ListContext(ctx context.Context, q ListQuery) ([]Account, string, error) {
+	return ps.bind(ctx).List(q)
+}
+
+// AdminListAccounts returns page of accounts matching q with password
+// hashes and other secrets removed. Storage must implement Lister.
+func (ad *admininterface) AdminListAccounts(q ListQuery) ([]Account, string, error) {
+	l, ok := ad.UserAccountStorage.(Lister)
+	if !ok {
+		return nil, "", ErrNotSupported
+	}
+	accounts, next, err := l.List(q)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range accounts {
+		accounts[i] = stripSecrets(accounts[i])
+	}
+	return accounts, next, nil
+}
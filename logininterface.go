@@ -2,6 +2,7 @@ package basicauth
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -17,27 +18,133 @@ type LoginInterface interface {
 	ChangeUserPassword(username, oldpassword, newpassword string) error
 	GetUserInfo(username, password string) (UserInfo, error)
 	UpdateUserInfo(username, password string, newinfo UserInfo) error
+	SetUserEmail(username, password, email string) error
+	RequestEmailVerification(username, password string) error
+	ConfirmEmail(username, code string) error
+	EnrollTOTP(username, password string) (uri string, err error)
+	ConfirmTOTP(username, password, code string) error
+	DisableTOTP(username, password, code string) error
+	CheckUserTOTP(username, password, code string) error
+	GenerateRecoveryCodes(username, password string) ([]string, error)
+	RecoveryCodesLeft(username, password string) (int, error)
+	CreateAPIKey(username, password, name string, expires time.Time, scopes []string) (key string, err error)
+	ListAPIKeys(username, password string) ([]APIKey, error)
+	RevokeAPIKey(username, password, id string) error
+	CheckAPIKey(key string) (APIKey, error)
+	LoginTOTP(username, pendingtoken, code string) (token string, err error)
 }
 
 type logininterface struct {
 	AppInterface
 	TokenKeeper
+	app    *appinterface
+	st     UserAccountStorage
+	policy *UsernamePolicy
+	// pending keeps tokens of users who passed password
+	// check but still have to provide one-time code
+	pending  TokenKeeper
+	failures *pendingFailures
+	opts     options
+}
+
+const (
+	// pendingLoginDuration is how long user has to complete
+	// login with LoginTOTP after successful password check
+	pendingLoginDuration = time.Minute * 5
+	// maxPendingFailures is how many invalid codes LoginTOTP accepts
+	// before pending token is revoked and login must start over
+	maxPendingFailures = 5
+)
+
+// pendingFailures counts invalid codes given with pending tokens
+type pendingFailures struct {
+	count map[string]int
+	mutex sync.Mutex
+}
+
+// add records failure of username and reports whether limit is reached
+func (pf *pendingFailures) add(username string) bool {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	pf.count[username]++
+	if pf.count[username] < maxPendingFailures {
+		return false
+	}
+	delete(pf.count, username)
+	return true
+}
+
+func (pf *pendingFailures) reset(username string) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	delete(pf.count, username)
 }
 
 // NewLoginManager return instance of LoginManager interface
-func NewLoginManager(st UserAccountStorage, sessionDuration time.Duration) (LoginInterface, error) {
+func NewLoginManager(st UserAccountStorage, sessionDuration time.Duration, opts ...Option) (LoginInterface, error) {
 	if st == nil {
 		return nil, fmt.Errorf("failed to instantiate LoginManager: ex is nil")
 	}
-	app, _ := NewAppInterface(st)
-	tk, _ := NewMemTokenKeeper(sessionDuration)
-	return &logininterface{app, tk}, nil
+	o := newOptions(opts)
+	app := &appinterface{NewPolicyStorage(st, o.usernamePolicy), o.passwordHasher(), o}
+	tk := o.tokens
+	if tk == nil {
+		tk, _ = NewMemTokenKeeper(sessionDuration)
+	}
+	pending, _ := NewMemTokenKeeper(pendingLoginDuration)
+	failures := &pendingFailures{count: make(map[string]int)}
+	return &logininterface{app, tk, app, NewPolicyStorage(st, o.usernamePolicy), o.usernamePolicy, pending, failures, o}, nil
 }
 
+// Login checks user password and returns session token. If user has
+// two-factor authentication enabled Login returns pending token and
+// ErrTOTPRequired. The pending token must be passed to LoginTOTP along
+// with one-time code to get session token.
 func (lm *logininterface) Login(username, password string) (token string, err error) {
+	if username, err = lm.policy.Apply(username); err != nil {
+		return
+	}
 	if err = lm.CheckUserPassword(username, password); err != nil {
 		return
 	}
+	if account, err := lm.st.Get(username); err == nil && account.TOTPConfirmed {
+		pendingtoken, err := lm.pending.NewUserToken(username)
+		if err != nil {
+			return "", err
+		}
+		lm.failures.reset(username)
+		return pendingtoken, ErrTOTPRequired
+	}
+	return lm.newSession(username)
+}
+
+// LoginTOTP completes login started with Login for users with
+// two-factor authentication enabled. After maxPendingFailures invalid
+// codes the pending token is revoked and login must start over.
+func (lm *logininterface) LoginTOTP(username, pendingtoken, code string) (token string, err error) {
+	if username, err = lm.policy.Apply(username); err != nil {
+		return
+	}
+	validtoken, err := lm.pending.GetUserToken(username)
+	if err != nil {
+		return "", err
+	}
+	if pendingtoken != validtoken {
+		return "", ErrInvalidToken
+	}
+	if err := lm.app.checkSecondFactor(username, code); err != nil {
+		if err == ErrInvalidTOTPCode && lm.failures.add(username) {
+			lm.pending.DelUserToken(username)
+		}
+		return "", err
+	}
+	lm.failures.reset(username)
+	lm.pending.DelUserToken(username)
+	return lm.newSession(username)
+}
+
+func (lm *logininterface) newSession(username string) (token string, err error) {
+	defer func() { lm.opts.emit(EventSessionStarted, SourceLogin, username, err) }()
 	if _, err := lm.GetUserToken(username); err == nil {
 		if err := lm.DelUserToken(username); err != nil {
 			return "", err
@@ -47,10 +154,20 @@ func (lm *logininterface) Login(username, password string) (token string, err er
 }
 
 func (lm *logininterface) Logout(username string) error {
-	return lm.DelUserToken(username)
+	username, err := lm.policy.Apply(username)
+	if err != nil {
+		return err
+	}
+	err = lm.DelUserToken(username)
+	lm.opts.emit(EventSessionEnded, SourceLogin, username, err)
+	return err
 }
 
 func (lm *logininterface) CheckUserLoggedIn(username, token string) error {
+	username, err := lm.policy.Apply(username)
+	if err != nil {
+		return err
+	}
 	validtoken, err := lm.GetUserToken(username)
 	if err != nil {
 		return err
@@ -0,0 +1,141 @@
+package basicauth_test
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+func TestLoginTOTP(t *testing.T) {
+	fmt.Println("Testing two-step login with TOTP...")
+	filename := "./test_totp.json"
+	st, err := storage.NewJSONPasswordKeeper(filename)
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed", err)
+		t.FailNow()
+	}
+	defer os.Remove(filename)
+	defer st.Close()
+	clock := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	lm, _ := basicauth.NewLoginManager(st, time.Hour, basicauth.WithClock(func() time.Time { return clock }))
+	lm.AddUser("joe", "passwd")
+	uri, err := lm.EnrollTOTP("joe", "passwd")
+	if err != nil {
+		fmt.Println("EnrollTOTP returned:", err)
+		t.FailNow()
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "otpauth" {
+		fmt.Println("EnrollTOTP returned invalid URI:", uri)
+		t.FailNow()
+	}
+	secret := u.Query().Get("secret")
+	code, _ := basicauth.TOTPCode(secret, clock)
+	if err := lm.ConfirmTOTP("joe", "passwd", code); err != nil {
+		fmt.Println("ConfirmTOTP returned:", err)
+		t.Fail()
+	}
+	pending, err := lm.Login("joe", "passwd")
+	if err != basicauth.ErrTOTPRequired || pending == "" {
+		fmt.Println("Login for user with TOTP enabled returned:", err)
+		t.Fail()
+	}
+	if _, err := lm.LoginTOTP("joe", pending, code); err != basicauth.ErrInvalidTOTPCode {
+		fmt.Println("LoginTOTP accepted replayed code:", err)
+		t.Fail()
+	}
+	clock = clock.Add(time.Minute)
+	code, _ = basicauth.TOTPCode(secret, clock)
+	if _, err := lm.LoginTOTP("joe", "wrongtoken", code); err != basicauth.ErrInvalidToken {
+		fmt.Println("LoginTOTP with invalid pending token returned:", err)
+		t.Fail()
+	}
+	token, err := lm.LoginTOTP("joe", pending, code)
+	if err != nil {
+		fmt.Println("LoginTOTP returned:", err)
+		t.Fail()
+	}
+	if err := lm.CheckUserLoggedIn("joe", token); err != nil {
+		fmt.Println("CheckUserLoggedIn after LoginTOTP returned:", err)
+		t.Fail()
+	}
+	codes, err := lm.GenerateRecoveryCodes("joe", "passwd")
+	if err != nil || len(codes) == 0 {
+		fmt.Println("GenerateRecoveryCodes returned:", err)
+		t.FailNow()
+	}
+	if err := lm.CheckUserTOTP("joe", "passwd", codes[0]); err != basicauth.ErrInvalidTOTPCode {
+		fmt.Println("CheckUserTOTP accepted recovery code:", err)
+		t.Fail()
+	}
+	pending, _ = lm.Login("joe", "passwd")
+	if _, err := lm.LoginTOTP("joe", pending, codes[0]); err != nil {
+		fmt.Println("LoginTOTP with recovery code returned:", err)
+		t.Fail()
+	}
+	if n, err := lm.RecoveryCodesLeft("joe", "passwd"); err != nil || n != len(codes)-1 {
+		fmt.Println("RecoveryCodesLeft want:", len(codes)-1, "got:", n, err)
+		t.Fail()
+	}
+	if err := lm.CheckUserTOTP("joe", "passwd", codes[0]); err != basicauth.ErrInvalidTOTPCode {
+		fmt.Println("CheckUserTOTP with used recovery code returned:", err)
+		t.Fail()
+	}
+	clock = clock.Add(time.Minute)
+	code, _ = basicauth.TOTPCode(secret, clock)
+	if err := lm.CheckUserTOTP("joe", "wrong", code); err != basicauth.ErrInvalidPassword {
+		fmt.Println("CheckUserTOTP with wrong password returned:", err)
+		t.Fail()
+	}
+	pending, _ = lm.Login("joe", "passwd")
+	for i := 0; i < 5; i++ {
+		if _, err := lm.LoginTOTP("joe", pending, "000000"); err != basicauth.ErrInvalidTOTPCode {
+			fmt.Println("LoginTOTP with invalid code returned:", err)
+			t.Fail()
+		}
+	}
+	if _, err := lm.LoginTOTP("joe", pending, code); err != basicauth.ErrNoSuchSession {
+		fmt.Println("LoginTOTP after too many invalid codes returned:", err)
+		t.Fail()
+	}
+}
+
+func TestRecoveryCodeConflict(t *testing.T) {
+	fmt.Println("Testing recovery code with concurrent change...")
+	filename := "./test_recovery_conflict.json"
+	st, err := storage.NewJSONPasswordKeeper(filename)
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed", err)
+		t.FailNow()
+	}
+	defer os.Remove(filename)
+	defer st.Close()
+	rs := &racingStorage{UserAccountStorage: st, raced: true}
+	clock := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	lm, _ := basicauth.NewLoginManager(rs, time.Hour, basicauth.WithClock(func() time.Time { return clock }))
+	lm.AddUser("joe", "passwd")
+	uri, _ := lm.EnrollTOTP("joe", "passwd")
+	u, _ := url.Parse(uri)
+	code, _ := basicauth.TOTPCode(u.Query().Get("secret"), clock)
+	lm.ConfirmTOTP("joe", "passwd", code)
+	codes, err := lm.GenerateRecoveryCodes("joe", "passwd")
+	if err != nil || len(codes) == 0 {
+		fmt.Println("GenerateRecoveryCodes returned:", err)
+		t.FailNow()
+	}
+	pending, _ := lm.Login("joe", "passwd")
+	rs.raced = false
+	if _, err := lm.LoginTOTP("joe", pending, codes[0]); err != nil {
+		fmt.Println("LoginTOTP with recovery code after conflict returned:", err)
+		t.Fail()
+	}
+	if n, _ := lm.RecoveryCodesLeft("joe", "passwd"); n != len(codes)-1 {
+		fmt.Println("RecoveryCodesLeft after conflict want:", len(codes)-1, "got:", n)
+		t.Fail()
+	}
+}
@@ -0,0 +1,201 @@
+// Package migrate copies accounts between implementations of
+// basicauth.UserAccountStorage and exports and imports them in
+// a portable NDJSON format.
+package migrate
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+var (
+	// ErrConflict is returned when account exists in destination
+	// and conflict policy is Fail
+	ErrConflict = errors.New("migrate error: account already exists in destination")
+	// ErrBadFormat is returned when import stream has no valid header
+	ErrBadFormat = errors.New("migrate error: not a basicauth export or unsupported version")
+)
+
+// ConflictPolicy defines what to do when account being copied
+// already exists in destination storage
+type ConflictPolicy int
+
+const (
+	// Skip leaves existing account untouched
+	Skip ConflictPolicy = iota
+	// Overwrite replaces existing account
+	Overwrite
+	// Fail stops migration with ErrConflict
+	Fail
+)
+
+// ParseConflictPolicy converts "skip", "overwrite" or "fail" to ConflictPolicy
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch s {
+	case "skip":
+		return Skip, nil
+	case "overwrite":
+		return Overwrite, nil
+	case "fail":
+		return Fail, nil
+	}
+	return Skip, fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// Options control migration
+type Options struct {
+	// DryRun reports what would be done without writing to destination
+	DryRun   bool
+	Conflict ConflictPolicy
+	// PageSize is number of accounts requested from source at once
+	PageSize int
+}
+
+// Report counts accounts processed by migration
+type Report struct {
+	Read        int
+	Created     int
+	Overwritten int
+	Skipped     int
+	DryRun      bool
+}
+
+func (r Report) String() string {
+	out := fmt.Sprintf("read: %v, created: %v, overwritten: %v, skipped: %v", r.Read, r.Created, r.Overwritten, r.Skipped)
+	if r.DryRun {
+		out += " (dry run, nothing written)"
+	}
+	return out
+}
+
+const (
+	exportFormat  = "basicauth-accounts"
+	exportVersion = 1
+)
+
+// exportHeader is the first line of export stream
+type exportHeader struct {
+	Format   string
+	Version  int
+	Exported time.Time
+}
+
+// Migrate copies every account from src to dst. src must implement basicauth.Lister.
+// Report is returned along with error if migration stops half way.
+func Migrate(src, dst basicauth.UserAccountStorage, opts Options) (Report, error) {
+	m := migrator{dst: dst, opts: opts, report: Report{DryRun: opts.DryRun}}
+	err := each(src, opts.PageSize, m.apply)
+	return m.report, err
+}
+
+// Export writes header and every account of src as a JSON line to w.
+// src must implement basicauth.Lister.
+func Export(src basicauth.UserAccountStorage, w io.Writer) (Report, error) {
+	var report Report
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(exportHeader{Format: exportFormat, Version: exportVersion, Exported: time.Now()}); err != nil {
+		return report, err
+	}
+	err := each(src, 0, func(account basicauth.Account) error {
+		report.Read++
+		return enc.Encode(account)
+	})
+	if err != nil {
+		return report, err
+	}
+	return report, bw.Flush()
+}
+
+// Import reads stream written by Export from r and stores accounts in dst.
+func Import(r io.Reader, dst basicauth.UserAccountStorage, opts Options) (Report, error) {
+	m := migrator{dst: dst, opts: opts, report: Report{DryRun: opts.DryRun}}
+	dec := json.NewDecoder(r)
+	var header exportHeader
+	if err := dec.Decode(&header); err != nil || header.Format != exportFormat || header.Version < 1 || header.Version > exportVersion {
+		return m.report, ErrBadFormat
+	}
+	for {
+		var account basicauth.Account
+		err := dec.Decode(&account)
+		if err == io.EOF {
+			return m.report, nil
+		}
+		if err != nil {
+			return m.report, fmt.Errorf("migrate error: record %v: %w", m.report.Read+1, err)
+		}
+		if err := m.apply(account); err != nil {
+			return m.report, err
+		}
+	}
+}
+
+// each calls f for every account of src
+func each(src basicauth.UserAccountStorage, pagesize int, f func(basicauth.Account) error) error {
+	l, ok := src.(basicauth.Lister)
+	if !ok {
+		return basicauth.ErrNotSupported
+	}
+	q := basicauth.ListQuery{Limit: pagesize}
+	for {
+		page, next, err := l.List(q)
+		if err != nil {
+			return err
+		}
+		for _, account := range page {
+			if err := f(account); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		q.Cursor = next
+	}
+}
+
+type migrator struct {
+	dst    basicauth.UserAccountStorage
+	opts   Options
+	report Report
+}
+
+func (m *migrator) apply(account basicauth.Account) error {
+	m.report.Read++
+	existing, err := m.dst.Get(account.UserName)
+	if errors.Is(err, storage.ErrNoSuchUser) {
+		if !m.opts.DryRun {
+			if err := m.dst.Put(account); err != nil {
+				return fmt.Errorf("migrate error: could not put %v: %w", account.UserName, err)
+			}
+		}
+		m.report.Created++
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("migrate error: could not get %v: %w", account.UserName, err)
+	}
+	switch m.opts.Conflict {
+	case Overwrite:
+		if !m.opts.DryRun {
+			// version of source account means nothing to destination
+			account.Version = existing.Version
+			if err := m.dst.Upd(account); err != nil {
+				return fmt.Errorf("migrate error: could not update %v: %w", account.UserName, err)
+			}
+		}
+		m.report.Overwritten++
+	case Fail:
+		return fmt.Errorf("%w: %v", ErrConflict, account.UserName)
+	default:
+		m.report.Skipped++
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package migrate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+func TestMigrate(t *testing.T) {
+	fmt.Println("Testing Migrate, Export and Import...")
+	defer os.Remove("test_src.json")
+	defer os.Remove("test_dst.json")
+	src, _ := storage.NewJSONPasswordKeeper("test_src.json")
+	dst, _ := storage.NewJSONPasswordKeeper("test_dst.json")
+	for _, u := range []string{"joe", "jane", "jim"} {
+		src.Put(basicauth.Account{UserName: u, PasswordHash: u + "hash"})
+	}
+	dst.Put(basicauth.Account{UserName: "jane", PasswordHash: "other"})
+
+	report, err := Migrate(src, dst, Options{DryRun: true, PageSize: 2})
+	if err != nil || report.Created != 2 || report.Skipped != 1 {
+		fmt.Println("dry run Migrate returned:", report, err)
+		t.Fail()
+	}
+	if _, err := dst.Get("joe"); err == nil {
+		fmt.Println("dry run wrote to destination")
+		t.Fail()
+	}
+	if _, err := Migrate(src, dst, Options{Conflict: Fail}); !errors.Is(err, ErrConflict) {
+		fmt.Println("Migrate with Fail policy returned:", err)
+		t.Fail()
+	}
+	report, err = Migrate(src, dst, Options{Conflict: Overwrite})
+	if err != nil || report.Read != 3 || report.Overwritten != 1 {
+		fmt.Println("Migrate with Overwrite policy returned:", report, err)
+		t.Fail()
+	}
+	if acc, _ := dst.Get("jane"); acc.PasswordHash != "janehash" {
+		fmt.Println("account was not overwritten:", acc)
+		t.Fail()
+	}
+
+	var buf bytes.Buffer
+	if report, err := Export(src, &buf); err != nil || report.Read != 3 {
+		fmt.Println("Export returned:", report, err)
+		t.Fail()
+	}
+	src.Del("joe")
+	report, err = Import(&buf, src, Options{})
+	if err != nil || report.Created != 1 || report.Skipped != 2 {
+		fmt.Println("Import returned:", report, err)
+		t.Fail()
+	}
+	if _, err := Import(bytes.NewBufferString(`{"Format":"other"}`), src, Options{}); err != ErrBadFormat {
+		fmt.Println("Import of foreign stream returned:", err)
+		t.Fail()
+	}
+	broken := &failingStorage{dst}
+	if report, err := Migrate(src, broken, Options{Conflict: Overwrite}); err == nil || report.Created != 0 {
+		fmt.Println("Migrate to storage failing on Get returned:", report, err)
+		t.Fail()
+	}
+}
+
+// failingStorage fails Get with error other than storage.ErrNoSuchUser
+type failingStorage struct {
+	basicauth.UserAccountStorage
+}
+
+func (fs *failingStorage) Get(string) (basicauth.Account, error) {
+	return basicauth.Account{}, fmt.Errorf("connection refused")
+}
@@ -0,0 +1,68 @@
+package net
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dmfed/basicauth/audit"
+	"github.com/dmfed/basicauth/storage"
+)
+
+func TestAuditLog(t *testing.T) {
+	fmt.Println("Testing server audit log...")
+	filename, logname := "./test_audit.json", "./test_audit.log"
+	defer os.Remove(filename)
+	defer os.Remove(logname)
+	st, _ := storage.NewJSONPasswordKeeper(filename)
+	al, err := audit.OpenLog(logname, []byte("auditkey"))
+	if err != nil {
+		fmt.Println("OpenLog returned:", err)
+		t.FailNow()
+	}
+	defer al.Close()
+	server, _ := NewLoginServerWithOptions(st, "", "", "admintoken", false, []string{"apptoken"}, WithAuditLog(al))
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	app, _ := NewRemodeLoginInterface(u.Hostname(), u.Port(), "apptoken", false)
+	admin, _ := NewRemoteAdminInterface(u.Hostname(), u.Port(), "admintoken", false)
+	bad, _ := NewRemodeLoginInterface(u.Hostname(), u.Port(), "wrongtoken", false)
+	app.AddUser("joe", "passwd")
+	app.Login("joe", "wrong")
+	app.Login("joe", "passwd")
+	app.ChangeUserPassword("joe", "passwd", "newpasswd")
+	app.CheckUserLoggedIn("joe", "token") // not audited
+	admin.AdminResetUserPassword("joe")
+	admin.(*AuthAdmin).AdminAddAppToken("newtoken")
+	bad.CheckUserPassword("joe", "newpasswd")
+
+	if n, err := al.Verify(); err != nil || n != 7 {
+		fmt.Println("Verify of server audit log returned:", n, err)
+		t.Fail()
+	}
+	entries, _ := al.Query(audit.Query{UserName: "joe", Action: "login"})
+	if len(entries) != 2 || entries[0].Success || !entries[1].Success || entries[0].IP != "127.0.0.1" || entries[0].RequestID == "" {
+		fmt.Println("login entries:", entries)
+		t.Fail()
+	}
+	entries, _ = al.Query(audit.Query{})
+	for _, e := range entries {
+		if strings.Contains(e.Actor, "token") {
+			fmt.Println("token leaked to audit log:", e)
+			t.Fail()
+		}
+	}
+	if e := entries[len(entries)-2]; e.Action != "adminaddapptoken" || !strings.HasPrefix(e.Actor, "admin:") {
+		fmt.Println("token change recorded as:", e)
+		t.Fail()
+	}
+	if e := entries[len(entries)-1]; !strings.HasPrefix(e.Actor, "rejected:") || e.Success {
+		fmt.Println("rejected token recorded as:", e)
+		t.Fail()
+	}
+}
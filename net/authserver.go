@@ -2,9 +2,14 @@ package net
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,8 +18,14 @@ import (
 	"time"
 
 	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/audit"
+	"github.com/dmfed/basicauth/storage"
+	"github.com/dmfed/basicauth/webhook"
 )
 
+// sessionDuration is how long session tokens issued by the server are valid
+const sessionDuration = time.Hour * 24
+
 var (
 	// ErrStorageIsNil is returned when trying to pass nil value of UserInfoStorage to
 	// NewLoginServer()
@@ -26,20 +37,121 @@ var (
 // It is callers responsibility to gracefully shutdown server with Shutdown() not Close()
 // in order to disconnect from password keeper gracefully
 func NewLoginServer(st basicauth.UserAccountStorage, ip, port, admintoken string, requireTLS bool, apptokens ...string) (*http.Server, error) {
-	if st == nil {
+	return NewLoginServerWithOptions(st, ip, port, admintoken, requireTLS, apptokens)
+}
+
+// ServerOption configures optional behaviour of the server created
+// with NewLoginServerWithOptions.
+type ServerOption func(*serverConfig)
+
+type serverConfig struct {
+	authopts     []basicauth.Option
+	storagetoken string
+	realms       []Realm
+	audit        *audit.Log
+	webhooks     *webhook.Dispatcher
+}
+
+// WithAuthOptions passes opts to the LoginInterface and AdminInterface
+// used by the server.
+func WithAuthOptions(opts ...basicauth.Option) ServerOption {
+	return func(c *serverConfig) {
+		c.authopts = append(c.authopts, opts...)
+	}
+}
+
+// WithStorageToken enables storage* actions which give clients created with
+// NewRemoteStorage raw access to accounts including password hashes. Requests
+// must carry token which should differ from admin and app tokens.
+func WithStorageToken(token string) ServerOption {
+	return func(c *serverConfig) {
+		c.storagetoken = token
+	}
+}
+
+// WithAuditLog makes the server record admin actions, logins, password
+// changes and rejected tokens to l along with client address.
+func WithAuditLog(l *audit.Log) ServerOption {
+	return func(c *serverConfig) {
+		c.audit = l
+	}
+}
+
+// WithWebhooks makes the server deliver account and session events to
+// webhook endpoints of d and enables admin actions on its dead letters.
+// Events carry name of the realm they come from. It sets EventSink of
+// the interfaces, use basicauth.MultiSink with Realm.Options to deliver
+// events elsewhere too.
+func WithWebhooks(d *webhook.Dispatcher) ServerOption {
+	return func(c *serverConfig) {
+		c.webhooks = d
+	}
+}
+
+// realmSink sets Realm of events before passing them to sink
+type realmSink struct {
+	sink  basicauth.EventSink
+	realm string
+}
+
+func (rs realmSink) Emit(e basicauth.Event) {
+	e.Realm = rs.realm
+	rs.sink.Emit(e)
+}
+
+// Realm is a separate user base served by the server. Each realm has its own
+// storage and tokens, app tokens of one realm give no access to other realms.
+// Options configure hasher, username policy, TokenKeeper and so on.
+type Realm struct {
+	Name         string
+	Storage      basicauth.UserAccountStorage
+	AdminToken   string
+	AppTokens    []string
+	StorageToken string
+	Options      []basicauth.Option
+}
+
+// WithRealm adds realm to the server. Clients select realm with URL path
+// /<name> or with Realm field of Request. Requests without realm go to the
+// default realm created from arguments of NewLoginServerWithOptions.
+func WithRealm(realm Realm) ServerOption {
+	return func(c *serverConfig) {
+		c.realms = append(c.realms, realm)
+	}
+}
+
+// NewLoginServerWithOptions is the same as NewLoginServer but accepts
+// ServerOptions to configure the server. st may be nil if realms are
+// configured with WithRealm, the server then has no default realm.
+func NewLoginServerWithOptions(st basicauth.UserAccountStorage, ip, port, admintoken string, requireTLS bool, apptokens []string, opts ...ServerOption) (*http.Server, error) {
+	var cfg serverConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	realms := cfg.realms
+	if st != nil {
+		realms = append([]Realm{{Storage: st, AdminToken: admintoken, AppTokens: apptokens, StorageToken: cfg.storagetoken}}, realms...)
+	}
+	if len(realms) == 0 {
 		return nil, ErrStorageIsNil
 	}
-	logmgr, _ := basicauth.NewLoginManager(st, time.Hour*24)
-	admin, _ := basicauth.NewAdminInterface(st)
-	var lh apihandler
-	lh.lm = logmgr
-	lh.admin = admin
-	lh.apptokens = make(map[string]bool)
-	for _, tok := range apptokens {
-		lh.apptokens[tok] = true
+	router := &realmRouter{realms: make(map[string]*apihandler), audit: cfg.audit}
+	for _, realm := range realms {
+		if realm.Storage == nil {
+			return nil, ErrStorageIsNil
+		}
+		if _, exists := router.realms[realm.Name]; exists {
+			return nil, fmt.Errorf("NewLoginServer: error creating server: realm %q is configured twice", realm.Name)
+		}
+		authopts := append([]basicauth.Option(nil), cfg.authopts...)
+		if cfg.webhooks != nil {
+			authopts = append(authopts, basicauth.WithEventSink(realmSink{cfg.webhooks, realm.Name}))
+		}
+		authopts = append(authopts, realm.Options...)
+		router.realms[realm.Name] = newRealmHandler(realm, authopts)
+		router.realms[realm.Name].webhooks = cfg.webhooks
 	}
-	lh.admintoken = admintoken
-	server := &http.Server{Addr: ip + ":" + port, Handler: &lh}
+	server := &http.Server{Addr: ip + ":" + port, Handler: router}
 	// below lines are intended to handle case when there is
 	// nobody to call call server.Shutdown() to exit gracefully
 	interrupts := make(chan os.Signal, 1)
@@ -47,8 +159,10 @@ func NewLoginServer(st basicauth.UserAccountStorage, ip, port, admintoken string
 	go func() {
 		sig := <-interrupts
 		log.Printf("authserver exiting on signal: %v", sig)
-		if err := st.Close(); err != nil {
-			log.Printf("basicauth storage shutdown error: %v", err)
+		for _, realm := range realms {
+			if err := realm.Storage.Close(); err != nil {
+				log.Printf("basicauth storage shutdown error: %v", err)
+			}
 		}
 		if err := server.Shutdown(context.Background()); err != nil {
 			log.Printf("basicauth authserver shutdown error: %v", err)
@@ -57,16 +171,38 @@ func NewLoginServer(st basicauth.UserAccountStorage, ip, port, admintoken string
 	return server, nil
 }
 
-type apihandler struct {
-	lm         basicauth.LoginInterface
-	admin      basicauth.AdminInterface
-	apptokens  map[string]bool
-	admintoken string
+func newRealmHandler(realm Realm, authopts []basicauth.Option) *apihandler {
+	st := realm.Storage
+	if cl, ok := st.(*storage.ChangeLog); ok {
+		// sessions go to the change stream for replicas
+		tk, _ := basicauth.NewMemTokenKeeper(sessionDuration)
+		authopts = append([]basicauth.Option{basicauth.WithTokenKeeper(cl.TokenKeeper(tk, sessionDuration))}, authopts...)
+	}
+	logmgr, _ := basicauth.NewLoginManager(st, sessionDuration, authopts...)
+	admin, _ := basicauth.NewAdminInterface(st, authopts...)
+	var lh apihandler
+	lh.lm = logmgr
+	lh.admin = admin
+	lh.apptokens = make(map[string]bool)
+	for _, tok := range realm.AppTokens {
+		lh.apptokens[tok] = true
+	}
+	lh.admintoken = realm.AdminToken
+	lh.st = st
+	lh.storagetoken = realm.StorageToken
+	return &lh
 }
 
-func (h *apihandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// realmRouter parses requests and passes them to handler of their realm
+type realmRouter struct {
+	realms map[string]*apihandler
+	audit  *audit.Log
+}
+
+func (rr *realmRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 	bodydata, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -79,13 +215,27 @@ func (h *apihandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "400 could not parse JSON from request body", http.StatusBadRequest)
 		return
 	}
-	if strings.HasPrefix(msg.Request.Action, "admin") && h.admintoken != "" && msg.AppToken == h.admintoken {
-		msg = h.processAdminCommand(msg)
-	} else if allowed, exists := h.apptokens[msg.AppToken]; allowed && exists {
-		// && msg.AppToken != ""
-		msg = h.processRegularCommand(msg)
-	} else {
-		log.Printf("error: got invalid app token %v from X-FWD: %v Addr: %v", msg.AppToken, r.Header.Get("X-FORWARDED-FOR"), r.RemoteAddr)
+	realm := strings.Trim(r.URL.Path, "/")
+	if realm != "" && msg.Request.Realm != "" && realm != msg.Request.Realm {
+		http.Error(w, "400 realm in path does not match realm in request", http.StatusBadRequest)
+		return
+	}
+	if realm == "" {
+		realm = msg.Request.Realm
+	}
+	h, ok := rr.realms[realm]
+	if !ok {
+		http.Error(w, "404 unknown realm", http.StatusNotFound)
+		return
+	}
+	// storage calls are canceled if client goes away
+	ctx := basicauth.WithRequestID(r.Context(), requestID(r, msg.Request))
+	ctx = basicauth.WithClientIP(ctx, clientIP(r))
+	req, actor := msg.Request, h.actor(msg)
+	msg, ok = h.process(ctx, msg)
+	rr.record(ctx, r, realm, actor, req, msg.Response)
+	if !ok {
+		log.Printf("error: got invalid app token %v for realm %q from X-FWD: %v Addr: %v", msg.AppToken, realm, r.Header.Get("X-FORWARDED-FOR"), r.RemoteAddr)
 		http.Error(w, "403 Forbidden", http.StatusForbidden)
 		return
 	}
@@ -94,74 +244,280 @@ func (h *apihandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(msg.ToBytes())
 }
 
-func (h *apihandler) processRegularCommand(msg Message) Message {
+// clientIP returns address of the peer without port
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// requestID returns ID of request set by client with X-Request-ID header
+// or Request.ID. Requests without ID (old clients send "0000") get random one.
+func requestID(r *http.Request, req Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+	if req.ID != "" && req.ID != "0000" {
+		return req.ID
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// auditedActions are regular and storage actions recorded to audit log.
+// All admin actions and requests with invalid tokens are recorded too.
+var auditedActions = map[string]bool{
+	"login":                 true,
+	"logintotp":             true,
+	"logout":                true,
+	"checkuserpassword":     true,
+	"checkusertotp":         true,
+	"adduser":               true,
+	"deluser":               true,
+	"changeuserpassword":    true,
+	"setuseremail":          true,
+	"confirmemail":          true,
+	"enrolltotp":            true,
+	"confirmtotp":           true,
+	"disabletotp":           true,
+	"generaterecoverycodes": true,
+	"createapikey":          true,
+	"revokeapikey":          true,
+	"storageput":            true,
+	"storageupd":            true,
+	"storagedel":            true,
+}
+
+// record writes request to audit log if it is configured and the action is audited
+func (rr *realmRouter) record(ctx context.Context, r *http.Request, realm, actor string, req Request, resp Response) {
+	if rr.audit == nil {
+		return
+	}
+	if !auditedActions[req.Action] && !strings.HasPrefix(req.Action, "admin") && !strings.HasPrefix(actor, "rejected") {
+		return
+	}
+	e := audit.Entry{
+		Actor:        actor,
+		IP:           basicauth.ClientIP(ctx),
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Realm:        realm,
+		RequestID:    basicauth.RequestID(ctx),
+		Action:       req.Action,
+		UserName:     req.UserName,
+		Success:      resp.OK,
+		Error:        resp.Error,
+	}
+	if e.UserName == "" {
+		e.UserName = req.Account.UserName
+	}
+	if strings.HasPrefix(actor, "rejected") {
+		e.Error = "token does not allow the action"
+	}
+	if _, err := rr.audit.Append(e); err != nil {
+		log.Printf("error: could not write audit entry for %v from %v: %v", req.Action, r.RemoteAddr, err)
+	}
+}
+
+// apihandler serves requests of a single realm
+type apihandler struct {
+	lm           basicauth.LoginInterface
+	admin        basicauth.AdminInterface
+	apptokens    map[string]bool
+	admintoken   string
+	st           basicauth.UserAccountStorage
+	storagetoken string
+	webhooks     *webhook.Dispatcher
+	// allowed limits regular actions when set (on replica)
+	allowed map[string]bool
+}
+
+// role returns kind of token in msg which allows the action
+// or empty string if the token does not allow it
+func (h *apihandler) role(msg Message) string {
+	switch {
+	case strings.HasPrefix(msg.Request.Action, "admin") && h.admintoken != "" && msg.AppToken == h.admintoken:
+		return "admin"
+	case strings.HasPrefix(msg.Request.Action, "storage") && h.storagetoken != "" && msg.AppToken == h.storagetoken:
+		return "storage"
+	case h.apptokens[msg.AppToken]:
+		return "app"
+	}
+	return ""
+}
+
+// actor identifies the client in audit log by role and fingerprint
+// of its token. Tokens themselves are never written to the log.
+func (h *apihandler) actor(msg Message) string {
+	role := h.role(msg)
+	if role == "" {
+		role = "rejected"
+	}
+	sum := sha256.Sum256([]byte(msg.AppToken))
+	return role + ":" + hex.EncodeToString(sum[:4])
+}
+
+// process executes request in msg with ctx. It returns false
+// if the token does not allow the action.
+func (h *apihandler) process(ctx context.Context, msg Message) (Message, bool) {
+	switch h.role(msg) {
+	case "admin":
+		return h.processAdminCommand(ctx, msg), true
+	case "storage":
+		return h.processStorageCommand(ctx, msg), true
+	case "app":
+		return h.processRegularCommand(ctx, msg), true
+	}
+	return msg, false
+}
+
+func (h *apihandler) processRegularCommand(ctx context.Context, msg Message) Message {
 	msg.Response = Response{ID: msg.Request.ID}
+	lm := basicauth.LoginWithContext(ctx, h.lm)
+	if h.allowed != nil && !h.allowed[msg.Request.Action] {
+		msg = appendErrorOKtoMessage(msg, ErrReadOnly)
+		msg.Request = Request{}
+		return msg
+	}
 	switch msg.Request.Action {
 	// Applications should use these ones (LoginManager)
 	case "login":
-		token, err := h.lm.Login(msg.Request.UserName, msg.Request.Password)
+		token, err := lm.Login(msg.Request.UserName, msg.Request.Password)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Token = token
+
+	case "logintotp":
+		token, err := lm.LoginTOTP(msg.Request.UserName, msg.Request.Token, msg.Request.Code)
 		msg = appendErrorOKtoMessage(msg, err)
 		msg.Response.Token = token
 
 	case "logout":
-		err := h.lm.Logout(msg.Request.UserName)
+		err := lm.Logout(msg.Request.UserName)
 		msg = appendErrorOKtoMessage(msg, err)
 
 	case "checkuserloggedin":
-		err := h.lm.CheckUserLoggedIn(msg.Request.UserName, msg.Request.Token)
+		err := lm.CheckUserLoggedIn(msg.Request.UserName, msg.Request.Token)
 		msg = appendErrorOKtoMessage(msg, err)
 		msg.Response.Token = msg.Request.Token
 
 	case "checkuserpassword":
-		err := h.lm.CheckUserPassword(msg.Request.UserName, msg.Request.Password)
+		err := lm.CheckUserPassword(msg.Request.UserName, msg.Request.Password)
 		msg = appendErrorOKtoMessage(msg, err)
 
 	case "adduser":
-		err := h.lm.AddUser(msg.Request.UserName, msg.Request.Password)
+		err := lm.AddUser(msg.Request.UserName, msg.Request.Password)
 		msg = appendErrorOKtoMessage(msg, err)
 
 	case "deluser":
-		err := h.lm.DelUser(msg.Request.UserName, msg.Request.Password)
+		err := lm.DelUser(msg.Request.UserName, msg.Request.Password)
 		msg = appendErrorOKtoMessage(msg, err)
 	case "changeuserpassword":
-		err := h.lm.ChangeUserPassword(msg.Request.UserName, msg.Request.Password, msg.Request.NewPassword)
+		err := lm.ChangeUserPassword(msg.Request.UserName, msg.Request.Password, msg.Request.NewPassword)
 		msg = appendErrorOKtoMessage(msg, err)
 	case "getuserinfo":
-		info, err := h.lm.GetUserInfo(msg.Request.UserName, msg.Request.Password)
+		info, err := lm.GetUserInfo(msg.Request.UserName, msg.Request.Password)
 		msg.Response.UserInfo = info
 		msg = appendErrorOKtoMessage(msg, err)
 	case "updateuserinfo":
-		err := h.lm.UpdateUserInfo(msg.Request.UserName, msg.Request.Password, msg.Request.UserInfo)
+		err := lm.UpdateUserInfo(msg.Request.UserName, msg.Request.Password, msg.Request.UserInfo)
 		msg = appendErrorOKtoMessage(msg, err)
+	case "setuseremail":
+		err := lm.SetUserEmail(msg.Request.UserName, msg.Request.Password, msg.Request.Email)
+		msg = appendErrorOKtoMessage(msg, err)
+	case "requestemailverification":
+		err := lm.RequestEmailVerification(msg.Request.UserName, msg.Request.Password)
+		msg = appendErrorOKtoMessage(msg, err)
+	case "confirmemail":
+		err := lm.ConfirmEmail(msg.Request.UserName, msg.Request.Code)
+		msg = appendErrorOKtoMessage(msg, err)
+	case "enrolltotp":
+		uri, err := lm.EnrollTOTP(msg.Request.UserName, msg.Request.Password)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Message = uri
+	case "confirmtotp":
+		err := lm.ConfirmTOTP(msg.Request.UserName, msg.Request.Password, msg.Request.Code)
+		msg = appendErrorOKtoMessage(msg, err)
+	case "disabletotp":
+		err := lm.DisableTOTP(msg.Request.UserName, msg.Request.Password, msg.Request.Code)
+		msg = appendErrorOKtoMessage(msg, err)
+	case "checkusertotp":
+		err := lm.CheckUserTOTP(msg.Request.UserName, msg.Request.Password, msg.Request.Code)
+		msg = appendErrorOKtoMessage(msg, err)
+	case "generaterecoverycodes":
+		codes, err := lm.GenerateRecoveryCodes(msg.Request.UserName, msg.Request.Password)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Codes = codes
+	case "createapikey":
+		key, err := lm.CreateAPIKey(msg.Request.UserName, msg.Request.Password, msg.Request.Name, msg.Request.Expires, msg.Request.Scopes)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Token = key
+	case "listapikeys":
+		keys, err := lm.ListAPIKeys(msg.Request.UserName, msg.Request.Password)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.APIKeys = keys
+	case "revokeapikey":
+		err := lm.RevokeAPIKey(msg.Request.UserName, msg.Request.Password, msg.Request.KeyID)
+		msg = appendErrorOKtoMessage(msg, err)
+	case "checkapikey":
+		key, err := lm.CheckAPIKey(msg.Request.Token)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.APIKey = key
+	case "recoverycodesleft":
+		n, err := lm.RecoveryCodesLeft(msg.Request.UserName, msg.Request.Password)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Count = n
 	default:
-		msg.Response.OK = false
+		msg = appendErrorOKtoMessage(msg, ErrUnknownAction)
 	}
 	msg.Request = Request{}
 	return msg
 }
 
-func (h *apihandler) processAdminCommand(msg Message) Message {
+func (h *apihandler) processAdminCommand(ctx context.Context, msg Message) Message {
 	msg.Response = Response{ID: msg.Request.ID}
+	admin := basicauth.AdminWithContext(ctx, h.admin)
 	switch msg.Request.Action {
 	case "admingetaccount":
-		account, err := h.admin.AdminGetAccount(msg.Request.UserName)
+		account, err := admin.AdminGetAccount(msg.Request.UserName)
 		msg = appendErrorOKtoMessage(msg, err)
 		msg.Response.Account = account
 
 	case "adminupdateaccount":
-		err := h.admin.AdminUpdAccount(msg.Request.Account)
+		err := admin.AdminUpdAccount(msg.Request.Account)
 		msg = appendErrorOKtoMessage(msg, err)
 
 	case "adminaddaccount":
-		err := h.admin.AdminAddAccount(msg.Request.UserName)
+		err := admin.AdminAddAccount(msg.Request.UserName)
 		msg = appendErrorOKtoMessage(msg, err)
 
 	case "admindelaccount":
-		err := h.admin.AdminDelAccount(msg.Request.UserName)
+		err := admin.AdminDelAccount(msg.Request.UserName)
 		msg = appendErrorOKtoMessage(msg, err)
 
 	case "adminresetuserpassword":
-		err := h.admin.AdminResetUserPassword(msg.Request.UserName)
+		err := admin.AdminResetUserPassword(msg.Request.UserName)
+		msg = appendErrorOKtoMessage(msg, err)
+
+	case "adminlistaccounts":
+		accounts, next, err := admin.AdminListAccounts(msg.Request.Query)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Accounts = accounts
+		msg.Response.Cursor = next
+
+	case "adminrecoverycodesleft":
+		n, err := admin.AdminRecoveryCodesLeft(msg.Request.UserName)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Count = n
+
+	case "adminlistapikeys":
+		keys, err := admin.AdminListAPIKeys(msg.Request.UserName)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.APIKeys = keys
+
+	case "adminrevokeapikey":
+		err := admin.AdminRevokeAPIKey(msg.Request.UserName, msg.Request.KeyID)
 		msg = appendErrorOKtoMessage(msg, err)
 
 	case "adminaddapptoken":
@@ -173,8 +529,7 @@ func (h *apihandler) processAdminCommand(msg Message) Message {
 			delete(h.apptokens, msg.Request.Token)
 			msg.Response.OK = true
 		} else {
-			msg.Response.Error = "token not found"
-			msg.Response.OK = false
+			msg = appendErrorOKtoMessage(msg, ErrTokenNotFound)
 		}
 
 	case "admintoggleapptoken":
@@ -182,15 +537,86 @@ func (h *apihandler) processAdminCommand(msg Message) Message {
 			h.apptokens[msg.Request.Token] = !state
 			msg.Response.OK = true
 		} else {
-			msg.Response.Error = "token not found"
-			msg.Response.OK = false
+			msg = appendErrorOKtoMessage(msg, ErrTokenNotFound)
 		}
 	case "adminreplaceadmintoken":
 		h.admintoken = msg.Request.Token
 		msg.Response.OK = true
+
+	case "adminlistdeadletters":
+		if h.webhooks == nil {
+			msg = appendErrorOKtoMessage(msg, basicauth.ErrNotSupported)
+			break
+		}
+		msg.Response.DeadLetters = h.webhooks.DeadLetters()
+		msg.Response.OK = true
+
+	case "adminretrydeadletter", "admindiscarddeadletter":
+		if h.webhooks == nil {
+			msg = appendErrorOKtoMessage(msg, basicauth.ErrNotSupported)
+			break
+		}
+		var err error
+		if msg.Request.Action == "adminretrydeadletter" {
+			err = h.webhooks.Retry(msg.Request.DeliveryID)
+		} else {
+			err = h.webhooks.Discard(msg.Request.DeliveryID)
+		}
+		msg = appendErrorOKtoMessage(msg, err)
+	default:
+		msg = appendErrorOKtoMessage(msg, ErrUnknownAction)
+	}
+	msg.Request = Request{}
+	return msg
+}
+
+func (h *apihandler) processStorageCommand(ctx context.Context, msg Message) Message {
+	msg.Response = Response{ID: msg.Request.ID}
+	st := basicauth.StorageWithContext(ctx, h.st)
+	switch msg.Request.Action {
+	case "storageget":
+		account, err := st.Get(msg.Request.UserName)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Account = account
+
+	case "storageput":
+		err := st.Put(msg.Request.Account)
+		msg = appendErrorOKtoMessage(msg, err)
+
+	case "storageupd":
+		err := st.Upd(msg.Request.Account)
+		msg = appendErrorOKtoMessage(msg, err)
+
+	case "storagedel":
+		err := st.Del(msg.Request.UserName)
+		msg = appendErrorOKtoMessage(msg, err)
+
+	case "storagelist":
+		accounts, next, err := st.(basicauth.Lister).List(msg.Request.Query)
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Accounts = accounts
+		msg.Response.Cursor = next
+
+	case "storagechanges", "storagesnapshot":
+		cs, ok := h.st.(storage.ChangeStream)
+		if !ok {
+			msg = appendErrorOKtoMessage(msg, basicauth.ErrNotSupported)
+			break
+		}
+		var (
+			batch storage.ChangeBatch
+			err   error
+		)
+		if msg.Request.Action == "storagechanges" {
+			batch, err = cs.Changes(msg.Request.Seq, msg.Request.Query.Limit)
+		} else {
+			batch, err = cs.Snapshot()
+		}
+		msg = appendErrorOKtoMessage(msg, err)
+		msg.Response.Changes = batch
+
 	default:
-		msg.Response.OK = false
-		msg.Response.Error = "unknown command supplied"
+		msg = appendErrorOKtoMessage(msg, ErrUnknownAction)
 	}
 	msg.Request = Request{}
 	return msg
@@ -199,6 +625,7 @@ func (h *apihandler) processAdminCommand(msg Message) Message {
 func appendErrorOKtoMessage(msg Message, err error) Message {
 	if err != nil {
 		msg.Response.Error = err.Error()
+		msg.Response.Code = codeOf(err)
 	} else {
 		msg.Response.OK = true
 	}
@@ -0,0 +1,82 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+func TestContextClients(t *testing.T) {
+	fmt.Println("Testing context aware clients...")
+	filename := "./test_context.json"
+	defer os.Remove(filename)
+	st, _ := storage.NewJSONPasswordKeeper(filename)
+	var (
+		mutex  sync.Mutex
+		events []basicauth.Event
+	)
+	sink := basicauth.EventSinkFunc(func(e basicauth.Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, e)
+	})
+	server, _ := NewLoginServerWithOptions(st, "", "", "admintoken", false, []string{"apptoken"}, WithAuthOptions(basicauth.WithEventSink(sink)))
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+			return
+		}
+		server.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	defer close(release)
+	u, _ := url.Parse(ts.URL)
+
+	app, _ := NewRemodeLoginInterface(u.Hostname(), u.Port(), "apptoken", false)
+	ctx := basicauth.WithRequestID(context.Background(), "req-42")
+	if err := basicauth.AppWithContext(ctx, app).AddUser("joe", "passwd"); err != nil {
+		fmt.Println("AddUser with context returned:", err)
+		t.Fail()
+	}
+	mutex.Lock()
+	if len(events) != 1 || events[0].RequestID != "req-42" || events[0].ClientIP != "127.0.0.1" {
+		fmt.Println("server events:", events)
+		t.Fail()
+	}
+	mutex.Unlock()
+
+	// deadline aborts request to unresponsive server
+	slow, _ := NewRemoteRealmLoginInterface(u.Hostname(), u.Port(), "slow", "apptoken", false)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := basicauth.LoginWithContext(ctx, slow).CheckUserPassword("joe", "passwd"); !errors.Is(err, context.DeadlineExceeded) {
+		fmt.Println("CheckUserPassword past deadline returned:", err)
+		t.Fail()
+	}
+	if time.Since(start) > time.Second {
+		fmt.Println("request was not aborted at deadline")
+		t.Fail()
+	}
+	rs, _ := NewRemoteRealmStorage(u.Hostname(), u.Port(), "slow", "storagetoken", false)
+	if _, err := rs.(basicauth.ContextStorage).GetContext(ctx, "joe"); !errors.Is(err, context.DeadlineExceeded) {
+		fmt.Println("remote GetContext past deadline returned:", err)
+		t.Fail()
+	}
+	admin, _ := NewRemoteRealmAdminInterface(u.Hostname(), u.Port(), "slow", "admintoken", false)
+	if _, err := basicauth.AdminWithContext(ctx, admin).AdminGetAccount("joe"); !errors.Is(err, context.DeadlineExceeded) {
+		fmt.Println("AdminGetAccount past deadline returned:", err)
+		t.Fail()
+	}
+}
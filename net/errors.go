@@ -0,0 +1,157 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+	"github.com/dmfed/basicauth/webhook"
+)
+
+// ErrorCode is a stable identifier of error sent in Response.Code.
+// Codes never change, new ones may be added.
+type ErrorCode string
+
+// Error codes of Response
+const (
+	CodeInvalidPassword         ErrorCode = "invalid_password"
+	CodeMustChangePassword      ErrorCode = "must_change_password"
+	CodeSamePassword            ErrorCode = "same_password"
+	CodeUserExists              ErrorCode = "user_exists"
+	CodeNoSuchUser              ErrorCode = "no_such_user"
+	CodeAccountLocked           ErrorCode = "account_locked"
+	CodeInvalidUsername         ErrorCode = "invalid_username"
+	CodeNoSuchSession           ErrorCode = "no_such_session"
+	CodeInvalidToken            ErrorCode = "invalid_token"
+	CodeConflict                ErrorCode = "conflict"
+	CodeNotSupported            ErrorCode = "not_supported"
+	CodeUnsupportedHash         ErrorCode = "unsupported_hash"
+	CodeEmailNotVerified        ErrorCode = "email_not_verified"
+	CodeInvalidVerificationCode ErrorCode = "invalid_verification_code"
+	CodeNoEmail                 ErrorCode = "no_email"
+	CodeNoNotifier              ErrorCode = "no_notifier"
+	CodeTOTPRequired            ErrorCode = "totp_required"
+	CodeInvalidTOTPCode         ErrorCode = "invalid_totp_code"
+	CodeTOTPNotEnabled          ErrorCode = "totp_not_enabled"
+	CodeTOTPAlreadyEnabled      ErrorCode = "totp_already_enabled"
+	CodeInvalidAPIKey           ErrorCode = "invalid_api_key"
+	CodeAPIKeyExpired           ErrorCode = "api_key_expired"
+	CodeNoSuchAPIKey            ErrorCode = "no_such_api_key"
+	CodeChangesTruncated        ErrorCode = "changes_truncated"
+	CodeFileChanged             ErrorCode = "file_changed"
+	CodeReadOnly                ErrorCode = "read_only"
+	CodeNoSuchDelivery          ErrorCode = "no_such_delivery"
+	CodeTokenNotFound           ErrorCode = "token_not_found"
+	CodeUnknownAction           ErrorCode = "unknown_action"
+	CodeCanceled                ErrorCode = "canceled"
+	CodeDeadlineExceeded        ErrorCode = "deadline_exceeded"
+	CodeInternal                ErrorCode = "internal"
+)
+
+var (
+	// ErrTokenNotFound is returned when admin deletes or toggles unknown app token
+	ErrTokenNotFound = errors.New("token not found")
+	// ErrUnknownAction is returned for actions the server does not know
+	ErrUnknownAction = errors.New("unknown command supplied")
+	// ErrForbidden is returned by clients when server rejects their token
+	ErrForbidden = errors.New("error: token does not allow the action")
+)
+
+// errorCodes maps sentinel errors to codes. Server sends code of the first
+// matching error, clients match all errors with the same code.
+var errorCodes = []struct {
+	code ErrorCode
+	err  error
+}{
+	{CodeInvalidPassword, basicauth.ErrInvalidPassword},
+	{CodeMustChangePassword, basicauth.ErrMustChangePassword},
+	{CodeSamePassword, basicauth.ErrSamePassword},
+	{CodeUserExists, basicauth.ErrUserExists},
+	{CodeUserExists, storage.ErrUserExists},
+	{CodeNoSuchUser, storage.ErrNoSuchUser},
+	{CodeAccountLocked, basicauth.ErrAccountLocked},
+	{CodeInvalidUsername, basicauth.ErrInvalidUsername},
+	{CodeNoSuchSession, basicauth.ErrNoSuchSession},
+	{CodeInvalidToken, basicauth.ErrInvalidToken},
+	{CodeConflict, basicauth.ErrConflict},
+	{CodeNotSupported, basicauth.ErrNotSupported},
+	{CodeUnsupportedHash, basicauth.ErrUnsupportedHash},
+	{CodeEmailNotVerified, basicauth.ErrEmailNotVerified},
+	{CodeInvalidVerificationCode, basicauth.ErrInvalidVerificationCode},
+	{CodeNoEmail, basicauth.ErrNoEmail},
+	{CodeNoNotifier, basicauth.ErrNoNotifier},
+	{CodeTOTPRequired, basicauth.ErrTOTPRequired},
+	{CodeInvalidTOTPCode, basicauth.ErrInvalidTOTPCode},
+	{CodeTOTPNotEnabled, basicauth.ErrTOTPNotEnabled},
+	{CodeTOTPAlreadyEnabled, basicauth.ErrTOTPAlreadyEnabled},
+	{CodeInvalidAPIKey, basicauth.ErrInvalidAPIKey},
+	{CodeAPIKeyExpired, basicauth.ErrAPIKeyExpired},
+	{CodeNoSuchAPIKey, basicauth.ErrNoSuchAPIKey},
+	{CodeChangesTruncated, storage.ErrChangesTruncated},
+	{CodeFileChanged, storage.ErrFileChanged},
+	{CodeReadOnly, ErrReadOnly},
+	{CodeNoSuchDelivery, webhook.ErrNoSuchDelivery},
+	{CodeTokenNotFound, ErrTokenNotFound},
+	{CodeUnknownAction, ErrUnknownAction},
+	{CodeCanceled, context.Canceled},
+	{CodeDeadlineExceeded, context.DeadlineExceeded},
+}
+
+// codeOf returns code of err or CodeInternal if err is not a known sentinel
+func codeOf(err error) ErrorCode {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec.code
+		}
+	}
+	return CodeInternal
+}
+
+// Error is an error reported by server. Remote clients return it wrapped
+// with action details. errors.Is(err, sentinel) is true for sentinel errors
+// of the same code, e.g. basicauth.ErrInvalidPassword for CodeInvalidPassword.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is a sentinel error of e.Code
+func (e *Error) Is(target error) bool {
+	for _, ec := range errorCodes {
+		if ec.code == e.Code && ec.err == target {
+			return true
+		}
+	}
+	return false
+}
+
+// responseError returns *Error for failed response. Code of responses
+// from servers which do not send codes is guessed from message.
+func responseError(resp Response) error {
+	e := &Error{Code: resp.Code, Message: resp.Error}
+	if e.Code == "" {
+		e.Code = CodeInternal
+		for _, ec := range errorCodes {
+			if ec.err.Error() == resp.Error {
+				e.Code = ec.code
+				break
+			}
+		}
+	}
+	return e
+}
+
+// statusError returns error for HTTP response which does not carry Message
+func statusError(status int, body []byte) error {
+	if status == http.StatusForbidden {
+		return ErrForbidden
+	}
+	return fmt.Errorf("server returned: %v", string(body))
+}
@@ -0,0 +1,155 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+// plainStorage hides Lister and ChangeStream of storage
+type plainStorage struct {
+	basicauth.UserAccountStorage
+}
+
+func TestErrorCodes(t *testing.T) {
+	fmt.Println("Testing error codes...")
+	for _, ec := range errorCodes {
+		msg := appendErrorOKtoMessage(Message{}, fmt.Errorf("wrapped: %w", ec.err))
+		if msg.Response.Code != ec.code {
+			fmt.Printf("%v was sent with code %v, want %v\n", ec.err, msg.Response.Code, ec.code)
+			t.Fail()
+		}
+		if err := responseError(msg.Response); !errors.Is(err, ec.err) {
+			fmt.Printf("error with code %v does not match %v\n", ec.code, ec.err)
+			t.Fail()
+		}
+		// servers which send no codes
+		if err := responseError(Response{Error: ec.err.Error()}); !errors.Is(err, ec.err) {
+			fmt.Printf("error without code does not match %v\n", ec.err)
+			t.Fail()
+		}
+	}
+	msg := appendErrorOKtoMessage(Message{}, errors.New("disk is on fire"))
+	if err := responseError(msg.Response); msg.Response.Code != CodeInternal || errors.Is(err, basicauth.ErrInvalidPassword) {
+		fmt.Println("unknown error was sent as:", msg.Response)
+		t.Fail()
+	}
+}
+
+func TestErrorMatrix(t *testing.T) {
+	fmt.Println("Testing errors of remote clients...")
+	filename := "./test_errors.json"
+	defer os.Remove(filename)
+	st, _ := storage.NewJSONPasswordKeeper(filename)
+	policy := &basicauth.UsernamePolicy{Reserved: []string{"root"}}
+	server, _ := NewLoginServerWithOptions(plainStorage{st}, "", "", "admintoken", false, []string{"apptoken"},
+		WithStorageToken("storagetoken"), WithAuthOptions(basicauth.WithUsernamePolicy(policy)))
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	lm, _ := NewRemodeLoginInterface(u.Hostname(), u.Port(), "apptoken", false)
+	admin, _ := NewRemoteAdminInterface(u.Hostname(), u.Port(), "admintoken", false)
+	aa := admin.(*AuthAdmin)
+	badadmin, _ := NewRemoteAdminInterface(u.Hostname(), u.Port(), "wrongtoken", false)
+	rs, _ := NewRemoteStorage(u.Hostname(), u.Port(), "storagetoken", false)
+
+	lm.AddUser("joe", "passwd")
+	lm.AddUser("ann", "passwd")
+	uri, _ := lm.EnrollTOTP("ann", "passwd")
+	secret := uri[strings.Index(uri, "secret=")+len("secret="):]
+	secret = strings.SplitN(secret, "&", 2)[0]
+	code, _ := basicauth.TOTPCode(secret, time.Now())
+	if err := lm.ConfirmTOTP("ann", "passwd", code); err != nil {
+		fmt.Println("ConfirmTOTP returned:", err)
+		t.FailNow()
+	}
+	admin.AdminAddAccount("new")
+	expired, _ := lm.CreateAPIKey("joe", "passwd", "old", time.Now().Add(-time.Hour), nil)
+	joe, _ := rs.Get("joe")
+
+	cases := []struct {
+		action string
+		call   func() error
+		want   error
+	}{
+		{"login", func() error { _, err := lm.Login("joe", "wrong"); return err }, basicauth.ErrInvalidPassword},
+		{"login", func() error { _, err := lm.Login("ann", "passwd"); return err }, basicauth.ErrTOTPRequired},
+		{"login", func() error { _, err := lm.Login("root", "passwd"); return err }, basicauth.ErrInvalidUsername},
+		{"logintotp", func() error { _, err := lm.LoginTOTP("joe", "token", "000000"); return err }, basicauth.ErrNoSuchSession},
+		{"logout", func() error { return lm.Logout("joe") }, basicauth.ErrNoSuchSession},
+		{"checkuserloggedin", func() error { return lm.CheckUserLoggedIn("joe", "token") }, basicauth.ErrNoSuchSession},
+		{"checkuserpassword", func() error { return lm.CheckUserPassword("nobody", "passwd") }, storage.ErrNoSuchUser},
+		{"checkuserpassword", func() error { return lm.CheckUserPassword("new", "passwd") }, basicauth.ErrMustChangePassword},
+		{"adduser", func() error { return lm.AddUser("joe", "passwd") }, basicauth.ErrUserExists},
+		{"deluser", func() error { return lm.DelUser("joe", "wrong") }, basicauth.ErrInvalidPassword},
+		{"changeuserpassword", func() error { return lm.ChangeUserPassword("joe", "passwd", "passwd") }, basicauth.ErrSamePassword},
+		{"getuserinfo", func() error { _, err := lm.GetUserInfo("joe", "wrong"); return err }, basicauth.ErrInvalidPassword},
+		{"updateuserinfo", func() error { return lm.UpdateUserInfo("joe", "wrong", basicauth.UserInfo{}) }, basicauth.ErrInvalidPassword},
+		{"setuseremail", func() error { return lm.SetUserEmail("joe", "wrong", "joe@example.com") }, basicauth.ErrInvalidPassword},
+		{"requestemailverification", func() error { return lm.RequestEmailVerification("joe", "passwd") }, basicauth.ErrNoNotifier},
+		{"confirmemail", func() error { return lm.ConfirmEmail("joe", "123456") }, basicauth.ErrInvalidVerificationCode},
+		{"enrolltotp", func() error { _, err := lm.EnrollTOTP("ann", "passwd"); return err }, basicauth.ErrTOTPAlreadyEnabled},
+		{"confirmtotp", func() error { return lm.ConfirmTOTP("joe", "passwd", "000000") }, basicauth.ErrTOTPNotEnabled},
+		{"disabletotp", func() error { return lm.DisableTOTP("joe", "passwd", "000000") }, basicauth.ErrTOTPNotEnabled},
+		{"checkusertotp", func() error { return lm.CheckUserTOTP("ann", "passwd", "abcdef") }, basicauth.ErrInvalidTOTPCode},
+		{"generaterecoverycodes", func() error { _, err := lm.GenerateRecoveryCodes("joe", "passwd"); return err }, basicauth.ErrTOTPNotEnabled},
+		{"recoverycodesleft", func() error { _, err := lm.RecoveryCodesLeft("joe", "wrong"); return err }, basicauth.ErrInvalidPassword},
+		{"createapikey", func() error { _, err := lm.CreateAPIKey("joe", "wrong", "key", time.Time{}, nil); return err }, basicauth.ErrInvalidPassword},
+		{"listapikeys", func() error { _, err := lm.ListAPIKeys("joe", "wrong"); return err }, basicauth.ErrInvalidPassword},
+		{"revokeapikey", func() error { return lm.RevokeAPIKey("joe", "passwd", "nokey") }, basicauth.ErrNoSuchAPIKey},
+		{"checkapikey", func() error { _, err := lm.CheckAPIKey("garbage"); return err }, basicauth.ErrInvalidAPIKey},
+		{"checkapikey", func() error { _, err := lm.CheckAPIKey(expired); return err }, basicauth.ErrAPIKeyExpired},
+		{"unknown", func() error {
+			ac := lm.(*authClient)
+			m := ac.messageTemplate()
+			m.Request.Action = "unknown"
+			m, _ = ac.post(m)
+			return responseError(m.Response)
+		}, ErrUnknownAction},
+
+		{"admingetaccount", func() error { _, err := admin.AdminGetAccount("nobody"); return err }, storage.ErrNoSuchUser},
+		{"adminupdateaccount", func() error { joe.Version += 10; return admin.AdminUpdAccount(joe) }, basicauth.ErrConflict},
+		{"adminaddaccount", func() error { return admin.AdminAddAccount("joe") }, basicauth.ErrUserExists},
+		{"admindelaccount", func() error { return admin.AdminDelAccount("nobody") }, storage.ErrNoSuchUser},
+		{"adminresetuserpassword", func() error { return admin.AdminResetUserPassword("nobody") }, storage.ErrNoSuchUser},
+		{"adminlistaccounts", func() error { _, _, err := admin.AdminListAccounts(basicauth.ListQuery{}); return err }, basicauth.ErrNotSupported},
+		{"adminrecoverycodesleft", func() error { _, err := admin.AdminRecoveryCodesLeft("nobody"); return err }, storage.ErrNoSuchUser},
+		{"adminlistapikeys", func() error { _, err := admin.AdminListAPIKeys("nobody"); return err }, storage.ErrNoSuchUser},
+		{"adminrevokeapikey", func() error { return admin.AdminRevokeAPIKey("joe", "nokey") }, basicauth.ErrNoSuchAPIKey},
+		{"adminaddapptoken", func() error { return badadmin.(*AuthAdmin).AdminAddAppToken("token") }, ErrForbidden},
+		{"admindelapptoken", func() error { return aa.AdminDelAppToken("nosuchtoken") }, ErrTokenNotFound},
+		{"admintoggleapptoken", func() error { return aa.AdminToggleAppToken("nosuchtoken") }, ErrTokenNotFound},
+		{"adminreplaceadmintoken", func() error { return badadmin.(*AuthAdmin).AdminReplaceAdminToken("token") }, ErrForbidden},
+		{"adminlistdeadletters", func() error { _, err := aa.AdminListDeadLetters(); return err }, basicauth.ErrNotSupported},
+		{"adminretrydeadletter", func() error { return aa.AdminRetryDeadLetter("id") }, basicauth.ErrNotSupported},
+		{"admindiscarddeadletter", func() error { return aa.AdminDiscardDeadLetter("id") }, basicauth.ErrNotSupported},
+		{"adminunknown", func() error {
+			m := aa.messageTemplate()
+			m.Request.Action = "adminunknown"
+			m, _ = aa.post(m)
+			return responseError(m.Response)
+		}, ErrUnknownAction},
+
+		{"storageget", func() error { _, err := rs.Get("nobody"); return err }, storage.ErrNoSuchUser},
+		{"storageput", func() error { return rs.Put(joe) }, storage.ErrUserExists},
+		{"storageupd", func() error { joe.Version = 100; return rs.Upd(joe) }, basicauth.ErrConflict},
+		{"storagedel", func() error { return rs.Del("nobody") }, storage.ErrNoSuchUser},
+		{"storagelist", func() error { _, _, err := rs.(basicauth.Lister).List(basicauth.ListQuery{}); return err }, basicauth.ErrNotSupported},
+		{"storagechanges", func() error { _, err := rs.(storage.ChangeStream).Changes(0, 10); return err }, basicauth.ErrNotSupported},
+		{"storagesnapshot", func() error { _, err := rs.(storage.ChangeStream).Snapshot(); return err }, basicauth.ErrNotSupported},
+	}
+	for _, c := range cases {
+		if err := c.call(); !errors.Is(err, c.want) {
+			fmt.Printf("%v returned %v, want %v\n", c.action, err, c.want)
+			t.Fail()
+		}
+	}
+}
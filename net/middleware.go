@@ -0,0 +1,51 @@
+package net
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/dmfed/basicauth"
+)
+
+type contextKey int
+
+const apiKeyContextKey contextKey = iota
+
+// APIKeyChecker is implemented by basicauth.AppInterface and
+// basicauth.LoginInterface (both local and remote ones).
+type APIKeyChecker interface {
+	CheckAPIKey(key string) (basicauth.APIKey, error)
+}
+
+// APIKeyMiddleware returns http.Handler which only passes requests carrying
+// valid API key in "Authorization: Bearer <key>" header to next. If scope is not
+// empty the key must be allowed to be used for scope. Checked key is available
+// to next with APIKeyFromContext.
+func APIKeyMiddleware(checker APIKeyChecker, scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="basicauth"`)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		key, err := checker.CheckAPIKey(strings.TrimSpace(auth[7:]))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="basicauth", error="invalid_token"`)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !key.HasScope(scope) {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, key)))
+	})
+}
+
+// APIKeyFromContext returns API key checked by APIKeyMiddleware.
+func APIKeyFromContext(ctx context.Context) (basicauth.APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(basicauth.APIKey)
+	return key, ok
+}
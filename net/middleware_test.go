@@ -0,0 +1,77 @@
+package net
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	fmt.Println("Testing APIKeyMiddleware...")
+	filename := "./test_apikeys.json"
+	st, err := storage.NewJSONPasswordKeeper(filename)
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed", err)
+		t.FailNow()
+	}
+	defer os.Remove(filename)
+	defer st.Close()
+	app, _ := basicauth.NewAppInterface(st)
+	app.AddUser("robot", "passwd")
+	key, err := app.CreateAPIKey("robot", "passwd", "ci", time.Time{}, []string{"read"})
+	if err != nil {
+		fmt.Println("CreateAPIKey returned:", err)
+		t.FailNow()
+	}
+	handler := func(scope string) http.Handler {
+		return APIKeyMiddleware(app, scope, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k, _ := APIKeyFromContext(r.Context())
+			fmt.Fprint(w, k.UserName)
+		}))
+	}
+	cases := []struct {
+		auth  string
+		scope string
+		code  int
+	}{
+		{"", "read", http.StatusUnauthorized},
+		{"Bearer bak.invalid", "read", http.StatusUnauthorized},
+		{"Bearer " + key, "write", http.StatusForbidden},
+		{"Bearer " + key, "read", http.StatusOK},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		handler(c.scope).ServeHTTP(w, r)
+		if w.Code != c.code {
+			fmt.Println("APIKeyMiddleware with", c.auth, "want:", c.code, "got:", w.Code)
+			t.Fail()
+		}
+		if c.code == http.StatusOK && w.Body.String() != "robot" {
+			fmt.Println("APIKeyFromContext returned wrong user:", w.Body.String())
+			t.Fail()
+		}
+	}
+	keys, _ := app.ListAPIKeys("robot", "passwd")
+	if len(keys) != 1 || keys[0].Hash != "" {
+		fmt.Println("ListAPIKeys returned unexpected keys:", keys)
+		t.FailNow()
+	}
+	if err := app.RevokeAPIKey("robot", "passwd", keys[0].ID); err != nil {
+		fmt.Println("RevokeAPIKey returned:", err)
+		t.Fail()
+	}
+	if _, err := app.CheckAPIKey(key); err != basicauth.ErrInvalidAPIKey {
+		fmt.Println("CheckAPIKey for revoked key returned:", err)
+		t.Fail()
+	}
+}
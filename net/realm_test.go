@@ -0,0 +1,89 @@
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+func TestRealms(t *testing.T) {
+	fmt.Println("Testing realms...")
+	fileA, fileB := "./test_realm_a.json", "./test_realm_b.json"
+	defer os.Remove(fileA)
+	defer os.Remove(fileB)
+	stA, _ := storage.NewJSONPasswordKeeper(fileA)
+	stB, _ := storage.NewJSONPasswordKeeper(fileB)
+	server, err := NewLoginServerWithOptions(nil, "", "", "", false, nil,
+		WithRealm(Realm{Name: "a", Storage: stA, AppTokens: []string{"tokenA"}}),
+		WithRealm(Realm{Name: "b", Storage: stB, AppTokens: []string{"tokenB"}, AdminToken: "adminB",
+			Options: []basicauth.Option{basicauth.WithUsernamePolicy(&basicauth.UsernamePolicy{FoldCase: true})}}))
+	if err != nil {
+		fmt.Println("NewLoginServerWithOptions returned:", err)
+		t.FailNow()
+	}
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	appA, _ := NewRemoteRealmLoginInterface(u.Hostname(), u.Port(), "a", "tokenA", false)
+	appB, _ := NewRemoteRealmLoginInterface(u.Hostname(), u.Port(), "b", "tokenB", false)
+	if err := appA.AddUser("Joe", "passwd"); err != nil {
+		fmt.Println("AddUser in realm a returned:", err)
+		t.Fail()
+	}
+	if err := appB.CheckUserPassword("Joe", "passwd"); err == nil {
+		fmt.Println("user of realm a is visible in realm b")
+		t.Fail()
+	}
+	appB.AddUser("Joe", "passwd")
+	if err := appB.CheckUserPassword("JOE", "passwd"); err != nil {
+		fmt.Println("username policy of realm b was not applied:", err)
+		t.Fail()
+	}
+	// token of realm a gives no access to realm b
+	crossed, _ := NewRemoteRealmLoginInterface(u.Hostname(), u.Port(), "b", "tokenA", false)
+	if err := crossed.CheckUserPassword("Joe", "passwd"); err == nil {
+		fmt.Println("token of realm a was accepted in realm b")
+		t.Fail()
+	}
+	adminB, _ := NewRemoteRealmAdminInterface(u.Hostname(), u.Port(), "b", "adminB", false)
+	if _, err := adminB.AdminGetAccount("joe"); err != nil {
+		fmt.Println("AdminGetAccount in realm b returned:", err)
+		t.Fail()
+	}
+
+	post := func(path string, msg Message) int {
+		resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(msg.ToBytes()))
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	msg := Message{AppToken: "tokenA", Request: Request{Action: "checkuserpassword", Realm: "a", UserName: "Joe", Password: "passwd"}}
+	cases := []struct {
+		path  string
+		realm string
+		code  int
+	}{
+		{"/", "a", http.StatusOK},
+		{"/a", "", http.StatusOK},
+		{"/b", "a", http.StatusBadRequest},
+		{"/", "", http.StatusNotFound},
+		{"/c", "", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		msg.Request.Realm = c.realm
+		if code := post(c.path, msg); code != c.code {
+			fmt.Printf("POST %v with realm %q returned %v, want %v\n", c.path, c.realm, code, c.code)
+			t.Fail()
+		}
+	}
+}
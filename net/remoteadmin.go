@@ -2,12 +2,14 @@ package net
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 
 	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/webhook"
 )
 
 var (
@@ -18,6 +20,8 @@ type AuthAdmin struct {
 	ipAddr     string
 	adminToken string
 	secure     bool
+	// ctx is set on clients bound with WithContext
+	ctx context.Context
 }
 
 // NewAdminClient returns basicauth.AdminInterface with two methods added
@@ -31,6 +35,22 @@ func NewRemoteAdminInterface(ip, port, admintoken string, secure bool) (basicaut
 	return &aa, nil
 }
 
+// NewRemoteRealmAdminInterface is the same as NewRemoteAdminInterface
+// but manages users of realm (see WithRealm).
+func NewRemoteRealmAdminInterface(ip, port, realm, admintoken string, secure bool) (basicauth.AdminInterface, error) {
+	ai, _ := NewRemoteAdminInterface(ip, port, admintoken, secure)
+	ai.(*AuthAdmin).ipAddr += realmPath(realm)
+	return ai, nil
+}
+
+// WithContext returns copy of the client which sends requests with ctx,
+// see basicauth.AdminWithContext
+func (aa *AuthAdmin) WithContext(ctx context.Context) basicauth.AdminInterface {
+	bound := *aa
+	bound.ctx = ctx
+	return &bound
+}
+
 func (aa *AuthAdmin) AdminGetAccount(username string) (basicauth.Account, error) {
 	m := aa.messageTemplate()
 	m.Request.Action = "admingetaccount"
@@ -40,7 +60,7 @@ func (aa *AuthAdmin) AdminGetAccount(username string) (basicauth.Account, error)
 		return m.Response.Account, err
 	}
 	if !m.Response.OK {
-		return m.Response.Account, fmt.Errorf("could not get user info for user %v: %v", username, m.Response.Error)
+		return m.Response.Account, fmt.Errorf("could not get user info for user %v: %w", username, responseError(m.Response))
 	}
 	return m.Response.Account, nil
 }
@@ -54,7 +74,7 @@ func (aa *AuthAdmin) AdminUpdAccount(account basicauth.Account) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not update user info for user %v: %v", account.UserName, m.Response.Error)
+		return fmt.Errorf("could not update user info for user %v: %w", account.UserName, responseError(m.Response))
 	}
 	return nil
 }
@@ -68,7 +88,7 @@ func (aa *AuthAdmin) AdminResetUserPassword(username string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not reset password for user %v: %v", username, m.Response.Error)
+		return fmt.Errorf("could not reset password for user %v: %w", username, responseError(m.Response))
 	}
 	return nil
 }
@@ -82,7 +102,7 @@ func (aa *AuthAdmin) AdminAddAccount(username string) (err error) {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not add user %v: %v", username, m.Response.Error)
+		return fmt.Errorf("could not add user %v: %w", username, responseError(m.Response))
 	}
 	return nil
 }
@@ -96,11 +116,68 @@ func (aa *AuthAdmin) AdminDelAccount(username string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not delete user %v: %v", username, m.Response.Error)
+		return fmt.Errorf("could not delete user %v: %w", username, responseError(m.Response))
 	}
 	return nil
 }
 
+func (aa *AuthAdmin) AdminRecoveryCodesLeft(username string) (int, error) {
+	m := aa.messageTemplate()
+	m.Request.Action = "adminrecoverycodesleft"
+	m.Request.UserName = username
+	m, err := aa.post(m)
+	if err != nil {
+		return 0, err
+	}
+	if !m.Response.OK {
+		return 0, fmt.Errorf("could not count recovery codes for user %v: %w", username, responseError(m.Response))
+	}
+	return m.Response.Count, nil
+}
+
+func (aa *AuthAdmin) AdminListAPIKeys(username string) ([]basicauth.APIKey, error) {
+	m := aa.messageTemplate()
+	m.Request.Action = "adminlistapikeys"
+	m.Request.UserName = username
+	m, err := aa.post(m)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Response.OK {
+		return nil, fmt.Errorf("could not list api keys of user %v: %w", username, responseError(m.Response))
+	}
+	return m.Response.APIKeys, nil
+}
+
+func (aa *AuthAdmin) AdminRevokeAPIKey(username, id string) error {
+	m := aa.messageTemplate()
+	m.Request.Action = "adminrevokeapikey"
+	m.Request.UserName = username
+	m.Request.KeyID = id
+	m, err := aa.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("could not revoke api key %v of user %v: %w", id, username, responseError(m.Response))
+	}
+	return nil
+}
+
+func (aa *AuthAdmin) AdminListAccounts(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	m := aa.messageTemplate()
+	m.Request.Action = "adminlistaccounts"
+	m.Request.Query = q
+	m, err := aa.post(m)
+	if err != nil {
+		return nil, "", err
+	}
+	if !m.Response.OK {
+		return nil, "", fmt.Errorf("could not list accounts: %w", responseError(m.Response))
+	}
+	return m.Response.Accounts, m.Response.Cursor, nil
+}
+
 func (aa *AuthAdmin) AdminAddAppToken(token string) error {
 	m := aa.messageTemplate()
 	m.Request.Action = "adminaddapptoken"
@@ -110,7 +187,7 @@ func (aa *AuthAdmin) AdminAddAppToken(token string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could add token: %v", m.Response.Error)
+		return fmt.Errorf("could add token: %w", responseError(m.Response))
 	}
 	return nil
 }
@@ -124,7 +201,7 @@ func (aa *AuthAdmin) AdminDelAppToken(token string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could delete token: %v", m.Response.Error)
+		return fmt.Errorf("could delete token: %w", responseError(m.Response))
 	}
 	return nil
 }
@@ -138,7 +215,7 @@ func (aa *AuthAdmin) AdminToggleAppToken(token string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could toggle token: %v", m.Response.Error)
+		return fmt.Errorf("could toggle token: %w", responseError(m.Response))
 	}
 	return nil
 }
@@ -152,14 +229,23 @@ func (aa *AuthAdmin) AdminReplaceAdminToken(token string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could add token: %v", m.Response.Error)
+		return fmt.Errorf("could add token: %w", responseError(m.Response))
 	}
 	return nil
 }
 
 func (aa *AuthAdmin) post(inpmessage Message) (Message, error) {
 	var m Message
-	resp, err := http.Post(aa.ipAddr, "application/json", bytes.NewReader(inpmessage.ToBytes()))
+	ctx := aa.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", aa.ipAddr, bytes.NewReader(inpmessage.ToBytes()))
+	if err != nil {
+		return m, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return m, err
 	}
@@ -169,7 +255,7 @@ func (aa *AuthAdmin) post(inpmessage Message) (Message, error) {
 		return m, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return m, fmt.Errorf("server returned: %v", string(data))
+		return m, statusError(resp.StatusCode, data)
 	}
 	if err = m.FromBytes(data); err != nil {
 		return m, err
@@ -180,7 +266,52 @@ func (aa *AuthAdmin) post(inpmessage Message) (Message, error) {
 func (aa *AuthAdmin) messageTemplate() Message {
 	var m Message
 	m.AppToken = aa.adminToken
-	// TODO Handle ids in some way
-	// m.Request.ID = "0000"
+	if aa.ctx != nil {
+		m.Request.ID = basicauth.RequestID(aa.ctx)
+	}
 	return m
 }
+
+// AdminListDeadLetters returns webhook deliveries which failed all attempts
+func (aa *AuthAdmin) AdminListDeadLetters() ([]webhook.Delivery, error) {
+	m := aa.messageTemplate()
+	m.Request.Action = "adminlistdeadletters"
+	m, err := aa.post(m)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Response.OK {
+		return nil, fmt.Errorf("could not list dead letters: %w", responseError(m.Response))
+	}
+	return m.Response.DeadLetters, nil
+}
+
+// AdminRetryDeadLetter puts dead letter back to webhook outbox
+func (aa *AuthAdmin) AdminRetryDeadLetter(id string) error {
+	m := aa.messageTemplate()
+	m.Request.Action = "adminretrydeadletter"
+	m.Request.DeliveryID = id
+	m, err := aa.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("could not retry dead letter %v: %w", id, responseError(m.Response))
+	}
+	return nil
+}
+
+// AdminDiscardDeadLetter removes dead letter
+func (aa *AuthAdmin) AdminDiscardDeadLetter(id string) error {
+	m := aa.messageTemplate()
+	m.Request.Action = "admindiscarddeadletter"
+	m.Request.DeliveryID = id
+	m, err := aa.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("could not discard dead letter %v: %w", id, responseError(m.Response))
+	}
+	return nil
+}
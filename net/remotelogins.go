@@ -2,9 +2,12 @@ package net
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/dmfed/basicauth"
 )
@@ -14,6 +17,8 @@ type authClient struct {
 	ipAddr   string
 	appToken string
 	secure   bool
+	// ctx is set on clients bound with WithContext
+	ctx context.Context
 }
 
 func NewRemoteAppInterface(ip, port, apptoken string, requireTLS bool) (basicauth.AppInterface, error) {
@@ -24,6 +29,22 @@ func NewRemodeLoginInterface(ip, port, apptoken string, requireTLS bool) (basica
 	return getAC(ip, port, apptoken, requireTLS), nil
 }
 
+// NewRemoteRealmLoginInterface is the same as NewRemodeLoginInterface
+// but works with users of realm (see WithRealm).
+func NewRemoteRealmLoginInterface(ip, port, realm, apptoken string, requireTLS bool) (basicauth.LoginInterface, error) {
+	ac := getAC(ip, port, apptoken, requireTLS)
+	ac.ipAddr += realmPath(realm)
+	return ac, nil
+}
+
+// realmPath returns URL path selecting realm on the server
+func realmPath(realm string) string {
+	if realm == "" {
+		return ""
+	}
+	return "/" + url.PathEscape(realm)
+}
+
 func getAC(ip, port, apptoken string, requireTLS bool) *authClient {
 	var ac authClient
 	switch requireTLS {
@@ -38,6 +59,26 @@ func getAC(ip, port, apptoken string, requireTLS bool) *authClient {
 	return &ac
 }
 
+// WithContext returns copy of the client which sends requests with ctx,
+// so that they are canceled when ctx is done. Request ID of ctx (see
+// basicauth.WithRequestID) is passed to server. See basicauth.LoginWithContext.
+func (ac *authClient) WithContext(ctx context.Context) basicauth.LoginInterface {
+	return ac.bind(ctx)
+}
+
+func (ac *authClient) bind(ctx context.Context) *authClient {
+	bound := *ac
+	bound.ctx = ctx
+	return &bound
+}
+
+func (ac *authClient) context() context.Context {
+	if ac.ctx == nil {
+		return context.Background()
+	}
+	return ac.ctx
+}
+
 func (ac *authClient) Login(username, password string) (token string, err error) {
 	m := ac.messageTemplate()
 	m.Request.Action = "login"
@@ -48,7 +89,24 @@ func (ac *authClient) Login(username, password string) (token string, err error)
 		return "", err
 	}
 	if !m.Response.OK {
-		return "", fmt.Errorf("could not login user %v: %v", username, m.Response.Error)
+		// Token holds pending token if server requires one-time code
+		return m.Response.Token, fmt.Errorf("could not login user %v: %w", username, responseError(m.Response))
+	}
+	return m.Response.Token, nil
+}
+
+func (ac *authClient) LoginTOTP(username, pendingtoken, code string) (token string, err error) {
+	m := ac.messageTemplate()
+	m.Request.Action = "logintotp"
+	m.Request.UserName = username
+	m.Request.Token = pendingtoken
+	m.Request.Code = code
+	m, err = ac.post(m)
+	if err != nil {
+		return "", err
+	}
+	if !m.Response.OK {
+		return "", fmt.Errorf("could not login user %v: %w", username, responseError(m.Response))
 	}
 	return m.Response.Token, nil
 }
@@ -62,7 +120,7 @@ func (ac *authClient) Logout(username string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not logout user %v: %v", username, m.Response.Error)
+		return fmt.Errorf("could not logout user %v: %w", username, responseError(m.Response))
 	}
 	return nil
 }
@@ -77,7 +135,7 @@ func (ac *authClient) CheckUserLoggedIn(username, token string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not comnfirm user %v status: %v", username, m.Response.Error)
+		return fmt.Errorf("could not comnfirm user %v status: %w", username, responseError(m.Response))
 	}
 	return nil
 }
@@ -91,7 +149,7 @@ func (ac *authClient) CheckUserPassword(username, password string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("error checking password for user %v: %v", username, m.Response.Error)
+		return fmt.Errorf("error checking password for user %v: %w", username, responseError(m.Response))
 	}
 	return nil
 }
@@ -106,7 +164,7 @@ func (ac *authClient) AddUser(username, password string) (err error) {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not add user %v: %v", username, m.Response.Error)
+		return fmt.Errorf("could not add user %v: %w", username, responseError(m.Response))
 	}
 	return nil
 }
@@ -121,7 +179,7 @@ func (ac *authClient) DelUser(username, password string) error {
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not delete user %v: %v", username, m.Response.Error)
+		return fmt.Errorf("could not delete user %v: %w", username, responseError(m.Response))
 	}
 	return nil
 }
@@ -137,7 +195,7 @@ func (ac *authClient) ChangeUserPassword(username, oldpassword, newpassword stri
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not reset password for user %v: %v", username, m.Response.Error)
+		return fmt.Errorf("could not reset password for user %v: %w", username, responseError(m.Response))
 	}
 	return nil
 }
@@ -152,7 +210,7 @@ func (ac *authClient) GetUserInfo(username, password string) (basicauth.UserInfo
 		return m.Response.UserInfo, err
 	}
 	if !m.Response.OK {
-		return basicauth.UserInfo{}, fmt.Errorf("could not get user info for user %v: %v", username, m.Response.Error)
+		return basicauth.UserInfo{}, fmt.Errorf("could not get user info for user %v: %w", username, responseError(m.Response))
 	}
 	return m.Response.UserInfo, nil
 }
@@ -160,7 +218,7 @@ func (ac *authClient) GetUserInfo(username, password string) (basicauth.UserInfo
 func (ac *authClient) UpdateUserInfo(username, password string, newinfo basicauth.UserInfo) error {
 	m := ac.messageTemplate()
 	m.Request.Action = "updateuserinfo"
-	m.Request.UserInfo = newinfo
+	m.Request.UserName = username
 	m.Request.Password = password
 	m.Request.UserInfo = newinfo
 	m, err := ac.post(m)
@@ -168,13 +226,220 @@ func (ac *authClient) UpdateUserInfo(username, password string, newinfo basicaut
 		return err
 	}
 	if !m.Response.OK {
-		return fmt.Errorf("could not update userinfo for user %v: %v", username, m.Response.Error)
+		return fmt.Errorf("could not update userinfo for user %v: %w", username, responseError(m.Response))
+	}
+	return nil
+}
+
+func (ac *authClient) SetUserEmail(username, password, email string) error {
+	m := ac.messageTemplate()
+	m.Request.Action = "setuseremail"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m.Request.Email = email
+	m, err := ac.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("could not set email for user %v: %w", username, responseError(m.Response))
+	}
+	return nil
+}
+
+func (ac *authClient) RequestEmailVerification(username, password string) error {
+	m := ac.messageTemplate()
+	m.Request.Action = "requestemailverification"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m, err := ac.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("could not request email verification for user %v: %w", username, responseError(m.Response))
+	}
+	return nil
+}
+
+func (ac *authClient) ConfirmEmail(username, code string) error {
+	m := ac.messageTemplate()
+	m.Request.Action = "confirmemail"
+	m.Request.UserName = username
+	m.Request.Code = code
+	m, err := ac.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("could not confirm email for user %v: %w", username, responseError(m.Response))
+	}
+	return nil
+}
+
+func (ac *authClient) EnrollTOTP(username, password string) (uri string, err error) {
+	m := ac.messageTemplate()
+	m.Request.Action = "enrolltotp"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m, err = ac.post(m)
+	if err != nil {
+		return "", err
+	}
+	if !m.Response.OK {
+		return "", fmt.Errorf("could not enroll user %v: %w", username, responseError(m.Response))
+	}
+	return m.Response.Message, nil
+}
+
+func (ac *authClient) ConfirmTOTP(username, password, code string) error {
+	m := ac.messageTemplate()
+	m.Request.Action = "confirmtotp"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m.Request.Code = code
+	m, err := ac.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("could not confirm enrollment for user %v: %w", username, responseError(m.Response))
+	}
+	return nil
+}
+
+func (ac *authClient) DisableTOTP(username, password, code string) error {
+	m := ac.messageTemplate()
+	m.Request.Action = "disabletotp"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m.Request.Code = code
+	m, err := ac.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("could not disable two-factor authentication for user %v: %w", username, responseError(m.Response))
+	}
+	return nil
+}
+
+func (ac *authClient) CheckUserTOTP(username, password, code string) error {
+	m := ac.messageTemplate()
+	m.Request.Action = "checkusertotp"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m.Request.Code = code
+	m, err := ac.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("error checking one-time code for user %v: %w", username, responseError(m.Response))
 	}
 	return nil
 }
 
+func (ac *authClient) GenerateRecoveryCodes(username, password string) ([]string, error) {
+	m := ac.messageTemplate()
+	m.Request.Action = "generaterecoverycodes"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m, err := ac.post(m)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Response.OK {
+		return nil, fmt.Errorf("could not generate recovery codes for user %v: %w", username, responseError(m.Response))
+	}
+	return m.Response.Codes, nil
+}
+
+func (ac *authClient) RecoveryCodesLeft(username, password string) (int, error) {
+	m := ac.messageTemplate()
+	m.Request.Action = "recoverycodesleft"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m, err := ac.post(m)
+	if err != nil {
+		return 0, err
+	}
+	if !m.Response.OK {
+		return 0, fmt.Errorf("could not count recovery codes for user %v: %w", username, responseError(m.Response))
+	}
+	return m.Response.Count, nil
+}
+
+func (ac *authClient) CreateAPIKey(username, password, name string, expires time.Time, scopes []string) (key string, err error) {
+	m := ac.messageTemplate()
+	m.Request.Action = "createapikey"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m.Request.Name = name
+	m.Request.Expires = expires
+	m.Request.Scopes = scopes
+	m, err = ac.post(m)
+	if err != nil {
+		return "", err
+	}
+	if !m.Response.OK {
+		return "", fmt.Errorf("could not create api key for user %v: %w", username, responseError(m.Response))
+	}
+	return m.Response.Token, nil
+}
+
+func (ac *authClient) ListAPIKeys(username, password string) ([]basicauth.APIKey, error) {
+	m := ac.messageTemplate()
+	m.Request.Action = "listapikeys"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m, err := ac.post(m)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Response.OK {
+		return nil, fmt.Errorf("could not list api keys of user %v: %w", username, responseError(m.Response))
+	}
+	return m.Response.APIKeys, nil
+}
+
+func (ac *authClient) RevokeAPIKey(username, password, id string) error {
+	m := ac.messageTemplate()
+	m.Request.Action = "revokeapikey"
+	m.Request.UserName = username
+	m.Request.Password = password
+	m.Request.KeyID = id
+	m, err := ac.post(m)
+	if err != nil {
+		return err
+	}
+	if !m.Response.OK {
+		return fmt.Errorf("could not revoke api key %v of user %v: %w", id, username, responseError(m.Response))
+	}
+	return nil
+}
+
+func (ac *authClient) CheckAPIKey(key string) (basicauth.APIKey, error) {
+	m := ac.messageTemplate()
+	m.Request.Action = "checkapikey"
+	m.Request.Token = key
+	m, err := ac.post(m)
+	if err != nil {
+		return basicauth.APIKey{}, err
+	}
+	if !m.Response.OK {
+		return basicauth.APIKey{}, fmt.Errorf("error checking api key: %w", responseError(m.Response))
+	}
+	return m.Response.APIKey, nil
+}
+
 func (ac *authClient) post(inpmessage Message) (m Message, err error) {
-	resp, err := http.Post(ac.schema+ac.ipAddr, "application/json", bytes.NewReader(inpmessage.ToBytes()))
+	req, err := http.NewRequestWithContext(ac.context(), "POST", ac.schema+ac.ipAddr, bytes.NewReader(inpmessage.ToBytes()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return
 	}
@@ -183,6 +448,9 @@ func (ac *authClient) post(inpmessage Message) (m Message, err error) {
 	if err != nil {
 		return
 	}
+	if resp.StatusCode != http.StatusOK {
+		return m, statusError(resp.StatusCode, data)
+	}
 	if err = m.FromBytes(data); err != nil {
 		return
 	}
@@ -193,5 +461,8 @@ func (ac *authClient) messageTemplate() Message {
 	var m Message
 	m.AppToken = ac.appToken
 	m.Request.ID = "0000"
+	if id := basicauth.RequestID(ac.context()); id != "" {
+		m.Request.ID = id
+	}
 	return m
 }
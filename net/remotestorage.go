@@ -0,0 +1,154 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+// storageErrors are passed by server as codes and turned back into the
+// same values by storageClient, so that callers may compare them with ==
+var storageErrors = []error{
+	storage.ErrNoSuchUser,
+	storage.ErrUserExists,
+	basicauth.ErrConflict,
+	basicauth.ErrNotSupported,
+	storage.ErrChangesTruncated,
+}
+
+// storageClient implements basicauth.UserAccountStorage, basicauth.Lister
+// and storage.ChangeStream over storage* actions of the server
+type storageClient struct {
+	*authClient
+}
+
+// NewRemoteStorage returns UserAccountStorage which keeps accounts on auth
+// server started with WithStorageToken option. Several servers can share one
+// storage this way. Close does not close storage of the remote server.
+func NewRemoteStorage(ip, port, storagetoken string, requireTLS bool) (basicauth.UserAccountStorage, error) {
+	return &storageClient{getAC(ip, port, storagetoken, requireTLS)}, nil
+}
+
+// NewRemoteRealmStorage is the same as NewRemoteStorage
+// but keeps accounts of realm (see WithRealm).
+func NewRemoteRealmStorage(ip, port, realm, storagetoken string, requireTLS bool) (basicauth.UserAccountStorage, error) {
+	sc := &storageClient{getAC(ip, port, storagetoken, requireTLS)}
+	sc.ipAddr += realmPath(realm)
+	return sc, nil
+}
+
+func (sc *storageClient) call(m Message) (Message, error) {
+	action, username := m.Request.Action, m.Request.UserName+m.Request.Account.UserName
+	m, err := sc.post(m)
+	if err != nil {
+		return m, err
+	}
+	if !m.Response.OK {
+		err := responseError(m.Response)
+		for _, e := range storageErrors {
+			if errors.Is(err, e) {
+				return m, e
+			}
+		}
+		return m, fmt.Errorf("remote storage error: %v %v: %w", action, username, err)
+	}
+	return m, nil
+}
+
+// GetContext, PutContext, UpdContext, DelContext and ListContext implement
+// basicauth.ContextStorage and basicauth.ContextLister
+func (sc *storageClient) GetContext(ctx context.Context, username string) (basicauth.Account, error) {
+	return sc.bind(ctx).Get(username)
+}
+
+func (sc *storageClient) PutContext(ctx context.Context, account basicauth.Account) error {
+	return sc.bind(ctx).Put(account)
+}
+
+func (sc *storageClient) UpdContext(ctx context.Context, account basicauth.Account) error {
+	return sc.bind(ctx).Upd(account)
+}
+
+func (sc *storageClient) DelContext(ctx context.Context, username string) error {
+	return sc.bind(ctx).Del(username)
+}
+
+func (sc *storageClient) ListContext(ctx context.Context, q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	return sc.bind(ctx).List(q)
+}
+
+func (sc *storageClient) bind(ctx context.Context) *storageClient {
+	return &storageClient{sc.authClient.bind(ctx)}
+}
+
+func (sc *storageClient) Get(username string) (basicauth.Account, error) {
+	m := sc.messageTemplate()
+	m.Request.Action = "storageget"
+	m.Request.UserName = username
+	m, err := sc.call(m)
+	if err != nil {
+		return basicauth.Account{}, err
+	}
+	return m.Response.Account, nil
+}
+
+func (sc *storageClient) Put(account basicauth.Account) error {
+	m := sc.messageTemplate()
+	m.Request.Action = "storageput"
+	m.Request.Account = account
+	_, err := sc.call(m)
+	return err
+}
+
+func (sc *storageClient) Upd(account basicauth.Account) error {
+	m := sc.messageTemplate()
+	m.Request.Action = "storageupd"
+	m.Request.Account = account
+	_, err := sc.call(m)
+	return err
+}
+
+func (sc *storageClient) Del(username string) error {
+	m := sc.messageTemplate()
+	m.Request.Action = "storagedel"
+	m.Request.UserName = username
+	_, err := sc.call(m)
+	return err
+}
+
+func (sc *storageClient) List(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	m := sc.messageTemplate()
+	m.Request.Action = "storagelist"
+	m.Request.Query = q
+	m, err := sc.call(m)
+	if err != nil {
+		return nil, "", err
+	}
+	return m.Response.Accounts, m.Response.Cursor, nil
+}
+
+// Close does nothing as there is no persistent connection
+func (sc *storageClient) Close() error {
+	return nil
+}
+
+// Changes implements storage.ChangeStream
+func (sc *storageClient) Changes(after uint64, limit int) (storage.ChangeBatch, error) {
+	m := sc.messageTemplate()
+	m.Request.Action = "storagechanges"
+	m.Request.Seq = after
+	m.Request.Query.Limit = limit
+	m, err := sc.call(m)
+	return m.Response.Changes, err
+}
+
+// Snapshot implements storage.ChangeStream
+func (sc *storageClient) Snapshot() (storage.ChangeBatch, error) {
+	m := sc.messageTemplate()
+	m.Request.Action = "storagesnapshot"
+	m, err := sc.call(m)
+	return m.Response.Changes, err
+}
@@ -0,0 +1,69 @@
+package net
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+func TestRemoteStorage(t *testing.T) {
+	fmt.Println("Testing remote storage...")
+	filename := "./test_remotestorage.json"
+	st, err := storage.NewJSONPasswordKeeper(filename)
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed", err)
+		t.FailNow()
+	}
+	defer os.Remove(filename)
+	defer st.Close()
+	server, _ := NewLoginServerWithOptions(st, "", "", "admintoken", false, []string{"apptoken"}, WithStorageToken("storagetoken"))
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	rs, _ := NewRemoteStorage(u.Hostname(), u.Port(), "storagetoken", false)
+	if err := rs.Put(basicauth.Account{UserName: "joe", PasswordHash: "hash"}); err != nil {
+		fmt.Println("Put() returned:", err)
+		t.Fail()
+	}
+	if err := rs.Put(basicauth.Account{UserName: "joe"}); err != storage.ErrUserExists {
+		fmt.Println("Put() of existing user returned:", err)
+		t.Fail()
+	}
+	account, err := rs.Get("joe")
+	if err != nil || account.PasswordHash != "hash" {
+		fmt.Println("Get() returned:", account, err)
+		t.Fail()
+	}
+	account.Disabled = true
+	rs.Upd(account)
+	if err := rs.Upd(account); err != basicauth.ErrConflict {
+		fmt.Println("Upd() with stale version returned:", err)
+		t.Fail()
+	}
+	if accounts, _, err := rs.(basicauth.Lister).List(basicauth.ListQuery{}); err != nil || len(accounts) != 1 || !accounts[0].Disabled {
+		fmt.Println("List() returned:", accounts, err)
+		t.Fail()
+	}
+	if err := rs.Del("joe"); err != nil {
+		fmt.Println("Del() returned:", err)
+		t.Fail()
+	}
+	if _, err := rs.Get("joe"); err != storage.ErrNoSuchUser {
+		fmt.Println("Get() of deleted user returned:", err)
+		t.Fail()
+	}
+	// app and admin tokens have no access to storage actions
+	for _, token := range []string{"apptoken", "admintoken"} {
+		other, _ := NewRemoteStorage(u.Hostname(), u.Port(), token, false)
+		if _, err := other.Get("joe"); err == nil || err == storage.ErrNoSuchUser {
+			fmt.Println("storage action was allowed with token", token, err)
+			t.Fail()
+		}
+	}
+}
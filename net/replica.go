@@ -0,0 +1,365 @@
+package net
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+// ErrReadOnly is returned by replica for actions which change accounts
+var ErrReadOnly = errors.New("error: replica is read-only")
+
+// replicaBatchSize is number of changes requested from primary at once
+const replicaBatchSize = 1000
+
+// replicaActions are actions served by replica. All of them only read
+// accounts, bookkeeping updates such as Lastlogin and failed login attempts
+// are forwarded to primary.
+var replicaActions = map[string]bool{
+	"checkuserpassword": true,
+	"checkuserloggedin": true,
+	"checkapikey":       true,
+}
+
+// ReplicaStatus describes replication state of Replica. Healthy is false
+// until snapshot of primary is fully loaded into local storage.
+type ReplicaStatus struct {
+	Healthy    bool
+	Epoch      string    `json:",omitempty"`
+	PrimarySeq uint64    // last change known to primary at LastSync
+	AppliedSeq uint64    // last change applied to local storage
+	Lag        uint64    // changes not yet applied
+	LastSync   time.Time `json:",omitempty"`
+	LastError  string    `json:",omitempty"`
+}
+
+// Replica keeps local storage in sync with change stream of primary
+// auth server. Primary must use storage created with storage.NewChangeLog
+// and have storage token set with WithStorageToken.
+type Replica struct {
+	local    basicauth.UserAccountStorage
+	remote   basicauth.UserAccountStorage
+	primary  storage.ChangeStream
+	sessions *replicaSessions
+	interval time.Duration
+	mutex    sync.Mutex
+	status   ReplicaStatus
+	// view holds accounts of snapshot being loaded into local storage.
+	// While it is set, accounts are read from it instead of local storage.
+	viewMutex sync.RWMutex
+	view      map[string]basicauth.Account
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewReplica returns Replica which polls primary at ip:port every interval.
+// local storage must implement basicauth.Lister and should be dedicated to
+// replica as it is wiped when replica has to start over from snapshot.
+func NewReplica(local basicauth.UserAccountStorage, ip, port, storagetoken string, requireTLS bool, interval time.Duration) (*Replica, error) {
+	if local == nil {
+		return nil, ErrStorageIsNil
+	}
+	primary, _ := NewRemoteStorage(ip, port, storagetoken, requireTLS)
+	return &Replica{
+		local:    local,
+		remote:   primary,
+		primary:  primary.(storage.ChangeStream),
+		sessions: &replicaSessions{tokens: make(map[string]storage.JournalRecord)},
+		interval: interval,
+	}, nil
+}
+
+// Start starts polling primary in background
+func (rp *Replica) Start() {
+	rp.stop = make(chan struct{})
+	rp.done = make(chan struct{})
+	go func() {
+		defer close(rp.done)
+		ticker := time.NewTicker(rp.interval)
+		defer ticker.Stop()
+		for {
+			if err := rp.Sync(); err != nil {
+				log.Printf("replica: sync failed: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-rp.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops polling started with Start
+func (rp *Replica) Stop() {
+	if rp.stop != nil {
+		close(rp.stop)
+		<-rp.done
+		rp.stop = nil
+	}
+}
+
+// Sync applies all changes made on primary since the last call
+func (rp *Replica) Sync() error {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	err := rp.sync()
+	if err != nil {
+		rp.status.LastError = err.Error()
+	} else {
+		rp.status.LastError = ""
+		rp.status.LastSync = time.Now()
+	}
+	return err
+}
+
+// sync is called with mutex held
+func (rp *Replica) sync() error {
+	for {
+		batch, err := rp.primary.Changes(rp.status.AppliedSeq, replicaBatchSize)
+		if err == storage.ErrChangesTruncated || (err == nil && batch.Epoch != rp.status.Epoch) {
+			if err := rp.loadSnapshot(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, rec := range batch.Records {
+			if err := rp.apply(rec); err != nil {
+				return err
+			}
+			rp.status.AppliedSeq = rec.Seq
+		}
+		rp.status.PrimarySeq = batch.Seq
+		rp.status.Lag = batch.Seq - rp.status.AppliedSeq
+		if len(batch.Records) == 0 || rp.status.Lag == 0 {
+			return nil
+		}
+	}
+}
+
+// loadSnapshot replaces contents of local storage with snapshot of primary.
+// Snapshot is served to readers from memory as a whole while local storage
+// is rebuilt, so they never see partly loaded state. If rebuilding fails,
+// snapshot is still served and replica stays unhealthy until next load.
+func (rp *Replica) loadSnapshot() error {
+	snapshot, err := rp.primary.Snapshot()
+	if err != nil {
+		return err
+	}
+	l, ok := rp.local.(basicauth.Lister)
+	if !ok {
+		return basicauth.ErrNotSupported
+	}
+	view := make(map[string]basicauth.Account, len(snapshot.Accounts))
+	for _, account := range snapshot.Accounts {
+		view[account.UserName] = account
+	}
+	rp.status.Healthy = false
+	rp.setView(view)
+	for {
+		accounts, _, err := l.List(basicauth.ListQuery{})
+		if err != nil {
+			return err
+		}
+		if len(accounts) == 0 {
+			break
+		}
+		for _, account := range accounts {
+			if err := rp.local.Del(account.UserName); err != nil {
+				return err
+			}
+		}
+	}
+	for _, account := range snapshot.Accounts {
+		if err := rp.local.Put(account); err != nil {
+			return err
+		}
+	}
+	rp.setView(nil)
+	rp.sessions.clear()
+	for _, rec := range snapshot.Records {
+		rp.sessions.apply(rec)
+	}
+	rp.status.Healthy = true
+	log.Printf("replica: loaded snapshot of %v accounts at %v:%v", len(snapshot.Accounts), snapshot.Epoch, snapshot.Seq)
+	rp.status.Epoch = snapshot.Epoch
+	rp.status.AppliedSeq = snapshot.Seq
+	return nil
+}
+
+func (rp *Replica) setView(view map[string]basicauth.Account) {
+	rp.viewMutex.Lock()
+	defer rp.viewMutex.Unlock()
+	rp.view = view
+}
+
+// get returns account from snapshot being loaded, if any, or from local storage
+func (rp *Replica) get(username string) (basicauth.Account, error) {
+	rp.viewMutex.RLock()
+	view := rp.view
+	rp.viewMutex.RUnlock()
+	if view == nil {
+		return rp.local.Get(username)
+	}
+	account, ok := view[username]
+	if !ok {
+		return basicauth.Account{}, storage.ErrNoSuchUser
+	}
+	return storage.CopyAccount(account), nil
+}
+
+// apply makes the change to local storage. Accounts are replaced
+// with Del and Put to keep their versions as on primary.
+func (rp *Replica) apply(rec storage.JournalRecord) error {
+	switch rec.Op {
+	case storage.OpPut, storage.OpUpd:
+		if rec.Account == nil {
+			return nil
+		}
+		if err := rp.local.Del(rec.UserName); err != nil && err != storage.ErrNoSuchUser {
+			return err
+		}
+		return rp.local.Put(*rec.Account)
+	case storage.OpDel:
+		if err := rp.local.Del(rec.UserName); err != nil && err != storage.ErrNoSuchUser {
+			return err
+		}
+	case storage.OpLogin, storage.OpLogout:
+		rp.sessions.apply(rec)
+	}
+	return nil
+}
+
+// Status returns current replication state
+func (rp *Replica) Status() ReplicaStatus {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+	return rp.status
+}
+
+// NewReplicaServer returns server which answers read-only actions of
+// apptokens from replica's local storage and rejects all others with
+// ErrReadOnly. GET /status returns ReplicaStatus as JSON with status
+// 503 Service Unavailable while replica is not healthy.
+// Replica has to be started separately.
+func NewReplicaServer(rp *Replica, ip, port string, apptokens []string, opts ...ServerOption) (*http.Server, error) {
+	var cfg serverConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	st := &readOnlyStorage{rp.local, rp}
+	authopts := append([]basicauth.Option{basicauth.WithTokenKeeper(rp.sessions)}, cfg.authopts...)
+	logmgr, _ := basicauth.NewLoginManager(st, sessionDuration, authopts...)
+	var lh apihandler
+	lh.lm = &replicaLogin{logmgr}
+	lh.allowed = replicaActions
+	lh.apptokens = make(map[string]bool)
+	for _, tok := range apptokens {
+		lh.apptokens[tok] = true
+	}
+	router := &realmRouter{realms: map[string]*apihandler{"": &lh}}
+	return &http.Server{Addr: ip + ":" + port, Handler: &replicaHandler{router, rp}}, nil
+}
+
+type replicaHandler struct {
+	api *realmRouter
+	rp  *Replica
+}
+
+func (h *replicaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && r.URL.Path == "/status" {
+		status := h.rp.Status()
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	h.api.ServeHTTP(w, r)
+}
+
+// readOnlyStorage rejects Put and Del. Upd is only called by read actions
+// for bookkeeping, such as counting failed logins for lockout, so it is
+// forwarded to primary and the change is synced back right away.
+type readOnlyStorage struct {
+	basicauth.UserAccountStorage
+	rp *Replica
+}
+
+func (ro *readOnlyStorage) Get(username string) (basicauth.Account, error) {
+	return ro.rp.get(username)
+}
+
+func (ro *readOnlyStorage) Put(basicauth.Account) error { return ErrReadOnly }
+func (ro *readOnlyStorage) Del(string) error            { return ErrReadOnly }
+
+func (ro *readOnlyStorage) Upd(account basicauth.Account) error {
+	if err := ro.rp.remote.Upd(account); err != nil {
+		return err
+	}
+	if err := ro.rp.Sync(); err != nil {
+		log.Printf("replica: sync failed: %v", err)
+	}
+	return nil
+}
+
+// replicaLogin checks session tokens against hashes kept by replicaSessions
+type replicaLogin struct {
+	basicauth.LoginInterface
+}
+
+func (rl *replicaLogin) CheckUserLoggedIn(username, token string) error {
+	return rl.LoginInterface.CheckUserLoggedIn(username, storage.HashToken(token))
+}
+
+func (rl *replicaLogin) WithContext(ctx context.Context) basicauth.LoginInterface {
+	return &replicaLogin{basicauth.LoginWithContext(ctx, rl.LoginInterface)}
+}
+
+// replicaSessions holds sessions replicated from primary. GetUserToken
+// returns storage.HashToken of the session token.
+// It implements basicauth.TokenKeeper but can not issue tokens.
+type replicaSessions struct {
+	mutex  sync.Mutex
+	tokens map[string]storage.JournalRecord
+}
+
+func (rs *replicaSessions) apply(rec storage.JournalRecord) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	if rec.Op == storage.OpLogin {
+		rs.tokens[rec.UserName] = rec
+	} else {
+		delete(rs.tokens, rec.UserName)
+	}
+}
+
+func (rs *replicaSessions) clear() {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.tokens = make(map[string]storage.JournalRecord)
+}
+
+func (rs *replicaSessions) NewUserToken(string) (string, error) { return "", ErrReadOnly }
+func (rs *replicaSessions) DelUserToken(string) error           { return ErrReadOnly }
+
+func (rs *replicaSessions) GetUserToken(username string) (string, error) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rec, ok := rs.tokens[username]
+	if !ok || !time.Now().Before(rec.Expires) {
+		return "", basicauth.ErrNoSuchSession
+	}
+	return rec.Token, nil
+}
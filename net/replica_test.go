@@ -0,0 +1,173 @@
+package net
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+func TestReplica(t *testing.T) {
+	fmt.Println("Testing replica...")
+	primaryfile, replicafile := "./test_primary.json", "./test_replica.json"
+	defer os.Remove(primaryfile)
+	defer os.Remove(replicafile)
+	st, _ := storage.NewJSONPasswordKeeper(primaryfile)
+	cl, _ := storage.NewChangeLog(st, 100)
+	server, _ := NewLoginServerWithOptions(cl, "", "", "admintoken", false, []string{"apptoken"}, WithStorageToken("storagetoken"))
+	ps := httptest.NewServer(server.Handler)
+	defer ps.Close()
+	pu, _ := url.Parse(ps.URL)
+	primary, _ := NewRemodeLoginInterface(pu.Hostname(), pu.Port(), "apptoken", false)
+	primary.AddUser("joe", "passwd")
+	token, err := primary.Login("joe", "passwd")
+	if err != nil {
+		fmt.Println("Login on primary returned:", err)
+		t.FailNow()
+	}
+
+	local, _ := storage.NewJSONPasswordKeeper(replicafile)
+	rp, _ := NewReplica(local, pu.Hostname(), pu.Port(), "storagetoken", false, time.Hour)
+	if err := rp.Sync(); err != nil {
+		fmt.Println("Sync() returned:", err)
+		t.FailNow()
+	}
+	replicaserver, _ := NewReplicaServer(rp, "", "", []string{"apptoken"})
+	rs := httptest.NewServer(replicaserver.Handler)
+	defer rs.Close()
+	ru, _ := url.Parse(rs.URL)
+	replica, _ := NewRemodeLoginInterface(ru.Hostname(), ru.Port(), "apptoken", false)
+	if err := replica.CheckUserPassword("joe", "passwd"); err != nil {
+		fmt.Println("CheckUserPassword on replica returned:", err)
+		t.Fail()
+	}
+	if err := replica.CheckUserLoggedIn("joe", token); err != nil {
+		fmt.Println("CheckUserLoggedIn on replica returned:", err)
+		t.Fail()
+	}
+	if err := replica.AddUser("ann", "passwd"); err == nil {
+		fmt.Println("replica accepted write")
+		t.Fail()
+	}
+
+	primary.ChangeUserPassword("joe", "passwd", "newpasswd")
+	primary.Logout("joe")
+	rp.Sync()
+	if err := replica.CheckUserPassword("joe", "newpasswd"); err != nil {
+		fmt.Println("password change was not replicated:", err)
+		t.Fail()
+	}
+	if err := replica.CheckUserLoggedIn("joe", token); err == nil {
+		fmt.Println("logout was not replicated")
+		t.Fail()
+	}
+	replica.CheckUserPassword("joe", "wrong")
+	if account, _ := st.Get("joe"); account.FailedLoginAttempts != 1 {
+		fmt.Println("failed login on replica was not counted on primary:", account.FailedLoginAttempts)
+		t.Fail()
+	}
+	resp, err := http.Get(rs.URL + "/status")
+	if err != nil {
+		fmt.Println("GET /status failed:", err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	var status ReplicaStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	if !status.Healthy || status.Lag != 0 || status.AppliedSeq == 0 || status.AppliedSeq != status.PrimarySeq || status.LastSync.IsZero() {
+		fmt.Printf("unexpected status: %+v\n", status)
+		t.Fail()
+	}
+}
+
+// failingStorage fails Put after puts successful calls
+type failingStorage struct {
+	basicauth.UserAccountStorage
+	puts int
+}
+
+func (fs *failingStorage) Put(account basicauth.Account) error {
+	if fs.puts == 0 {
+		return errors.New("disk full")
+	}
+	fs.puts--
+	return fs.UserAccountStorage.Put(account)
+}
+
+func (fs *failingStorage) List(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	return fs.UserAccountStorage.(basicauth.Lister).List(q)
+}
+
+func TestReplicaSnapshotFailure(t *testing.T) {
+	fmt.Println("Testing replica with failing snapshot load...")
+	primaryfile, replicafile := "./test_primary_fail.json", "./test_replica_fail.json"
+	defer os.Remove(primaryfile)
+	defer os.Remove(replicafile)
+	st, _ := storage.NewJSONPasswordKeeper(primaryfile)
+	cl, _ := storage.NewChangeLog(st, 100)
+	server, _ := NewLoginServerWithOptions(cl, "", "", "admintoken", false, []string{"apptoken"}, WithStorageToken("storagetoken"))
+	ps := httptest.NewServer(server.Handler)
+	defer ps.Close()
+	pu, _ := url.Parse(ps.URL)
+	primary, _ := NewRemodeLoginInterface(pu.Hostname(), pu.Port(), "apptoken", false)
+	primary.AddUser("ann", "passwd")
+	primary.AddUser("joe", "passwd")
+
+	jk, _ := storage.NewJSONPasswordKeeper(replicafile)
+	local := &failingStorage{jk, 1}
+	rp, _ := NewReplica(local, pu.Hostname(), pu.Port(), "storagetoken", false, time.Hour)
+	replicaserver, _ := NewReplicaServer(rp, "", "", []string{"apptoken"})
+	rs := httptest.NewServer(replicaserver.Handler)
+	defer rs.Close()
+	ru, _ := url.Parse(rs.URL)
+	replica, _ := NewRemodeLoginInterface(ru.Hostname(), ru.Port(), "apptoken", false)
+	getStatus := func() (int, ReplicaStatus) {
+		var status ReplicaStatus
+		resp, err := http.Get(rs.URL + "/status")
+		if err != nil {
+			return 0, status
+		}
+		defer resp.Body.Close()
+		json.NewDecoder(resp.Body).Decode(&status)
+		return resp.StatusCode, status
+	}
+	if code, status := getStatus(); code != http.StatusServiceUnavailable || status.Healthy {
+		fmt.Println("replica is healthy before first sync:", code, status.Healthy)
+		t.Fail()
+	}
+	if err := rp.Sync(); err == nil {
+		fmt.Println("Sync() with failing local storage returned no error")
+		t.Fail()
+	}
+	for _, name := range []string{"ann", "joe"} {
+		if err := replica.CheckUserPassword(name, "passwd"); err != nil {
+			fmt.Println("CheckUserPassword during failed snapshot load returned:", name, err)
+			t.Fail()
+		}
+	}
+	if code, status := getStatus(); code != http.StatusServiceUnavailable || status.Healthy {
+		fmt.Println("replica is healthy after failed snapshot load:", code, status.Healthy)
+		t.Fail()
+	}
+	local.puts = -1
+	if err := rp.Sync(); err != nil {
+		fmt.Println("Sync() returned:", err)
+		t.Fail()
+	}
+	if code, status := getStatus(); code != http.StatusOK || !status.Healthy {
+		fmt.Println("replica is not healthy after snapshot load:", code, status.Healthy)
+		t.Fail()
+	}
+	if account, err := jk.Get("joe"); err != nil || account.PasswordHash == "" {
+		fmt.Println("snapshot was not loaded into local storage:", err)
+		t.Fail()
+	}
+}
@@ -2,31 +2,53 @@ package net
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+	"github.com/dmfed/basicauth/webhook"
 )
 
 // Request represents request to auth server
 type Request struct {
-	ID          string             `json:",omitempty"`
-	Action      string             `json:",omitempty"`
-	Token       string             `json:",omitempty"`
-	UserName    string             `json:",omitempty"`
-	Password    string             `json:",omitempty"`
-	NewPassword string             `json:",omitempty"`
-	UserInfo    basicauth.UserInfo `json:",omitempty"`
-	Account     basicauth.Account  `json:",omitempty"`
+	ID          string              `json:",omitempty"`
+	Action      string              `json:",omitempty"`
+	Realm       string              `json:",omitempty"`
+	Token       string              `json:",omitempty"`
+	UserName    string              `json:",omitempty"`
+	Password    string              `json:",omitempty"`
+	NewPassword string              `json:",omitempty"`
+	Email       string              `json:",omitempty"`
+	Code        string              `json:",omitempty"`
+	Name        string              `json:",omitempty"`
+	KeyID       string              `json:",omitempty"`
+	Scopes      []string            `json:",omitempty"`
+	Expires     time.Time           `json:",omitempty"`
+	Query       basicauth.ListQuery `json:",omitempty"`
+	Seq         uint64              `json:",omitempty"`
+	DeliveryID  string              `json:",omitempty"`
+	UserInfo    basicauth.UserInfo  `json:",omitempty"`
+	Account     basicauth.Account   `json:",omitempty"`
 }
 
 // Response represents response of auth server
 type Response struct {
-	ID       string             `json:",omitempty"`
-	OK       bool               `json:",omitempty"`
-	Error    string             `json:",omitempty"`
-	Message  string             `json:",omitempty"`
-	Token    string             `json:",omitempty"`
-	UserInfo basicauth.UserInfo `json:",omitempty"`
-	Account  basicauth.Account  `json:",omitempty"`
+	ID          string              `json:",omitempty"`
+	OK          bool                `json:",omitempty"`
+	Error       string              `json:",omitempty"`
+	Code        ErrorCode           `json:",omitempty"`
+	Message     string              `json:",omitempty"`
+	Token       string              `json:",omitempty"`
+	Codes       []string            `json:",omitempty"`
+	Count       int                 `json:",omitempty"`
+	APIKey      basicauth.APIKey    `json:",omitempty"`
+	APIKeys     []basicauth.APIKey  `json:",omitempty"`
+	Accounts    []basicauth.Account `json:",omitempty"`
+	Cursor      string              `json:",omitempty"`
+	Changes     storage.ChangeBatch `json:",omitempty"`
+	DeadLetters []webhook.Delivery  `json:",omitempty"`
+	UserInfo    basicauth.UserInfo  `json:",omitempty"`
+	Account     basicauth.Account   `json:",omitempty"`
 }
 
 // Message type is a basic transfer unit for Requests and Responses
@@ -2,6 +2,7 @@ package net
 
 import (
 	"log"
+	"reflect"
 	"testing"
 )
 
@@ -31,7 +32,7 @@ func TestMessageFromBytes(t *testing.T) {
 		log.Println(err)
 		t.Fail()
 	}
-	if m != other {
+	if !reflect.DeepEqual(m, other) {
 		t.Fail()
 	}
 }
@@ -0,0 +1,71 @@
+package net
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+	"github.com/dmfed/basicauth/webhook"
+)
+
+func TestWebhooks(t *testing.T) {
+	fmt.Println("Testing server webhooks...")
+	filename, realmfile, outbox := "./test_webhooks.json", "./test_webhooks_a.json", "./test_webhooks_outbox.json"
+	defer os.Remove(filename)
+	defer os.Remove(realmfile)
+	defer os.Remove(outbox)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	d, _ := webhook.OpenDispatcher(outbox, []webhook.Endpoint{{URL: down.URL, Secret: "secret", Events: []basicauth.EventType{basicauth.EventUserDeleted}}},
+		webhook.WithBackoff(time.Millisecond, time.Millisecond), webhook.WithMaxAttempts(1))
+	defer d.Close()
+	st, _ := storage.NewJSONPasswordKeeper(filename)
+	stA, _ := storage.NewJSONPasswordKeeper(realmfile)
+	server, _ := NewLoginServerWithOptions(st, "", "", "admintoken", false, []string{"apptoken"}, WithWebhooks(d),
+		WithRealm(Realm{Name: "a", Storage: stA, AppTokens: []string{"tokenA"}}))
+	ts := httptest.NewServer(server.Handler)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	app, _ := NewRemodeLoginInterface(u.Hostname(), u.Port(), "apptoken", false)
+	admin, _ := NewRemoteAdminInterface(u.Hostname(), u.Port(), "admintoken", false)
+	aa := admin.(*AuthAdmin)
+	app.AddUser("joe", "passwd")
+	app.DelUser("joe", "passwd")
+	var dead []webhook.Delivery
+	for i := 0; i < 500 && len(dead) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		dead, _ = aa.AdminListDeadLetters()
+	}
+	if len(dead) != 1 || dead[0].Event.Type != basicauth.EventUserDeleted || dead[0].Event.UserName != "joe" || dead[0].Event.Realm != "" {
+		fmt.Println("AdminListDeadLetters returned:", dead)
+		t.FailNow()
+	}
+	appA, _ := NewRemoteRealmLoginInterface(u.Hostname(), u.Port(), "a", "tokenA", false)
+	appA.AddUser("ann", "passwd")
+	appA.DelUser("ann", "passwd")
+	for i := 0; i < 500 && len(dead) == 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+		dead, _ = aa.AdminListDeadLetters()
+	}
+	if len(dead) != 2 || dead[1].Event.UserName != "ann" || dead[1].Event.Realm != "a" {
+		fmt.Println("event of realm a:", dead)
+		t.Fail()
+	}
+	if err := aa.AdminDiscardDeadLetter(dead[0].ID); err != nil {
+		fmt.Println("AdminDiscardDeadLetter returned:", err)
+		t.Fail()
+	}
+	if err := aa.AdminRetryDeadLetter(dead[0].ID); err == nil {
+		fmt.Println("AdminRetryDeadLetter of discarded letter returned nil")
+		t.Fail()
+	}
+}
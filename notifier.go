@@ -0,0 +1,62 @@
+package basicauth
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers messages (such as verification codes) to the
+// contact address of a user. Implement it to send email, SMS etc.
+type Notifier interface {
+	Notify(address, subject, message string) error
+}
+
+type writerNotifier struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// NewWriterNotifier returns Notifier which writes messages to w.
+// NewWriterNotifier(os.Stdout) is handy for local development.
+func NewWriterNotifier(w io.Writer) Notifier {
+	return &writerNotifier{w: w}
+}
+
+func (n *writerNotifier) Notify(address, subject, message string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	_, err := fmt.Fprintf(n.w, "%v\nTo: %v\nSubject: %v\n\n%v\n\n", time.Now().Format(time.RFC3339), address, subject, message)
+	return err
+}
+
+type fileNotifier struct {
+	filename string
+	mutex    sync.Mutex
+}
+
+// NewFileNotifier returns Notifier which appends messages to file filename.
+// The file is created if it does not exist.
+func NewFileNotifier(filename string) (Notifier, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("error: empty filename provided")
+	}
+	return &fileNotifier{filename: filename}, nil
+}
+
+func (n *fileNotifier) Notify(address, subject, message string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	f, err := os.OpenFile(n.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	wn := writerNotifier{w: f}
+	if err := wn.Notify(address, subject, message); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
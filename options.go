@@ -0,0 +1,120 @@
+package basicauth
+
+import (
+	"context"
+	"time"
+)
+
+// Option configures optional behaviour of AppInterface, AdminInterface
+// and LoginInterface. Options are passed to NewAppInterface,
+// NewAdminInterface and NewLoginManager.
+type Option func(*options)
+
+type options struct {
+	notifier             Notifier
+	requireVerifiedEmail bool
+	totpIssuer           string
+	now                  func() time.Time
+	usernamePolicy       *UsernamePolicy
+	hasher               PasswordHasher
+	tokens               TokenKeeper
+	events               EventSink
+	lockout              int
+	// ctx is set on interfaces bound with WithContext
+	ctx context.Context
+}
+
+func newOptions(opts []Option) options {
+	o := options{totpIssuer: "basicauth", now: time.Now}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&o)
+		}
+	}
+	return o
+}
+
+// WithNotifier sets Notifier used to deliver verification codes to users.
+func WithNotifier(n Notifier) Option {
+	return func(o *options) {
+		o.notifier = n
+	}
+}
+
+// WithRequireVerifiedEmail makes CheckUserPassword (and therefore Login)
+// refuse users who have not confirmed their email address yet.
+func WithRequireVerifiedEmail(require bool) Option {
+	return func(o *options) {
+		o.requireVerifiedEmail = require
+	}
+}
+
+// WithTOTPIssuer sets issuer name put into otpauth:// URIs returned by EnrollTOTP.
+// Authenticator apps display it next to username.
+func WithTOTPIssuer(issuer string) Option {
+	return func(o *options) {
+		o.totpIssuer = issuer
+	}
+}
+
+// WithClock replaces time.Now as the source of current time. It is intended
+// for tests of time dependent features such as TOTP.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		if now != nil {
+			o.now = now
+		}
+	}
+}
+
+// WithUsernamePolicy makes interfaces normalize and validate every username
+// with policy. Rejected usernames produce *UsernameError.
+func WithUsernamePolicy(policy *UsernamePolicy) Option {
+	return func(o *options) {
+		o.usernamePolicy = policy
+	}
+}
+
+// WithHasher makes interfaces use h instead of package default
+// PasswordHasher (see RegisterHasher).
+func WithHasher(h PasswordHasher) Option {
+	return func(o *options) {
+		o.hasher = h
+	}
+}
+
+// passwordHasher returns configured PasswordHasher or package default
+func (o options) passwordHasher() PasswordHasher {
+	if o.hasher != nil {
+		return o.hasher
+	}
+	return globalHasher
+}
+
+// WithTokenKeeper makes LoginInterface keep session tokens in tk
+// instead of in-memory TokenKeeper created by NewLoginManager.
+func WithTokenKeeper(tk TokenKeeper) Option {
+	return func(o *options) {
+		o.tokens = tk
+	}
+}
+
+// WithEventSink makes interfaces report account and session events to sink.
+func WithEventSink(sink EventSink) Option {
+	return func(o *options) {
+		o.events = sink
+	}
+}
+
+// WithLockout locks account after maxFailed consecutive failed password or
+// one-time code checks and emits EventAccountLocked. Locked accounts get
+// ErrAccountLocked until FailedLoginAttempts is reset, either by successful
+// login of the user before the limit is reached or by administrator setting
+// FailedLoginAttempts to zero with AdminUpdAccount. Users with two-factor
+// authentication enabled have the counter reset only after one-time code
+// checks out. Lockout does not change Disabled.
+func WithLockout(maxFailed int) Option {
+	return func(o *options) {
+		o.lockout = maxFailed
+	}
+}
@@ -0,0 +1,132 @@
+package basicauth
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+const (
+	recoveryCodesCount = 10
+	recoveryCodeSize   = 10 // characters excluding dash
+)
+
+// RecoveryCode is a single-use code which can be given instead of
+// one-time TOTP code if user has lost access to authenticator app.
+// Only the hash of the code is stored.
+type RecoveryCode struct {
+	Hash   string
+	Used   bool      `json:",omitempty"`
+	UsedAt time.Time `json:",omitempty"`
+}
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, recoveryCodeSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := recoveryEncoding.EncodeToString(b)[:recoveryCodeSize]
+	return s[:recoveryCodeSize/2] + "-" + s[recoveryCodeSize/2:], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+}
+
+// GenerateRecoveryCodes replaces user's recovery codes with a new set and
+// returns the codes in plain text. This is the only time the codes are
+// available, only their hashes are stored.
+func (app *appinterface) GenerateRecoveryCodes(username, password string) (codes []string, err error) {
+	err = retryOnConflict(func() error {
+		codes, err = app.generateRecoveryCodes(username, password)
+		return err
+	})
+	return codes, err
+}
+
+func (app *appinterface) generateRecoveryCodes(username, password string) ([]string, error) {
+	account, err := app.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return nil, ErrInvalidPassword
+	}
+	if !account.TOTPConfirmed {
+		return nil, ErrTOTPNotEnabled
+	}
+	codes := make([]string, recoveryCodesCount)
+	stored := make([]RecoveryCode, recoveryCodesCount)
+	for i := range codes {
+		if codes[i], err = generateRecoveryCode(); err != nil {
+			return nil, err
+		}
+		if stored[i].Hash, err = app.HashPassword(codes[i]); err != nil {
+			return nil, err
+		}
+	}
+	account.RecoveryCodes = stored
+	account.DateChanged = app.opts.now()
+	if err := app.Upd(account); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RecoveryCodesLeft returns number of unused recovery codes of user.
+func (app *appinterface) RecoveryCodesLeft(username, password string) (int, error) {
+	account, err := app.Get(username)
+	if err != nil {
+		return 0, err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return 0, ErrInvalidPassword
+	}
+	return countRecoveryCodesLeft(account), nil
+}
+
+func countRecoveryCodesLeft(account Account) int {
+	n := 0
+	for _, rc := range account.RecoveryCodes {
+		if !rc.Used {
+			n++
+		}
+	}
+	return n
+}
+
+// useRecoveryCode marks matching unused recovery code as used. It returns
+// false if code does not match any of unused codes.
+func (app *appinterface) useRecoveryCode(account *Account, code string) bool {
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeSize+1 {
+		return false
+	}
+	for i, rc := range account.RecoveryCodes {
+		if rc.Used {
+			continue
+		}
+		if app.CompareUserPasswordWithHash(rc.Hash, code) == nil {
+			// copy the slice so that the code is not consumed in
+			// storage's memory if following Upd fails
+			codes := append([]RecoveryCode(nil), account.RecoveryCodes...)
+			codes[i].Used = true
+			codes[i].UsedAt = app.opts.now()
+			account.RecoveryCodes = codes
+			return true
+		}
+	}
+	return false
+}
+
+// AdminRecoveryCodesLeft returns number of unused recovery codes of user.
+func (ad *admininterface) AdminRecoveryCodesLeft(username string) (int, error) {
+	account, err := ad.Get(username)
+	if err != nil {
+		return 0, err
+	}
+	return countRecoveryCodesLeft(account), nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// renameFile is os.Rename. It is a variable so that tests
+// can simulate crash in the middle of writing a file.
+var renameFile = os.Rename
+
+// WriteFileAtomic writes data to a temporary file in the same directory
+// as filename, syncs it to disk and renames it over filename. Either old
+// or new contents of filename are left on disk if writing fails at any point.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(filename)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = renameFile(tmp.Name(), filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes rename of a file in directory dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// backupFile replaces backup with current contents of filename.
+// It does nothing if filename does not exist.
+func backupFile(filename, backup string) error {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	os.Remove(backup)
+	// hard link keeps old contents after filename is
+	// replaced by rename and costs nothing to create
+	if err := os.Link(filename, backup); err == nil {
+		return nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(backup, data, 0600)
+}
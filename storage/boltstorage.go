@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketAccounts = []byte("accounts")
+	bucketSessions = []byte("sessions")
+	bucketAPIKeys  = []byte("apikeys")
+)
+
+// BoltStorage keeps accounts in embedded bbolt database with one bucket
+// per entity type: accounts, sessions and API key index (key ID -> username).
+// Every change is a single transaction.
+// It implements basicauth.UserAccountStorage
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// OpenBoltStorage opens (or creates) bbolt database in file filename.
+func OpenBoltStorage(filename string) (basicauth.UserAccountStorage, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("empty filename provided. will do nothing")
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketAccounts, bucketSessions, bucketAPIKeys} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db}, nil
+}
+
+func getAccount(tx *bolt.Tx, username string) (basicauth.Account, error) {
+	var account basicauth.Account
+	data := tx.Bucket(bucketAccounts).Get([]byte(username))
+	if data == nil {
+		return account, ErrNoSuchUser
+	}
+	err := json.Unmarshal(data, &account)
+	return account, err
+}
+
+// putAccount stores account and updates API key index
+func putAccount(tx *bolt.Tx, account basicauth.Account, old *basicauth.Account) error {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketAccounts).Put([]byte(account.UserName), data); err != nil {
+		return err
+	}
+	keys := tx.Bucket(bucketAPIKeys)
+	if old != nil {
+		for _, k := range old.APIKeys {
+			if err := keys.Delete([]byte(k.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, k := range account.APIKeys {
+		if err := keys.Put([]byte(k.ID), []byte(account.UserName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns account if username is valid
+func (bs *BoltStorage) Get(username string) (account basicauth.Account, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		account, err = getAccount(tx, username)
+		return err
+	})
+	return
+}
+
+// Put adds account to storage
+func (bs *BoltStorage) Put(account basicauth.Account) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketAccounts).Get([]byte(account.UserName)) != nil {
+			return ErrUserExists
+		}
+		return putAccount(tx, account, nil)
+	})
+}
+
+// Upd replaces existing account with supplied one if their versions match
+func (bs *BoltStorage) Upd(account basicauth.Account) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		old, err := getAccount(tx, account.UserName)
+		if err != nil {
+			return err
+		}
+		if old.Version != account.Version {
+			return basicauth.ErrConflict
+		}
+		account.Version++
+		return putAccount(tx, account, &old)
+	})
+}
+
+// Del deletes account if username is valid
+func (bs *BoltStorage) Del(username string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		old, err := getAccount(tx, username)
+		if err != nil {
+			return err
+		}
+		for _, k := range old.APIKeys {
+			if err := tx.Bucket(bucketAPIKeys).Delete([]byte(k.ID)); err != nil {
+				return err
+			}
+		}
+		tx.Bucket(bucketSessions).Delete([]byte(username))
+		return tx.Bucket(bucketAccounts).Delete([]byte(username))
+	})
+}
+
+// List implements basicauth.Lister
+func (bs *BoltStorage) List(q basicauth.ListQuery) (accounts []basicauth.Account, next string, err error) {
+	limit := q.PageSize()
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketAccounts).Cursor()
+		start := []byte(q.Prefix)
+		if q.Cursor >= q.Prefix {
+			start = []byte(q.Cursor + "\x00")
+		}
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, []byte(q.Prefix)); k, v = c.Next() {
+			var account basicauth.Account
+			if err := json.Unmarshal(v, &account); err != nil {
+				return err
+			}
+			if !q.Match(account) {
+				continue
+			}
+			if len(accounts) == limit {
+				next = accounts[limit-1].UserName
+				return nil
+			}
+			accounts = append(accounts, account)
+		}
+		return nil
+	})
+	return
+}
+
+// LookupAPIKey returns name of the user owning API key with specified ID.
+func (bs *BoltStorage) LookupAPIKey(id string) (username string, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		name := tx.Bucket(bucketAPIKeys).Get([]byte(id))
+		if name == nil {
+			return basicauth.ErrNoSuchAPIKey
+		}
+		username = string(name)
+		return nil
+	})
+	return
+}
+
+// Backup writes consistent copy of the database to w while
+// storage stays available for reads and writes.
+func (bs *BoltStorage) Backup(w io.Writer) (n int64, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return
+}
+
+// Close closes underlying database
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
+
+// TokenKeeper returns basicauth.TokenKeeper which keeps session tokens in
+// the sessions bucket so that they survive restarts. Sessions expire
+// after sessionDuration.
+func (bs *BoltStorage) TokenKeeper(sessionDuration time.Duration) basicauth.TokenKeeper {
+	return &boltTokenKeeper{bs.db, sessionDuration}
+}
+
+type boltSession struct {
+	Token   string
+	Expires time.Time
+}
+
+type boltTokenKeeper struct {
+	db          *bolt.DB
+	maxduration time.Duration
+}
+
+func (tk *boltTokenKeeper) NewUserToken(username string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	session := boltSession{Token: hex.EncodeToString(b), Expires: time.Now().Add(tk.maxduration)}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	err = tk.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).Put([]byte(username), data)
+	})
+	return session.Token, err
+}
+
+func (tk *boltTokenKeeper) GetUserToken(username string) (token string, err error) {
+	err = tk.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketSessions).Get([]byte(username))
+		if data == nil {
+			return basicauth.ErrNoSuchSession
+		}
+		var session boltSession
+		if err := json.Unmarshal(data, &session); err != nil {
+			return err
+		}
+		if time.Now().After(session.Expires) {
+			return basicauth.ErrNoSuchSession
+		}
+		token = session.Token
+		return nil
+	})
+	return
+}
+
+func (tk *boltTokenKeeper) DelUserToken(username string) error {
+	if _, err := tk.GetUserToken(username); err != nil {
+		return err
+	}
+	return tk.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).Delete([]byte(username))
+	})
+}
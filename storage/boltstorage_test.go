@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+func Test_BoltStorage(t *testing.T) {
+	fmt.Println("Testing BoltStorage")
+	filename, backupname := "test_bolt.db", "test_bolt_backup.db"
+	defer os.Remove(filename)
+	defer os.Remove(backupname)
+	st, err := OpenBoltStorage(filename)
+	if err != nil {
+		fmt.Println("OpenBoltStorage failed with error:", err)
+		t.FailNow()
+	}
+	bs := st.(*BoltStorage)
+	account := testUserInfo
+	account.APIKeys = []basicauth.APIKey{{ID: "key1"}}
+	if err := bs.Put(account); err != nil {
+		fmt.Println("Put() failed with error:", err)
+		t.Fail()
+	}
+	if err := bs.Put(account); err != ErrUserExists {
+		fmt.Println("Put() with existing user returned:", err)
+		t.Fail()
+	}
+	if err := bs.Upd(basicauth.Account{UserName: testInvalidUser}); err != ErrNoSuchUser {
+		fmt.Println("Upd() of non-existing user returned:", err)
+		t.Fail()
+	}
+	if name, err := bs.LookupAPIKey("key1"); err != nil || name != testUser {
+		fmt.Println("LookupAPIKey() want:", testUser, "got:", name, err)
+		t.Fail()
+	}
+	account.PasswordHash = "newhash"
+	account.APIKeys = nil
+	bs.Upd(account)
+	if _, err := bs.LookupAPIKey("key1"); err == nil {
+		fmt.Println("index of removed API key was not updated")
+		t.Fail()
+	}
+	tk := bs.TokenKeeper(time.Hour)
+	token, _ := tk.NewUserToken(testUser)
+	if got, err := tk.GetUserToken(testUser); err != nil || got != token {
+		fmt.Println("GetUserToken() want:", token, "got:", got, err)
+		t.Fail()
+	}
+	f, _ := os.Create(backupname)
+	if _, err := bs.Backup(f); err != nil {
+		fmt.Println("Backup() failed with error:", err)
+		t.Fail()
+	}
+	f.Close()
+	bs.Del(testUser)
+	if _, err := tk.GetUserToken(testUser); err == nil {
+		fmt.Println("session of deleted user still exists")
+		t.Fail()
+	}
+	bs.Close()
+	restored, err := OpenBoltStorage(backupname)
+	if err != nil {
+		fmt.Println("could not open backup:", err)
+		t.FailNow()
+	}
+	defer restored.Close()
+	if acc, err := restored.Get(testUser); err != nil || acc.PasswordHash != "newhash" {
+		fmt.Println("backup does not contain user:", acc, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+// ChangeSource is implemented by storages which can report changes
+// made to accounts. Subscribe registers fn to be called with username
+// of every changed account, or with empty username when any account may
+// have changed. fn is called synchronously and must not call the storage.
+// The returned function cancels subscription.
+type ChangeSource interface {
+	Subscribe(fn func(username string)) (cancel func())
+}
+
+// CacheStats holds counters of CachedStorage
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Size      int
+}
+
+// HitRatio returns share of Get calls served from cache
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type cacheEntry struct {
+	account basicauth.Account
+	expires time.Time
+}
+
+// CachedStorage keeps recently read accounts in memory in front of slower
+// storage such as SQL database or remote server. Writes go straight to the
+// underlying storage and drop the cached copy. Changes made to the underlying
+// storage by other writers are only seen after TTL expires, unless the
+// storage implements ChangeSource and SubscribeChanges is used.
+// It implements basicauth.UserAccountStorage
+type CachedStorage struct {
+	st        basicauth.UserAccountStorage
+	size      int
+	ttl       time.Duration
+	noHashes  bool
+	subscribe bool
+	cancel    func()
+	now       func() time.Time
+
+	mutex   sync.Mutex
+	lru     *list.List // front is most recently used, values are usernames
+	entries map[string]*list.Element
+	values  map[string]cacheEntry
+	stats   CacheStats
+	// gen is incremented on every invalidation so that Get does
+	// not cache an account read before concurrent write
+	gen uint64
+}
+
+// CacheOption configures optional behaviour of CachedStorage
+type CacheOption func(*CachedStorage)
+
+// WithoutPasswordHashes keeps password hashes out of memory of the cache.
+// Get still returns complete accounts: on cache hit the password hash is read
+// from the underlying storage, so every Get reaches the underlying storage.
+// Cached account is replaced if the underlying storage holds newer version.
+func WithoutPasswordHashes() CacheOption {
+	return func(cs *CachedStorage) {
+		cs.noHashes = true
+	}
+}
+
+// SubscribeChanges makes CachedStorage drop accounts changed in the
+// underlying storage by other writers. The storage must implement ChangeSource.
+func SubscribeChanges() CacheOption {
+	return func(cs *CachedStorage) {
+		cs.subscribe = true
+	}
+}
+
+// NewCachedStorage returns storage which caches up to size accounts of st
+// for ttl. Least recently used accounts are evicted first. Zero ttl means
+// accounts do not expire.
+func NewCachedStorage(st basicauth.UserAccountStorage, size int, ttl time.Duration, opts ...CacheOption) (basicauth.UserAccountStorage, error) {
+	if st == nil {
+		return nil, fmt.Errorf("error: storage is nil")
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("error: cache size must be positive")
+	}
+	cs := &CachedStorage{st: st, size: size, ttl: ttl, now: time.Now,
+		lru: list.New(), entries: make(map[string]*list.Element), values: make(map[string]cacheEntry)}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cs)
+		}
+	}
+	if cs.subscribe {
+		src, ok := st.(ChangeSource)
+		if !ok {
+			return nil, fmt.Errorf("error: storage does not report changes")
+		}
+		cs.cancel = src.Subscribe(cs.invalidate)
+	}
+	return cs, nil
+}
+
+// Get returns cached account or reads it from underlying storage
+func (cs *CachedStorage) Get(username string) (basicauth.Account, error) {
+	return cs.GetContext(context.Background(), username)
+}
+
+// GetContext is Get which passes ctx to underlying storage on cache miss
+func (cs *CachedStorage) GetContext(ctx context.Context, username string) (basicauth.Account, error) {
+	cs.mutex.Lock()
+	if e, ok := cs.entries[username]; ok {
+		entry := cs.values[username]
+		if cs.ttl <= 0 || cs.now().Before(entry.expires) {
+			cs.lru.MoveToFront(e)
+			cs.stats.Hits++
+			gen := cs.gen
+			cs.mutex.Unlock()
+			if cs.noHashes {
+				return cs.withPasswordHash(ctx, entry.account, gen)
+			}
+			return CopyAccount(entry.account), nil
+		}
+		cs.remove(username)
+	}
+	cs.stats.Misses++
+	gen := cs.gen
+	cs.mutex.Unlock()
+	account, err := basicauth.StorageWithContext(ctx, cs.st).Get(username)
+	if err != nil {
+		return account, err
+	}
+	cs.add(account, gen)
+	return account, nil
+}
+
+// withPasswordHash returns cached account with password hash read from
+// underlying storage. If the underlying storage has another version
+// of the account, that version is returned and cached.
+func (cs *CachedStorage) withPasswordHash(ctx context.Context, cached basicauth.Account, gen uint64) (basicauth.Account, error) {
+	account, err := basicauth.StorageWithContext(ctx, cs.st).Get(cached.UserName)
+	if err != nil {
+		cs.invalidate(cached.UserName)
+		return account, err
+	}
+	if account.Version != cached.Version {
+		cs.add(account, gen)
+		return account, nil
+	}
+	cached = CopyAccount(cached)
+	cached.PasswordHash = account.PasswordHash
+	return cached, nil
+}
+
+// add caches account unless cache was invalidated since gen
+func (cs *CachedStorage) add(account basicauth.Account, gen uint64) {
+	cached := CopyAccount(account)
+	if cs.noHashes {
+		cached.PasswordHash = ""
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if cs.gen != gen {
+		return
+	}
+	if e, ok := cs.entries[account.UserName]; ok {
+		cs.lru.MoveToFront(e)
+	} else {
+		cs.entries[account.UserName] = cs.lru.PushFront(account.UserName)
+	}
+	cs.values[account.UserName] = cacheEntry{cached, cs.now().Add(cs.ttl)}
+	for cs.lru.Len() > cs.size {
+		cs.remove(cs.lru.Back().Value.(string))
+		cs.stats.Evictions++
+	}
+}
+
+// remove is called with mutex held
+func (cs *CachedStorage) remove(username string) {
+	if e, ok := cs.entries[username]; ok {
+		cs.lru.Remove(e)
+		delete(cs.entries, username)
+		delete(cs.values, username)
+	}
+}
+
+// invalidate drops username from cache. Empty username drops everything.
+func (cs *CachedStorage) invalidate(username string) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.gen++
+	if username != "" {
+		cs.remove(username)
+		return
+	}
+	cs.lru.Init()
+	cs.entries = make(map[string]*list.Element)
+	cs.values = make(map[string]cacheEntry)
+}
+
+// Put adds account to underlying storage
+func (cs *CachedStorage) Put(account basicauth.Account) error {
+	return cs.PutContext(context.Background(), account)
+}
+
+// PutContext is Put which passes ctx to underlying storage
+func (cs *CachedStorage) PutContext(ctx context.Context, account basicauth.Account) error {
+	defer cs.invalidate(account.UserName)
+	return basicauth.StorageWithContext(ctx, cs.st).Put(account)
+}
+
+// Upd updates account in underlying storage
+func (cs *CachedStorage) Upd(account basicauth.Account) error {
+	return cs.UpdContext(context.Background(), account)
+}
+
+// UpdContext is Upd which passes ctx to underlying storage
+func (cs *CachedStorage) UpdContext(ctx context.Context, account basicauth.Account) error {
+	defer cs.invalidate(account.UserName)
+	return basicauth.StorageWithContext(ctx, cs.st).Upd(account)
+}
+
+// Del deletes account from underlying storage
+func (cs *CachedStorage) Del(username string) error {
+	return cs.DelContext(context.Background(), username)
+}
+
+// DelContext is Del which passes ctx to underlying storage
+func (cs *CachedStorage) DelContext(ctx context.Context, username string) error {
+	defer cs.invalidate(username)
+	return basicauth.StorageWithContext(ctx, cs.st).Del(username)
+}
+
+// List passes the call to underlying storage if it implements basicauth.Lister
+func (cs *CachedStorage) List(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	return cs.ListContext(context.Background(), q)
+}
+
+// ListContext is List which passes ctx to underlying storage
+func (cs *CachedStorage) ListContext(ctx context.Context, q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	return basicauth.StorageWithContext(ctx, cs.st).(basicauth.Lister).List(q)
+}
+
+// Stats returns current values of cache counters
+func (cs *CachedStorage) Stats() CacheStats {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	stats := cs.stats
+	stats.Size = cs.lru.Len()
+	return stats
+}
+
+// Close cancels subscription to changes and closes underlying storage
+func (cs *CachedStorage) Close() error {
+	if cs.cancel != nil {
+		cs.cancel()
+	}
+	return cs.st.Close()
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+func Test_CachedStorage(t *testing.T) {
+	fmt.Println("Testing CachedStorage")
+	defer os.Remove(testFileName)
+	st, _ := NewJSONPasswordKeeper(testFileName)
+	for _, name := range []string{"one", "two", "three"} {
+		st.Put(basicauth.Account{UserName: name, PasswordHash: "hash"})
+	}
+	cached, err := NewCachedStorage(st, 2, time.Minute, SubscribeChanges())
+	if err != nil {
+		fmt.Println("NewCachedStorage failed with error:", err)
+		t.FailNow()
+	}
+	cs := cached.(*CachedStorage)
+	cs.Get("one")
+	cs.Get("one")
+	cs.Get("two")
+	cs.Get("three") // evicts "one"
+	if got, _ := cs.Get("one"); got.PasswordHash != "hash" {
+		fmt.Println("cached account has wrong password hash:", got.PasswordHash)
+		t.Fail()
+	}
+	if stats := cs.Stats(); stats.Hits != 1 || stats.Misses != 4 || stats.Evictions != 2 || stats.Size != 2 {
+		fmt.Printf("unexpected stats: %+v\n", stats)
+		t.Fail()
+	}
+	// change made directly to the underlying storage
+	account, _ := st.Get("one")
+	account.Disabled = true
+	st.Upd(account)
+	if got, _ := cs.Get("one"); !got.Disabled {
+		fmt.Println("cache was not invalidated by change notification")
+		t.Fail()
+	}
+	// expired entries are read again
+	cs.now = func() time.Time { return time.Now().Add(time.Hour) }
+	misses := cs.Stats().Misses
+	cs.Get("one")
+	if cs.Stats().Misses != misses+1 {
+		fmt.Println("expired entry was served from cache")
+		t.Fail()
+	}
+	cs.Close()
+
+	st, _ = OpenJSONPasswordKeeper(testFileName)
+	cached, _ = NewCachedStorage(st, 10, 0, WithoutPasswordHashes())
+	cs = cached.(*CachedStorage)
+	app, _ := basicauth.NewAppInterface(cached)
+	app.AddUser("joe", "passwd")
+	cs.Get("joe")
+	if cs.values["joe"].account.PasswordHash != "" {
+		fmt.Println("password hash was cached")
+		t.Fail()
+	}
+	if err := app.CheckUserPassword("joe", "passwd"); err != nil {
+		fmt.Println("CheckUserPassword with cache without hashes returned:", err)
+		t.Fail()
+	}
+	account, _ = cs.Get("joe")
+	account.User.Comment = "updated"
+	if err := cs.Upd(account); err != nil {
+		fmt.Println("Upd of account read from cache returned:", err)
+		t.Fail()
+	}
+	if stored, _ := st.Get("joe"); stored.PasswordHash == "" || stored.User.Comment != "updated" {
+		fmt.Println("Upd of account read from cache lost password hash")
+		t.Fail()
+	}
+	// change made directly to the underlying storage is seen on hit
+	cs.Get("joe")
+	account, _ = st.Get("joe")
+	account.Disabled = true
+	st.Upd(account)
+	if got, _ := cs.Get("joe"); !got.Disabled || got.Version != account.Version+1 {
+		fmt.Println("stale cached account was returned")
+		t.Fail()
+	}
+	if stats := cs.Stats(); stats.Hits != 2 {
+		fmt.Printf("unexpected stats: %+v\n", stats)
+		t.Fail()
+	}
+	cs.Close()
+	if _, err := NewCachedStorage(&HtpasswdStorage{}, 10, 0, SubscribeChanges()); err == nil {
+		fmt.Println("subscribing to storage without notifications did not fail")
+		t.Fail()
+	}
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+// Session operations recorded by TokenKeeper of ChangeLog
+const (
+	OpLogin  = "login"
+	OpLogout = "logout"
+)
+
+// ErrChangesTruncated is returned when requested changes are
+// no longer kept and the reader has to start from a snapshot
+var ErrChangesTruncated = errors.New("storage error: requested changes are no longer kept")
+
+// ChangeBatch is a part of change stream returned by ChangeStream
+type ChangeBatch struct {
+	// Epoch identifies the stream. It changes when the stream
+	// is restarted and sequence numbers start over.
+	Epoch string
+	// Seq is sequence number of the last change in the stream
+	Seq     uint64
+	Records []JournalRecord `json:",omitempty"`
+	// Accounts are only set in snapshot
+	Accounts []basicauth.Account `json:",omitempty"`
+}
+
+// ChangeStream is implemented by storages which keep ordered
+// log of changes for replication
+type ChangeStream interface {
+	// Changes returns up to limit records with sequence numbers after after
+	Changes(after uint64, limit int) (ChangeBatch, error)
+	// Snapshot returns all accounts and active sessions as login records.
+	// Seq of the snapshot is the last change it includes.
+	Snapshot() (ChangeBatch, error)
+}
+
+// ChangeLog passes calls to underlying storage and keeps last changes
+// numbered in order they were made. Writes are serialized. Changes are
+// only kept in memory, Epoch of the stream changes on every start.
+// It implements basicauth.UserAccountStorage and ChangeStream
+type ChangeLog struct {
+	st       basicauth.UserAccountStorage
+	epoch    string
+	capacity int
+	mutex    sync.Mutex
+	seq      uint64
+	records  []JournalRecord
+	sessions map[string]JournalRecord // last login records by username
+}
+
+// NewChangeLog returns storage which records changes made to st
+// and keeps capacity last of them. Underlying storage must implement
+// basicauth.Lister for snapshots.
+func NewChangeLog(st basicauth.UserAccountStorage, capacity int) (basicauth.UserAccountStorage, error) {
+	if st == nil {
+		return nil, fmt.Errorf("error: storage is nil")
+	}
+	if capacity <= 0 {
+		return nil, fmt.Errorf("error: capacity must be positive")
+	}
+	epoch := make([]byte, 8)
+	if _, err := rand.Read(epoch); err != nil {
+		return nil, err
+	}
+	return &ChangeLog{st: st, epoch: hex.EncodeToString(epoch), capacity: capacity,
+		sessions: make(map[string]JournalRecord)}, nil
+}
+
+// record is called with mutex held
+func (cl *ChangeLog) record(rec JournalRecord) {
+	cl.seq++
+	rec.Seq = cl.seq
+	rec.Time = time.Now()
+	cl.records = append(cl.records, rec)
+	if len(cl.records) > cl.capacity {
+		cl.records = append(cl.records[:0:0], cl.records[len(cl.records)-cl.capacity:]...)
+	}
+}
+
+// recordAccount records stored state of account after successful write
+func (cl *ChangeLog) recordAccount(op, username string) {
+	account, err := cl.st.Get(username)
+	if err != nil {
+		return
+	}
+	cl.record(JournalRecord{Op: op, UserName: account.UserName, Account: &account})
+}
+
+// Get passes the call to underlying storage
+func (cl *ChangeLog) Get(username string) (basicauth.Account, error) {
+	return cl.st.Get(username)
+}
+
+// Put adds account to underlying storage and records the change
+func (cl *ChangeLog) Put(account basicauth.Account) error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if err := cl.st.Put(account); err != nil {
+		return err
+	}
+	cl.recordAccount(OpPut, account.UserName)
+	return nil
+}
+
+// Upd updates account in underlying storage and records the change
+func (cl *ChangeLog) Upd(account basicauth.Account) error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if err := cl.st.Upd(account); err != nil {
+		return err
+	}
+	cl.recordAccount(OpUpd, account.UserName)
+	return nil
+}
+
+// Del deletes account from underlying storage and records the change
+func (cl *ChangeLog) Del(username string) error {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if err := cl.st.Del(username); err != nil {
+		return err
+	}
+	cl.record(JournalRecord{Op: OpDel, UserName: username})
+	return nil
+}
+
+// List passes the call to underlying storage if it implements basicauth.Lister
+func (cl *ChangeLog) List(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	if l, ok := cl.st.(basicauth.Lister); ok {
+		return l.List(q)
+	}
+	return nil, "", basicauth.ErrNotSupported
+}
+
+// Close closes underlying storage
+func (cl *ChangeLog) Close() error {
+	return cl.st.Close()
+}
+
+// Changes implements ChangeStream
+func (cl *ChangeLog) Changes(after uint64, limit int) (ChangeBatch, error) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	batch := ChangeBatch{Epoch: cl.epoch, Seq: cl.seq}
+	if after > cl.seq || (after < cl.seq && (len(cl.records) == 0 || after+1 < cl.records[0].Seq)) {
+		return batch, ErrChangesTruncated
+	}
+	if after == cl.seq {
+		return batch, nil
+	}
+	start := int(after + 1 - cl.records[0].Seq)
+	end := len(cl.records)
+	if limit > 0 && end-start > limit {
+		end = start + limit
+	}
+	batch.Records = append([]JournalRecord(nil), cl.records[start:end]...)
+	return batch, nil
+}
+
+// Snapshot implements ChangeStream. Writes are blocked while
+// the snapshot is taken.
+func (cl *ChangeLog) Snapshot() (ChangeBatch, error) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	batch := ChangeBatch{Epoch: cl.epoch, Seq: cl.seq}
+	l, ok := cl.st.(basicauth.Lister)
+	if !ok {
+		return batch, basicauth.ErrNotSupported
+	}
+	q := basicauth.ListQuery{Limit: 1000}
+	for {
+		accounts, next, err := l.List(q)
+		if err != nil {
+			return batch, err
+		}
+		batch.Accounts = append(batch.Accounts, accounts...)
+		if next == "" {
+			break
+		}
+		q.Cursor = next
+	}
+	t := time.Now()
+	for username, rec := range cl.sessions {
+		if !t.Before(rec.Expires) {
+			delete(cl.sessions, username)
+			continue
+		}
+		batch.Records = append(batch.Records, rec)
+	}
+	return batch, nil
+}
+
+// HashToken returns hash of session token kept in change stream
+// in place of the token itself
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenKeeper returns basicauth.TokenKeeper which passes calls to tk and
+// records logins and logouts in the change stream, so that replicas can
+// check sessions. Tokens are recorded as HashToken, readers of the stream
+// never see them. duration must be the session duration of tk.
+func (cl *ChangeLog) TokenKeeper(tk basicauth.TokenKeeper, duration time.Duration) basicauth.TokenKeeper {
+	return &sessionLog{tk, cl, duration}
+}
+
+type sessionLog struct {
+	basicauth.TokenKeeper
+	cl       *ChangeLog
+	duration time.Duration
+}
+
+func (sl *sessionLog) NewUserToken(username string) (string, error) {
+	token, err := sl.TokenKeeper.NewUserToken(username)
+	if err != nil {
+		return token, err
+	}
+	sl.cl.mutex.Lock()
+	defer sl.cl.mutex.Unlock()
+	sl.cl.record(JournalRecord{Op: OpLogin, UserName: username, Token: HashToken(token), Expires: time.Now().Add(sl.duration)})
+	sl.cl.sessions[username] = sl.cl.records[len(sl.cl.records)-1]
+	return token, nil
+}
+
+func (sl *sessionLog) DelUserToken(username string) error {
+	if err := sl.TokenKeeper.DelUserToken(username); err != nil {
+		return err
+	}
+	sl.cl.mutex.Lock()
+	defer sl.cl.mutex.Unlock()
+	sl.cl.record(JournalRecord{Op: OpLogout, UserName: username})
+	delete(sl.cl.sessions, username)
+	return nil
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+func Test_ChangeLog(t *testing.T) {
+	fmt.Println("Testing ChangeLog")
+	defer os.Remove(testFileName)
+	st, _ := NewJSONPasswordKeeper(testFileName)
+	logged, err := NewChangeLog(st, 3)
+	if err != nil {
+		fmt.Println("NewChangeLog failed with error:", err)
+		t.FailNow()
+	}
+	cl := logged.(*ChangeLog)
+	cl.Put(basicauth.Account{UserName: "one"})
+	account, _ := cl.Get("one")
+	cl.Upd(account)
+	cl.Upd(account) // conflict is not recorded
+	cl.Del("one")
+	batch, err := cl.Changes(0, 0)
+	if err != nil || batch.Seq != 3 || len(batch.Records) != 3 {
+		fmt.Println("Changes() returned:", batch, err)
+		t.FailNow()
+	}
+	if rec := batch.Records[1]; rec.Op != OpUpd || rec.Seq != 2 || rec.Account.Version != 1 {
+		fmt.Printf("unexpected record: %+v\n", rec)
+		t.Fail()
+	}
+	if batch, _ := cl.Changes(2, 0); len(batch.Records) != 1 || batch.Records[0].Op != OpDel {
+		fmt.Println("Changes() after 2 returned:", batch.Records)
+		t.Fail()
+	}
+	tk, _ := basicauth.NewMemTokenKeeper(time.Hour)
+	sessions := cl.TokenKeeper(tk, time.Hour)
+	token, _ := sessions.NewUserToken("two")
+	cl.Put(basicauth.Account{UserName: "two"})
+	if _, err := cl.Changes(0, 0); err != ErrChangesTruncated {
+		fmt.Println("Changes() of dropped records returned:", err)
+		t.Fail()
+	}
+	snapshot, err := cl.Snapshot()
+	if err != nil || snapshot.Seq != 5 || len(snapshot.Accounts) != 1 || len(snapshot.Records) != 1 || snapshot.Records[0].Token != HashToken(token) {
+		fmt.Println("Snapshot() returned:", snapshot, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	encryptedFormat  = "basicauth-encrypted"
+	encryptedVersion = 1
+	// KeySize is the size of keys accepted by KeyProvider implementations
+	KeySize = 32
+)
+
+var (
+	// ErrEncrypted is returned when encrypted file is opened without KeyProvider
+	ErrEncrypted = errors.New("storage error: file is encrypted and no key provider is configured")
+	// ErrUnknownKey is returned when file is encrypted with a key KeyProvider does not have
+	ErrUnknownKey = errors.New("storage error: unknown encryption key")
+	// ErrDecrypt is returned when file can not be decrypted with the key
+	ErrDecrypt = errors.New("storage error: could not decrypt file")
+)
+
+// Cipher is AEAD used to encrypt storage file
+type Cipher int
+
+const (
+	// AESGCM is AES-256 in GCM mode
+	AESGCM Cipher = iota
+	// XChaCha20Poly1305 is XChaCha20-Poly1305 with 24 byte nonces
+	XChaCha20Poly1305
+)
+
+func (c Cipher) String() string {
+	switch c {
+	case AESGCM:
+		return "AES-256-GCM"
+	case XChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("Cipher(%d)", int(c))
+}
+
+func parseCipher(name string) (Cipher, error) {
+	for _, c := range []Cipher{AESGCM, XChaCha20Poly1305} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("storage error: unknown cipher %q", name)
+}
+
+func (c Cipher) aead(key []byte) (cipher.AEAD, error) {
+	switch c {
+	case AESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case XChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, fmt.Errorf("storage error: unknown cipher %v", c)
+}
+
+// KeyProvider supplies master keys for encryption at rest. Files are
+// always written with the current key, other keys are only used to read
+// files written before the key was rotated.
+type KeyProvider interface {
+	// CurrentKey returns ID and value of the key used for writing
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns key with ID or ErrUnknownKey
+	Key(id string) ([]byte, error)
+}
+
+// KeyID returns ID of key. It is a short fingerprint which
+// identifies the key without revealing it.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// keyRing is KeyProvider holding keys in memory. First key is current.
+type keyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing returns KeyProvider which encrypts with current and
+// decrypts with current and any of old keys. Keys must be KeySize bytes.
+func NewKeyRing(current []byte, old ...[]byte) (KeyProvider, error) {
+	kr := &keyRing{keys: make(map[string][]byte)}
+	for i, key := range append([][]byte{current}, old...) {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("storage error: key must be %v bytes long, got %v", KeySize, len(key))
+		}
+		id := KeyID(key)
+		if i == 0 {
+			kr.current = id
+		}
+		kr.keys[id] = key
+	}
+	return kr, nil
+}
+
+// NewEnvKeyProvider reads base64 encoded keys from environment
+// variables. Key from the first variable is current.
+func NewEnvKeyProvider(current string, old ...string) (KeyProvider, error) {
+	return loadKeys(func(name string) (string, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("storage error: environment variable %v is not set", name)
+		}
+		return value, nil
+	}, current, old)
+}
+
+// NewFileKeyProvider reads base64 encoded keys from files.
+// Key from the first file is current.
+func NewFileKeyProvider(current string, old ...string) (KeyProvider, error) {
+	return loadKeys(func(name string) (string, error) {
+		data, err := os.ReadFile(name)
+		return string(data), err
+	}, current, old)
+}
+
+func loadKeys(read func(string) (string, error), current string, old []string) (KeyProvider, error) {
+	var keys [][]byte
+	for _, name := range append([]string{current}, old...) {
+		value, err := read(name)
+		if err != nil {
+			return nil, err
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("storage error: key %v is not valid base64: %w", name, err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyRing(keys[0], keys[1:]...)
+}
+
+func (kr *keyRing) CurrentKey() (string, []byte, error) {
+	return kr.current, kr.keys[kr.current], nil
+}
+
+func (kr *keyRing) Key(id string) ([]byte, error) {
+	if key, ok := kr.keys[id]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// envelope is the format of encrypted file. Data is encrypted with
+// random data key which is in turn encrypted with master key KeyID.
+type envelope struct {
+	Format     string
+	Version    int
+	Cipher     string
+	KeyID      string
+	WrappedKey []byte
+	KeyNonce   []byte
+	Nonce      []byte
+	Data       []byte
+}
+
+// additionalData binds ciphertext to header fields
+func (e *envelope) additionalData() []byte {
+	return []byte(fmt.Sprintf("%v/%v/%v/%v", e.Format, e.Version, e.Cipher, e.KeyID))
+}
+
+// isEnvelope reports whether data looks like encrypted file
+func isEnvelope(data []byte) bool {
+	var header struct{ Format string }
+	return json.Unmarshal(data, &header) == nil && header.Format == encryptedFormat
+}
+
+func seal(aead cipher.AEAD, plaintext, ad []byte) (nonce, ciphertext []byte, err error) {
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+// encrypt wraps plaintext into envelope using current key of kp
+func encrypt(kp KeyProvider, c Cipher, plaintext []byte) ([]byte, error) {
+	id, master, err := kp.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	env := envelope{Format: encryptedFormat, Version: encryptedVersion, Cipher: c.String(), KeyID: id}
+	ad := env.additionalData()
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	kek, err := c.aead(master)
+	if err != nil {
+		return nil, err
+	}
+	if env.KeyNonce, env.WrappedKey, err = seal(kek, dataKey, ad); err != nil {
+		return nil, err
+	}
+	dek, err := c.aead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if env.Nonce, env.Data, err = seal(dek, plaintext, ad); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(env, "", "    ")
+}
+
+// decrypt opens envelope in data. It also returns ID of key
+// the file was encrypted with.
+func decrypt(kp KeyProvider, data []byte) ([]byte, string, error) {
+	if kp == nil {
+		return nil, "", ErrEncrypted
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, "", err
+	}
+	if env.Version != encryptedVersion {
+		return nil, "", fmt.Errorf("storage error: unsupported encrypted file version %v", env.Version)
+	}
+	c, err := parseCipher(env.Cipher)
+	if err != nil {
+		return nil, "", err
+	}
+	master, err := kp.Key(env.KeyID)
+	if err != nil {
+		return nil, "", err
+	}
+	ad := env.additionalData()
+	kek, err := c.aead(master)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(env.KeyNonce) != kek.NonceSize() || len(env.Nonce) != kek.NonceSize() {
+		return nil, "", ErrDecrypt
+	}
+	dataKey, err := kek.Open(nil, env.KeyNonce, env.WrappedKey, ad)
+	if err != nil {
+		return nil, "", ErrDecrypt
+	}
+	dek, err := c.aead(dataKey)
+	if err != nil {
+		return nil, "", ErrDecrypt
+	}
+	plaintext, err := dek.Open(nil, env.Nonce, env.Data, ad)
+	if err != nil {
+		return nil, "", ErrDecrypt
+	}
+	return plaintext, env.KeyID, nil
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dmfed/basicauth"
+)
+
+func newTestKey() []byte {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	return key
+}
+
+func Test_Encryption(t *testing.T) {
+	fmt.Println("Testing encryption of JSONPasswordKeeper")
+	defer os.Remove(testFileName)
+	oldkey, newkey := newTestKey(), newTestKey()
+	for _, c := range []Cipher{AESGCM, XChaCha20Poly1305} {
+		os.Remove(testFileName)
+		kp, _ := NewKeyRing(oldkey)
+		pk, err := NewJSONPasswordKeeper(testFileName, WithEncryption(kp, c))
+		if err != nil {
+			fmt.Println("NewJSONPasswordKeeper failed with error:", err)
+			t.FailNow()
+		}
+		pk.Put(testUserInfo)
+		pk.Close()
+		data, _ := os.ReadFile(testFileName)
+		if bytes.Contains(data, []byte(testUser)) || !bytes.Contains(data, []byte(KeyID(oldkey))) {
+			fmt.Printf("%v: file is not encrypted or does not record key ID:\n%s\n", c, data)
+			t.Fail()
+		}
+		if _, err := OpenJSONPasswordKeeper(testFileName); err != ErrEncrypted {
+			fmt.Println("opening encrypted file without key returned:", err)
+			t.Fail()
+		}
+		wrong, _ := NewKeyRing(newkey)
+		if _, err := OpenJSONPasswordKeeper(testFileName, WithEncryption(wrong, c)); err != ErrUnknownKey {
+			fmt.Println("opening encrypted file with wrong key returned:", err)
+			t.Fail()
+		}
+		// rotate: new current key, old one is kept for reading
+		os.Setenv("BASICAUTH_TEST_KEY", base64.StdEncoding.EncodeToString(newkey))
+		os.Setenv("BASICAUTH_TEST_OLDKEY", base64.StdEncoding.EncodeToString(oldkey))
+		rotated, err := NewEnvKeyProvider("BASICAUTH_TEST_KEY", "BASICAUTH_TEST_OLDKEY")
+		if err != nil {
+			fmt.Println("NewEnvKeyProvider failed with error:", err)
+			t.FailNow()
+		}
+		pk, err = OpenJSONPasswordKeeper(testFileName, WithEncryption(rotated, c))
+		if err != nil {
+			fmt.Println("opening file with rotated keys failed with error:", err)
+			t.FailNow()
+		}
+		if acc, err := pk.Get(testUser); err != nil || acc.PasswordHash != testHash {
+			fmt.Println("Get() after decryption returned:", acc, err)
+			t.Fail()
+		}
+		pk.Put(basicauth.Account{UserName: testInvalidUser})
+		pk.Close()
+		data, _ = os.ReadFile(testFileName)
+		if !bytes.Contains(data, []byte(KeyID(newkey))) {
+			fmt.Println("file was not re-encrypted with new key")
+			t.Fail()
+		}
+		// tampering is detected
+		data[len(data)/2] ^= 1
+		os.WriteFile(testFileName, data, 0600)
+		if _, err := OpenJSONPasswordKeeper(testFileName, WithEncryption(rotated, c)); err == nil {
+			fmt.Println("opening damaged file did not return error")
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+// htpasswdLine is a line of htpasswd file. Comments
+// and blank lines have empty user and are kept as is.
+type htpasswdLine struct {
+	raw  string
+	user string
+	hash string
+}
+
+// HtpasswdStorage keeps accounts in Apache htpasswd file. Comments
+// and order of lines are preserved. The format only holds usernames
+// and password hashes, all other fields of basicauth.Account are lost
+// on Put and Upd refuses to change them.
+// Use it with basicauth.NewHtpasswdHasher to verify apr1 and {SHA} hashes.
+// It implements basicauth.UserAccountStorage
+type HtpasswdStorage struct {
+	filename string
+	lines    []htpasswdLine
+	mutex    sync.Mutex
+}
+
+// OpenHtpasswdStorage reads htpasswd file filename. The file
+// is created if it does not exist.
+func OpenHtpasswdStorage(filename string) (basicauth.UserAccountStorage, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("empty filename provided. will do nothing")
+	}
+	hs := &HtpasswdStorage{filename: filename}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return hs, hs.flushToDisk()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if hs.lines, err = parseHtpasswd(f); err != nil {
+		return nil, err
+	}
+	return hs, nil
+}
+
+func parseHtpasswd(r io.Reader) ([]htpasswdLine, error) {
+	var lines []htpasswdLine
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		raw := scanner.Text()
+		line := htpasswdLine{raw: raw}
+		trimmed := strings.TrimSpace(raw)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			i := strings.IndexByte(raw, ':')
+			if i <= 0 {
+				return nil, fmt.Errorf("storage error: malformed htpasswd line %v", n)
+			}
+			line.user, line.hash = raw[:i], raw[i+1:]
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// ImportHtpasswd reads htpasswd file from r and puts every user into dst.
+// Users already present in dst are skipped. Returns number of imported users.
+func ImportHtpasswd(r io.Reader, dst basicauth.UserAccountStorage) (int, error) {
+	lines, err := parseHtpasswd(r)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	t := time.Now()
+	for _, line := range lines {
+		if line.user == "" {
+			continue
+		}
+		if _, err := dst.Get(line.user); err == nil {
+			continue
+		}
+		if err := dst.Put(basicauth.Account{UserName: line.user, PasswordHash: line.hash, DateCreated: t, DateChanged: t}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (hs *HtpasswdStorage) find(username string) int {
+	for i, line := range hs.lines {
+		if line.user != "" && line.user == username {
+			return i
+		}
+	}
+	return -1
+}
+
+func validHtpasswdUser(username string) error {
+	if username == "" || strings.ContainsAny(username, ":\r\n") {
+		return fmt.Errorf("storage error: username %q can not be stored in htpasswd file", username)
+	}
+	return nil
+}
+
+func validHtpasswdHash(hash string) error {
+	if strings.ContainsAny(hash, ":\r\n") {
+		return fmt.Errorf("storage error: password hash can not be stored in htpasswd file")
+	}
+	return nil
+}
+
+// Get returns account with username and password hash set
+func (hs *HtpasswdStorage) Get(username string) (basicauth.Account, error) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	i := hs.find(username)
+	if i < 0 {
+		return basicauth.Account{}, ErrNoSuchUser
+	}
+	return basicauth.Account{UserName: hs.lines[i].user, PasswordHash: hs.lines[i].hash}, nil
+}
+
+// htpasswdFields reports whether account has no fields other than
+// those kept in htpasswd file or timestamps which are dropped silently
+func htpasswdFields(account basicauth.Account) bool {
+	kept := basicauth.Account{UserName: account.UserName, PasswordHash: account.PasswordHash,
+		DateCreated: account.DateCreated, DateChanged: account.DateChanged, Lastlogin: account.Lastlogin}
+	return reflect.DeepEqual(account, kept)
+}
+
+// update applies change to lines and writes the file. Previous
+// lines are restored if the file could not be written.
+// It is called with mutex held.
+func (hs *HtpasswdStorage) update(change func()) error {
+	prev := append([]htpasswdLine(nil), hs.lines...)
+	change()
+	if err := hs.flushToDisk(); err != nil {
+		hs.lines = prev
+		return err
+	}
+	return nil
+}
+
+// Put appends user to the end of file. Timestamps are not kept.
+// Put returns basicauth.ErrNotSupported if any other field
+// besides username and password hash is set.
+func (hs *HtpasswdStorage) Put(account basicauth.Account) error {
+	if !htpasswdFields(account) {
+		return basicauth.ErrNotSupported
+	}
+	if err := validHtpasswdUser(account.UserName); err != nil {
+		return err
+	}
+	if err := validHtpasswdHash(account.PasswordHash); err != nil {
+		return err
+	}
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if hs.find(account.UserName) >= 0 {
+		return ErrUserExists
+	}
+	return hs.update(func() {
+		hs.lines = append(hs.lines, htpasswdLine{user: account.UserName, hash: account.PasswordHash})
+	})
+}
+
+// Upd replaces password hash of user in place. Versions
+// are not kept, so concurrent updates are not detected.
+// Timestamps are not kept either. Upd returns basicauth.ErrNotSupported
+// if any other field differs from what Get returns.
+func (hs *HtpasswdStorage) Upd(account basicauth.Account) error {
+	if !htpasswdFields(account) {
+		return basicauth.ErrNotSupported
+	}
+	if err := validHtpasswdHash(account.PasswordHash); err != nil {
+		return err
+	}
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	i := hs.find(account.UserName)
+	if i < 0 {
+		return ErrNoSuchUser
+	}
+	if hs.lines[i].hash == account.PasswordHash {
+		return nil
+	}
+	return hs.update(func() {
+		hs.lines[i] = htpasswdLine{user: account.UserName, hash: account.PasswordHash}
+	})
+}
+
+// Del removes user's line from file
+func (hs *HtpasswdStorage) Del(username string) error {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	i := hs.find(username)
+	if i < 0 {
+		return ErrNoSuchUser
+	}
+	return hs.update(func() {
+		hs.lines = append(hs.lines[:i], hs.lines[i+1:]...)
+	})
+}
+
+// List implements basicauth.Lister
+func (hs *HtpasswdStorage) List(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	accounts := make(map[string]basicauth.Account)
+	for _, line := range hs.lines {
+		if line.user != "" {
+			accounts[line.user] = basicauth.Account{UserName: line.user, PasswordHash: line.hash}
+		}
+	}
+	page, next := listAccounts(accounts, q)
+	return page, next, nil
+}
+
+// Close implements basicauth.UserAccountStorage
+func (hs *HtpasswdStorage) Close() error {
+	return nil
+}
+
+func (hs *HtpasswdStorage) flushToDisk() error {
+	var buf bytes.Buffer
+	for _, line := range hs.lines {
+		if line.user != "" && line.raw == "" {
+			line.raw = line.user + ":" + line.hash
+		}
+		buf.WriteString(line.raw)
+		buf.WriteByte('\n')
+	}
+	return WriteFileAtomic(hs.filename, buf.Bytes(), 0600)
+}
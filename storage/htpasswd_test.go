@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dmfed/basicauth"
+)
+
+var sampleHtpasswd = `# managed by hand
+alice:$apr1$xxxxxxxx$dxHfLAsjHkDRmG83UXe8K0
+
+bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=
+`
+
+func Test_HtpasswdStorage(t *testing.T) {
+	fmt.Println("Testing HtpasswdStorage")
+	filename := "test.htpasswd"
+	defer os.Remove(filename)
+	os.WriteFile(filename, []byte(sampleHtpasswd), 0600)
+	st, err := OpenHtpasswdStorage(filename)
+	if err != nil {
+		fmt.Println("OpenHtpasswdStorage failed with error:", err)
+		t.FailNow()
+	}
+	app, _ := basicauth.NewAppInterface(st, basicauth.WithHasher(basicauth.NewHtpasswdHasher()))
+	if err := app.CheckUserPassword("alice", "password"); err != nil {
+		fmt.Println("CheckUserPassword with apr1 hash returned:", err)
+		t.Fail()
+	}
+	if acc, _ := st.Get("alice"); !strings.HasPrefix(acc.PasswordHash, "$2") {
+		fmt.Println("apr1 hash was not upgraded on login:", acc.PasswordHash)
+		t.Fail()
+	}
+	if err := app.CheckUserPassword("bob", "password"); err != nil {
+		fmt.Println("CheckUserPassword with {SHA} hash returned:", err)
+		t.Fail()
+	}
+	st.Put(basicauth.Account{UserName: "carol", PasswordHash: "{SHA}x"})
+	if err := st.Put(basicauth.Account{UserName: "carol"}); err != ErrUserExists {
+		fmt.Println("Put() with existing user returned:", err)
+		t.Fail()
+	}
+	if err := st.Upd(basicauth.Account{UserName: "carol", PasswordHash: "{SHA}x", Email: "carol@example.com"}); err != basicauth.ErrNotSupported {
+		fmt.Println("Upd() of field other than hash returned:", err)
+		t.Fail()
+	}
+	if err := st.Upd(basicauth.Account{UserName: "carol", PasswordHash: "x:y\nmallory:z"}); err == nil {
+		fmt.Println("Upd() accepted hash with separators")
+		t.Fail()
+	}
+	if err := st.Put(basicauth.Account{UserName: "dave", PasswordHash: "{SHA}x", MustChangePassword: true}); err != basicauth.ErrNotSupported {
+		fmt.Println("Put() with field other than hash returned:", err)
+		t.Fail()
+	}
+	renameFile = func(string, string) error { return fmt.Errorf("simulated failure") }
+	putErr := st.Put(basicauth.Account{UserName: "dave", PasswordHash: "{SHA}x"})
+	updErr := st.Upd(basicauth.Account{UserName: "carol", PasswordHash: "{SHA}y"})
+	delErr := st.Del("carol")
+	renameFile = os.Rename
+	if putErr == nil || updErr == nil || delErr == nil {
+		fmt.Println("failed writes returned:", putErr, updErr, delErr)
+		t.Fail()
+	}
+	if _, err := st.Get("dave"); err != ErrNoSuchUser {
+		fmt.Println("user was kept after failed Put():", err)
+		t.Fail()
+	}
+	if acc, err := st.Get("carol"); err != nil || acc.PasswordHash != "{SHA}x" {
+		fmt.Println("user was changed after failed Upd() or Del():", acc, err)
+		t.Fail()
+	}
+	st.Del("bob")
+	data, _ := os.ReadFile(filename)
+	lines := strings.Split(string(data), "\n")
+	if len(lines) != 5 || lines[0] != "# managed by hand" || !strings.HasPrefix(lines[1], "alice:$2") || lines[2] != "" || lines[3] != "carol:{SHA}x" {
+		fmt.Printf("comments or order of lines were not preserved:\n%s", data)
+		t.Fail()
+	}
+	defer os.Remove("test_htimport.json")
+	dst, _ := NewJSONPasswordKeeper("test_htimport.json")
+	if n, err := ImportHtpasswd(strings.NewReader(sampleHtpasswd), dst); err != nil || n != 2 {
+		fmt.Println("ImportHtpasswd returned:", n, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+const (
+	snapshotSuffix = ".snapshot"
+	journalSuffix  = ".log"
+	// defaultCompactRecords is number of records in the log
+	// which triggers compaction if not set with WithCompaction
+	defaultCompactRecords = 1000
+)
+
+// Journal operations
+const (
+	OpPut = "put"
+	OpUpd = "upd"
+	OpDel = "del"
+)
+
+// JournalRecord is a single change of storage. Records
+// are written to the log as JSON lines. Token and Expires
+// are only set in session records of ChangeLog, Token holds
+// HashToken of the session token.
+type JournalRecord struct {
+	Seq      uint64
+	Time     time.Time
+	Op       string
+	UserName string             `json:",omitempty"`
+	Account  *basicauth.Account `json:",omitempty"`
+	Token    string             `json:",omitempty"`
+	Expires  time.Time          `json:",omitempty"`
+}
+
+type journalSnapshot struct {
+	Seq      uint64
+	Accounts map[string]basicauth.Account
+}
+
+// JournalStorage keeps accounts in memory and appends every change to
+// a log file as a JSON line synced to disk before the change is applied.
+// On open the log is replayed on top of the last snapshot. Compaction
+// writes a new snapshot and starts a fresh log.
+// It implements basicauth.UserAccountStorage
+type JournalStorage struct {
+	accounts     map[string]basicauth.Account
+	snapshotname string
+	journal      *os.File
+	seq          uint64
+	records      int
+	maxRecords   int
+	interval     time.Duration
+	compact      chan struct{}
+	stop         chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+	mutex        sync.Mutex
+}
+
+// JournalOption configures optional behaviour of JournalStorage
+type JournalOption func(*JournalStorage)
+
+// WithCompaction makes JournalStorage compact the log every interval and
+// whenever it grows to maxRecords records. Zero interval disables periodic
+// compaction, zero maxRecords disables compaction by size.
+func WithCompaction(interval time.Duration, maxRecords int) JournalOption {
+	return func(js *JournalStorage) {
+		js.interval = interval
+		js.maxRecords = maxRecords
+	}
+}
+
+// OpenJournalStorage opens (or creates) storage kept in files filename.snapshot
+// and filename.log. Torn record at the end of the log (left by a crash in the
+// middle of a write) is truncated.
+func OpenJournalStorage(filename string, opts ...JournalOption) (basicauth.UserAccountStorage, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("empty filename provided. will do nothing")
+	}
+	js := &JournalStorage{
+		accounts:     make(map[string]basicauth.Account),
+		snapshotname: filename + snapshotSuffix,
+		maxRecords:   defaultCompactRecords,
+		compact:      make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(js)
+		}
+	}
+	if err := js.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename+journalSuffix, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	js.journal = f
+	if err := js.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	go js.compactor()
+	return js, nil
+}
+
+func (js *JournalStorage) loadSnapshot() error {
+	data, err := os.ReadFile(js.snapshotname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap journalSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("storage error: could not read snapshot %v: %w", js.snapshotname, err)
+	}
+	js.seq = snap.Seq
+	if snap.Accounts != nil {
+		js.accounts = snap.Accounts
+	}
+	return nil
+}
+
+// replay applies records from the log. Records already included
+// in snapshot are skipped.
+func (js *JournalStorage) replay() error {
+	if _, err := js.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(js.journal)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				return js.truncateTorn(offset)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var rec JournalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if _, peekerr := r.Peek(1); peekerr == io.EOF {
+				return js.truncateTorn(offset)
+			}
+			return fmt.Errorf("storage error: damaged record in %v at offset %v: %w", js.journal.Name(), offset, err)
+		}
+		offset += int64(len(line))
+		js.records++
+		if rec.Seq <= js.seq {
+			continue
+		}
+		js.apply(rec)
+	}
+	_, err := js.journal.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (js *JournalStorage) truncateTorn(offset int64) error {
+	log.Printf("storage: truncating torn record at the end of %v at offset %v", js.journal.Name(), offset)
+	if err := js.journal.Truncate(offset); err != nil {
+		return err
+	}
+	if err := js.journal.Sync(); err != nil {
+		return err
+	}
+	_, err := js.journal.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (js *JournalStorage) apply(rec JournalRecord) {
+	switch rec.Op {
+	case OpPut, OpUpd:
+		if rec.Account != nil {
+			js.accounts[rec.Account.UserName] = CopyAccount(*rec.Account)
+		}
+	case OpDel:
+		delete(js.accounts, rec.UserName)
+	}
+	js.seq = rec.Seq
+}
+
+// writeJournal is (*os.File).Write. It is a variable so that
+// tests can simulate failed writes.
+var writeJournal = (*os.File).Write
+
+// rollback removes partially written record at offset after write
+// failed with cause, so that next record does not follow garbage.
+func (js *JournalStorage) rollback(offset int64, cause error) error {
+	if err := js.journal.Truncate(offset); err != nil {
+		log.Printf("storage: could not remove partial record from %v: %v", js.journal.Name(), err)
+		return cause
+	}
+	if _, err := js.journal.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("storage: could not seek in %v: %v", js.journal.Name(), err)
+	}
+	return cause
+}
+
+// write appends record to the log, syncs it and applies it.
+// Must be called with mutex held.
+func (js *JournalStorage) write(rec JournalRecord) error {
+	rec.Seq = js.seq + 1
+	rec.Time = time.Now()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	offset, err := js.journal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := writeJournal(js.journal, data); err != nil {
+		return js.rollback(offset, err)
+	}
+	if err := js.journal.Sync(); err != nil {
+		return js.rollback(offset, err)
+	}
+	js.apply(rec)
+	js.records++
+	if js.maxRecords > 0 && js.records >= js.maxRecords {
+		select {
+		case js.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Put adds account to storage
+func (js *JournalStorage) Put(account basicauth.Account) error {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	if _, exists := js.accounts[account.UserName]; exists {
+		return ErrUserExists
+	}
+	return js.write(JournalRecord{Op: OpPut, UserName: account.UserName, Account: &account})
+}
+
+// Get returns account if username is valid
+func (js *JournalStorage) Get(username string) (basicauth.Account, error) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	account, exists := js.accounts[username]
+	if !exists {
+		return basicauth.Account{}, ErrNoSuchUser
+	}
+	return CopyAccount(account), nil
+}
+
+// List implements basicauth.Lister
+func (js *JournalStorage) List(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	accounts, next := listAccounts(js.accounts, q)
+	return accounts, next, nil
+}
+
+// Del deletes account if username is valid
+func (js *JournalStorage) Del(username string) error {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	if _, exists := js.accounts[username]; !exists {
+		return ErrNoSuchUser
+	}
+	return js.write(JournalRecord{Op: OpDel, UserName: username})
+}
+
+// Upd replaces existing account with supplied one if their versions match
+func (js *JournalStorage) Upd(account basicauth.Account) error {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	existing, exists := js.accounts[account.UserName]
+	if !exists {
+		return ErrNoSuchUser
+	}
+	if existing.Version != account.Version {
+		return basicauth.ErrConflict
+	}
+	account.Version++
+	return js.write(JournalRecord{Op: OpUpd, UserName: account.UserName, Account: &account})
+}
+
+// Compact writes snapshot of current state and starts a fresh log.
+func (js *JournalStorage) Compact() error {
+	js.mutex.Lock()
+	defer js.mutex.Unlock()
+	if js.records == 0 {
+		return nil
+	}
+	data, err := json.Marshal(journalSnapshot{Seq: js.seq, Accounts: js.accounts})
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(js.snapshotname, data, 0600); err != nil {
+		return err
+	}
+	// a crash before truncation is harmless: records
+	// already in snapshot are skipped on replay
+	if err := js.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := js.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	js.records = 0
+	return js.journal.Sync()
+}
+
+func (js *JournalStorage) compactor() {
+	defer close(js.done)
+	var tick <-chan time.Time
+	if js.interval > 0 {
+		ticker := time.NewTicker(js.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-js.compact:
+		case <-js.stop:
+			return
+		}
+		if err := js.Compact(); err != nil {
+			log.Printf("storage: error compacting %v: %v", js.journal.Name(), err)
+		}
+	}
+}
+
+// Close stops background compaction and closes the log.
+func (js *JournalStorage) Close() (err error) {
+	js.closeOnce.Do(func() {
+		close(js.stop)
+		<-js.done
+		js.mutex.Lock()
+		defer js.mutex.Unlock()
+		err = js.journal.Close()
+	})
+	return
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dmfed/basicauth"
+)
+
+func Test_JournalStorage(t *testing.T) {
+	fmt.Println("Testing JournalStorage")
+	base := "test_journal"
+	defer os.Remove(base + snapshotSuffix)
+	defer os.Remove(base + journalSuffix)
+	js, err := OpenJournalStorage(base)
+	if err != nil {
+		fmt.Println("OpenJournalStorage failed with error:", err)
+		t.FailNow()
+	}
+	js.Put(testUserInfo)
+	js.Put(basicauth.Account{UserName: testInvalidUser})
+	if err := js.Put(testUserInfo); err != ErrUserExists {
+		fmt.Println("Put() with existing user returned:", err)
+		t.Fail()
+	}
+	updated := testUserInfo
+	updated.PasswordHash = "newhash"
+	js.Upd(updated)
+	js.Del(testInvalidUser)
+	js.Close()
+
+	// simulate crash in the middle of appending a record
+	f, _ := os.OpenFile(base+journalSuffix, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"Seq":5,"Op":"put","Acc`)
+	f.Close()
+	js, err = OpenJournalStorage(base)
+	if err != nil {
+		fmt.Println("OpenJournalStorage did not recover from torn record:", err)
+		t.FailNow()
+	}
+	if acc, err := js.Get(testUser); err != nil || acc.PasswordHash != "newhash" {
+		fmt.Println("replayed account does not match:", acc, err)
+		t.Fail()
+	}
+	if _, err := js.Get(testInvalidUser); err != ErrNoSuchUser {
+		fmt.Println("deleted user exists after replay:", err)
+		t.Fail()
+	}
+	if err := js.(*JournalStorage).Compact(); err != nil {
+		fmt.Println("Compact() failed with error:", err)
+		t.Fail()
+	}
+	js.Put(basicauth.Account{UserName: "after"})
+	js.Close()
+
+	js, err = OpenJournalStorage(base)
+	if err != nil {
+		fmt.Println("OpenJournalStorage after compaction failed with error:", err)
+		t.FailNow()
+	}
+	defer js.Close()
+	for _, name := range []string{testUser, "after"} {
+		if _, err := js.Get(name); err != nil {
+			fmt.Println("user", name, "lost after compaction:", err)
+			t.Fail()
+		}
+	}
+	if seq := js.(*JournalStorage).seq; seq != 5 {
+		fmt.Println("sequence number after reopen want: 5 got:", seq)
+		t.Fail()
+	}
+	js.Close()
+
+	// failed write must not leave partial record in the log
+	js, _ = OpenJournalStorage(base)
+	writeJournal = func(f *os.File, data []byte) (int, error) {
+		n, _ := f.Write(data[:len(data)/2])
+		return n, fmt.Errorf("simulated failure")
+	}
+	err = js.Put(basicauth.Account{UserName: "failed"})
+	writeJournal = (*os.File).Write
+	if err == nil {
+		fmt.Println("Put() did not return error when write failed")
+		t.Fail()
+	}
+	js.Put(basicauth.Account{UserName: "next"})
+	js.Close()
+	js, err = OpenJournalStorage(base)
+	if err != nil {
+		fmt.Println("OpenJournalStorage after failed write returned:", err)
+		t.FailNow()
+	}
+	if _, err := js.Get("next"); err != nil {
+		fmt.Println("record written after failed write was lost:", err)
+		t.Fail()
+	}
+	js.Close()
+}
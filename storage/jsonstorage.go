@@ -4,13 +4,21 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/dmfed/basicauth"
 )
 
+const backupSuffix = ".bak"
+
 var (
+	// ErrFileChanged is returned in watch mode when the file was changed by
+	// someone else since it was last read and the new contents can not be
+	// read. Pending changes are kept in memory and written by the next write.
+	ErrFileChanged = errors.New("storage error: file was changed externally")
 	// ErrNoSuchUser is returned if no user is found
 	ErrNoSuchUser = errors.New("storage error: no such user")
 	// ErrUserExists is returned when trying to add user with existing username
@@ -24,32 +32,263 @@ type JSONPasswordKeeper struct {
 	userInfo map[string]basicauth.Account
 	filename string
 	mutex    sync.Mutex
+	backup   bool
+	// encryption at rest settings
+	keys   KeyProvider
+	cipher Cipher
+	// write-behind mode settings and state
+	interval  time.Duration
+	maxDirty  int
+	dirty     int
+	pending   map[string]bool // accounts changed since the last write
+	stop      chan struct{}
+	workers   sync.WaitGroup
+	closeOnce sync.Once
+	// watch mode settings and state
+	watch    time.Duration
+	diskInfo os.FileInfo // file as last read or written by the keeper
+	// subscribers to changes, see Subscribe
+	subscribers map[int]func(string)
+	lastSub     int
+}
+
+// JSONOption configures optional behaviour of JSONPasswordKeeper
+type JSONOption func(*JSONPasswordKeeper)
+
+// WithBackup makes JSONPasswordKeeper keep previous version of the file
+// as filename.bak. OpenJSONPasswordKeeper recovers from .bak if the main
+// file is missing or damaged.
+func WithBackup() JSONOption {
+	return func(pk *JSONPasswordKeeper) {
+		pk.backup = true
+	}
+}
+
+// WithWriteBehind makes JSONPasswordKeeper collect changes in memory
+// and write them to disk every interval or as soon as maxDirty changes
+// are pending (zero maxDirty means no limit). Pending changes are written
+// by Sync and Close. Changes made since the last write are lost if
+// the process crashes.
+func WithWriteBehind(interval time.Duration, maxDirty int) JSONOption {
+	return func(pk *JSONPasswordKeeper) {
+		pk.interval = interval
+		pk.maxDirty = maxDirty
+	}
+}
+
+// WithEncryption makes JSONPasswordKeeper encrypt the file with a random
+// data key which is in turn encrypted with current key of kp. The file
+// records ID of the key, so after kp's current key is changed the file
+// is still readable with the old key and is re-encrypted on the next write.
+// Plain text files are encrypted on the next write too.
+func WithEncryption(kp KeyProvider, c Cipher) JSONOption {
+	return func(pk *JSONPasswordKeeper) {
+		pk.keys = kp
+		pk.cipher = c
+	}
+}
+
+// WithWatch makes JSONPasswordKeeper check the file for external changes
+// every interval and load new contents. The file is also checked before
+// every change and every write. External edits are merged per account:
+// accounts changed through the keeper since the last write keep their new
+// state, all others are loaded from the file. If new contents can not be
+// read the error is logged, current state is kept and the write fails with
+// ErrFileChanged.
+func WithWatch(interval time.Duration) JSONOption {
+	return func(pk *JSONPasswordKeeper) {
+		pk.watch = interval
+	}
+}
+
+func (pk *JSONPasswordKeeper) applyOptions(opts []JSONOption) {
+	for _, opt := range opts {
+		if opt != nil {
+			opt(pk)
+		}
+	}
+	pk.stop = make(chan struct{})
+}
+
+// start starts background writes of write-behind mode and polling of
+// the file in watch mode. It must be called after the keeper is fully
+// constructed and the file has been read or written for the first time.
+func (pk *JSONPasswordKeeper) start() {
+	if pk.interval > 0 {
+		pk.workers.Add(1)
+		go pk.writeBehind()
+	}
+	if pk.watch <= 0 {
+		return
+	}
+	pk.workers.Add(1)
+	go func() {
+		defer pk.workers.Done()
+		ticker := time.NewTicker(pk.watch)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pk.mutex.Lock()
+				pk.reloadIfChanged()
+				pk.mutex.Unlock()
+			case <-pk.stop:
+				return
+			}
+		}
+	}()
+}
+
+// changedOnDisk reports whether the file differs from the one
+// last read or written by the keeper
+func (pk *JSONPasswordKeeper) changedOnDisk() (os.FileInfo, bool) {
+	info, err := os.Stat(pk.filename)
+	if err != nil {
+		// missing file is recreated on next write
+		return nil, false
+	}
+	if pk.diskInfo == nil {
+		return info, true
+	}
+	return info, !os.SameFile(info, pk.diskInfo) || !info.ModTime().Equal(pk.diskInfo.ModTime()) || info.Size() != pk.diskInfo.Size()
+}
+
+// reloadIfChanged is called with mutex held. It loads contents of the file
+// if the file was changed externally, accounts with pending changes keep
+// their state. Returns ErrFileChanged if the file could not be read.
+func (pk *JSONPasswordKeeper) reloadIfChanged() error {
+	info, changed := pk.changedOnDisk()
+	if !changed {
+		return nil
+	}
+	// remember the file even if it is broken to log the error only once
+	pk.diskInfo = info
+	userinfo, err := pk.readAccounts(pk.filename)
+	if err != nil {
+		log.Printf("storage: %v changed but could not be read, keeping current state: %v", pk.filename, err)
+		return ErrFileChanged
+	}
+	if len(pk.pending) > 0 {
+		log.Printf("storage: %v changed externally, keeping pending changes of %v accounts", pk.filename, len(pk.pending))
+	}
+	for username := range pk.pending {
+		if account, ok := pk.userInfo[username]; ok {
+			userinfo[username] = account
+		} else {
+			delete(userinfo, username)
+		}
+	}
+	pk.userInfo = userinfo
+	pk.notify("")
+	return nil
+}
+
+// refresh is called with mutex held before modifying userInfo in watch mode
+func (pk *JSONPasswordKeeper) refresh() {
+	if pk.watch > 0 {
+		pk.reloadIfChanged()
+	}
+}
+
+// rememberFile records current state of the file as known to the keeper
+func (pk *JSONPasswordKeeper) rememberFile() {
+	if info, err := os.Stat(pk.filename); err == nil {
+		pk.diskInfo = info
+	}
+}
+
+// writeBehind periodically flushes pending changes to disk
+func (pk *JSONPasswordKeeper) writeBehind() {
+	defer pk.workers.Done()
+	ticker := time.NewTicker(pk.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := pk.Sync(); err != nil {
+				log.Printf("storage: error writing %v: %v", pk.filename, err)
+			}
+		case <-pk.stop:
+			return
+		}
+	}
 }
 
 // OpenJSONPasswordKeeper accepts a filename containig usernames and password
 // hashes and returns in stance of JSONPasswordKeeper. Function returns an underlying
 // error if it fails to read from file or fails to Unmarshal its contents.
-func OpenJSONPasswordKeeper(filename string) (basicauth.UserAccountStorage, error) {
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return NewJSONPasswordKeeper(filename)
+// With WithBackup, if file is damaged or missing and filename.bak is available,
+// the keeper is recovered from the backup and the file is rewritten. Changes
+// made after the backup was written are lost.
+func OpenJSONPasswordKeeper(filename string, opts ...JSONOption) (basicauth.UserAccountStorage, error) {
+	var pk JSONPasswordKeeper
+	pk.filename = filename
+	pk.applyOptions(opts)
+	backupname := filename + backupSuffix
+	_, staterr := os.Stat(filename)
+	_, backuperr := os.Stat(backupname)
+	if os.IsNotExist(staterr) && (!pk.backup || os.IsNotExist(backuperr)) {
+		return NewJSONPasswordKeeper(filename, opts...)
+	}
+	userinfo, err := pk.readAccounts(filename)
+	if err != nil && pk.backup {
+		userinfo, err = pk.recover(backupname, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pk.userInfo = userinfo
+	pk.rememberFile()
+	pk.start()
+	return &pk, nil
+}
+
+// recover reads accounts from backup after reading main file failed with
+// cause and rewrites main file with recovered contents.
+func (pk *JSONPasswordKeeper) recover(backupname string, cause error) (map[string]basicauth.Account, error) {
+	info, err := os.Stat(backupname)
+	if err != nil {
+		return nil, cause
 	}
+	userinfo, err := pk.readAccounts(backupname)
+	if err != nil {
+		return nil, cause
+	}
+	log.Printf("storage: WARNING: could not read %v: %v. ROLLED BACK to %v written at %v, changes made since then are LOST",
+		pk.filename, cause, backupname, info.ModTime())
+	// not using flushToDisk here as it would replace
+	// good backup with the damaged file
+	data, err := pk.marshal(userinfo)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteFileAtomic(pk.filename, data, 0600); err != nil {
+		return nil, err
+	}
+	return userinfo, nil
+}
+
+func (pk *JSONPasswordKeeper) readAccounts(filename string) (map[string]basicauth.Account, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	var pk JSONPasswordKeeper
-	pk.userInfo = make(map[string]basicauth.Account)
-	if err := json.Unmarshal(data, &pk.userInfo); err != nil {
+	if isEnvelope(data) {
+		if data, _, err = decrypt(pk.keys, data); err != nil {
+			return nil, err
+		}
+	}
+	userinfo := make(map[string]basicauth.Account)
+	if err := json.Unmarshal(data, &userinfo); err != nil {
 		return nil, err
 	}
-	pk.filename = filename
-	return &pk, nil
+	return userinfo, nil
 }
 
 // NewJSONPasswordKeeper creates a new keeper and tries to save to disk.
 // Will return underlying error if it fails to write to designated file)
 // properly.
-func NewJSONPasswordKeeper(filename string) (basicauth.UserAccountStorage, error) {
+func NewJSONPasswordKeeper(filename string, opts ...JSONOption) (basicauth.UserAccountStorage, error) {
 	if filename == "" {
 		return nil, fmt.Errorf("empty filename provided. will do nothing")
 	}
@@ -59,18 +298,25 @@ func NewJSONPasswordKeeper(filename string) (basicauth.UserAccountStorage, error
 	var pk JSONPasswordKeeper
 	pk.userInfo = make(map[string]basicauth.Account)
 	pk.filename = filename
-	return &pk, pk.flushToDisk()
+	pk.applyOptions(opts)
+	if err := pk.flushToDisk(); err != nil {
+		return &pk, err
+	}
+	pk.start()
+	return &pk, nil
 }
 
 // Put adds UseerInfo to storage
 func (pk *JSONPasswordKeeper) Put(userinfo basicauth.Account) error {
 	pk.mutex.Lock()
 	defer pk.mutex.Unlock()
+	pk.refresh()
 	if _, exists := pk.userInfo[userinfo.UserName]; exists {
 		return ErrUserExists
 	}
-	pk.userInfo[userinfo.UserName] = userinfo
-	return pk.flushToDisk()
+	pk.userInfo[userinfo.UserName] = CopyAccount(userinfo)
+	pk.notify(userinfo.UserName)
+	return pk.changed(userinfo.UserName)
 }
 
 // Get returns basicauth.UserInfo if username is valid
@@ -81,34 +327,118 @@ func (pk *JSONPasswordKeeper) Get(username string) (basicauth.Account, error) {
 	if !exists {
 		return basicauth.Account{}, ErrNoSuchUser
 	}
-	return userinfo, nil
+	return CopyAccount(userinfo), nil
+}
+
+// List implements basicauth.Lister
+func (pk *JSONPasswordKeeper) List(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	pk.mutex.Lock()
+	defer pk.mutex.Unlock()
+	accounts, next := listAccounts(pk.userInfo, q)
+	return accounts, next, nil
 }
 
 // Del deletes basicauth.UserInfo is username is valid
 func (pk *JSONPasswordKeeper) Del(username string) error {
 	pk.mutex.Lock()
 	defer pk.mutex.Unlock()
+	pk.refresh()
 	if _, exists := pk.userInfo[username]; exists {
 		delete(pk.userInfo, username)
-		return pk.flushToDisk()
+		pk.notify(username)
+		return pk.changed(username)
 	}
 	return ErrNoSuchUser
 }
 
 // Upd finds if user with UserName as in supplied userinfo exists and
-// updates existing info for that user with supplied userinfo.
+// updates existing info for that user with supplied userinfo. It returns
+// basicauth.ErrConflict if stored Version differs from userinfo.Version.
 func (pk *JSONPasswordKeeper) Upd(userinfo basicauth.Account) error {
 	pk.mutex.Lock()
 	defer pk.mutex.Unlock()
-	if _, ok := pk.userInfo[userinfo.UserName]; ok {
-		pk.userInfo[userinfo.UserName] = userinfo
-		return pk.flushToDisk()
+	pk.refresh()
+	existing, ok := pk.userInfo[userinfo.UserName]
+	if !ok {
+		return ErrNoSuchUser
+	}
+	if existing.Version != userinfo.Version {
+		return basicauth.ErrConflict
+	}
+	userinfo.Version++
+	pk.userInfo[userinfo.UserName] = CopyAccount(userinfo)
+	pk.notify(userinfo.UserName)
+	return pk.changed(userinfo.UserName)
+}
+
+// Subscribe implements ChangeSource. fn is called on every change
+// made with the keeper and when external edit is loaded in watch mode.
+func (pk *JSONPasswordKeeper) Subscribe(fn func(username string)) func() {
+	pk.mutex.Lock()
+	defer pk.mutex.Unlock()
+	if pk.subscribers == nil {
+		pk.subscribers = make(map[int]func(string))
+	}
+	pk.lastSub++
+	id := pk.lastSub
+	pk.subscribers[id] = fn
+	return func() {
+		pk.mutex.Lock()
+		defer pk.mutex.Unlock()
+		delete(pk.subscribers, id)
 	}
-	return ErrNoSuchUser
 }
 
-// Close implements basicauth UsrInfoStorage interface
+// notify is called with mutex held after account is changed
+func (pk *JSONPasswordKeeper) notify(username string) {
+	for _, fn := range pk.subscribers {
+		fn(username)
+	}
+}
+
+// Sync writes pending changes to disk. It is only needed
+// in write-behind mode, otherwise every change is written at once.
+func (pk *JSONPasswordKeeper) Sync() error {
+	pk.mutex.Lock()
+	defer pk.mutex.Unlock()
+	if pk.dirty == 0 {
+		return nil
+	}
+	return pk.flush()
+}
+
+// Close implements basicauth UsrInfoStorage interface. It stops
+// write-behind and writes pending changes to disk.
 func (pk *JSONPasswordKeeper) Close() error {
+	pk.closeOnce.Do(func() {
+		if pk.stop != nil {
+			close(pk.stop)
+			pk.workers.Wait()
+		}
+	})
+	return pk.Sync()
+}
+
+// changed is called with mutex held after account of username is modified.
+// It writes to disk unless write-behind mode allows to postpone it.
+func (pk *JSONPasswordKeeper) changed(username string) error {
+	if pk.pending == nil {
+		pk.pending = make(map[string]bool)
+	}
+	pk.pending[username] = true
+	pk.dirty++
+	if pk.interval > 0 && (pk.maxDirty <= 0 || pk.dirty < pk.maxDirty) {
+		return nil
+	}
+	return pk.flush()
+}
+
+func (pk *JSONPasswordKeeper) flush() error {
+	if err := pk.flushToDisk(); err != nil {
+		return err
+	}
+	pk.dirty = 0
+	pk.pending = nil
 	return nil
 }
 
@@ -116,9 +446,52 @@ func (pk *JSONPasswordKeeper) flushToDisk() error {
 	// This method is always called from functions which
 	// defer pk.mutex.Unlock() so no need to use mutex here,
 	// we're protected already.
-	data, err := json.MarshalIndent(pk.userInfo, "", "    ")
+	if pk.watch > 0 {
+		if err := pk.reloadIfChanged(); err != nil {
+			return err
+		}
+	}
+	data, err := pk.marshal(pk.userInfo)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(pk.filename, data, 0600)
+	if pk.backup {
+		if err := backupFile(pk.filename, pk.filename+backupSuffix); err != nil {
+			return err
+		}
+	}
+	if err := WriteFileAtomic(pk.filename, data, 0600); err != nil {
+		return err
+	}
+	pk.rememberFile()
+	return nil
+}
+
+// marshal returns file contents for userinfo, encrypted if configured
+func (pk *JSONPasswordKeeper) marshal(userinfo map[string]basicauth.Account) ([]byte, error) {
+	data, err := json.MarshalIndent(userinfo, "", "    ")
+	if err != nil || pk.keys == nil {
+		return data, err
+	}
+	return encrypt(pk.keys, pk.cipher, data)
+}
+
+// CopyAccount returns account which shares no slices with a. Storages
+// keeping accounts in memory return and store copies so that callers
+// changing returned account do not change stored one.
+func CopyAccount(a basicauth.Account) basicauth.Account {
+	if a.RecoveryCodes != nil {
+		a.RecoveryCodes = append([]basicauth.RecoveryCode(nil), a.RecoveryCodes...)
+	}
+	if a.APIKeys != nil {
+		keys := make([]basicauth.APIKey, len(a.APIKeys))
+		for i, k := range a.APIKeys {
+			if k.Scopes != nil {
+				k.Scopes = append([]string(nil), k.Scopes...)
+			}
+			keys[i] = k
+		}
+		a.APIKeys = keys
+	}
+	return a
 }
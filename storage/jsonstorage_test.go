@@ -3,7 +3,11 @@ package storage
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/dmfed/basicauth"
 )
@@ -27,7 +31,7 @@ var sampleContent = []byte(fmt.Sprintf(`{
         "Lastlogin": "0001-01-01T00:00:00Z",
         "FailedLoginAttempts": 0,
         "MustChangePassword": false
-    },
+    }
 }`, testUser, testUser, testHash))
 
 func init() {
@@ -59,7 +63,7 @@ func Test_NewJSONPAsswordKeeper(t *testing.T) {
 	if _, err := pk.Get(testInvalidUser); err == nil {
 		fmt.Println("Get() invalid user produces no errors")
 	}
-	if uinfo != testUserInfo {
+	if !reflect.DeepEqual(uinfo, testUserInfo) {
 		fmt.Println("userinfo received with Get() does not match, want:", testUserInfo, "got:", uinfo)
 		t.Fail()
 	}
@@ -68,8 +72,13 @@ func Test_NewJSONPAsswordKeeper(t *testing.T) {
 		fmt.Println("failed to Upd() userinfo", err)
 		t.Fail()
 	}
+	if err = pk.Upd(uinfo); err != basicauth.ErrConflict {
+		fmt.Println("Upd() with stale version returned:", err)
+		t.Fail()
+	}
+	uinfo.Version++
 	newuinfo, err := pk.Get(testUser)
-	if uinfo != newuinfo {
+	if !reflect.DeepEqual(uinfo, newuinfo) {
 		fmt.Println("updated userinfo does not match, want:", uinfo, "got:", newuinfo)
 		t.Fail()
 	}
@@ -107,3 +116,190 @@ func Test_OpenJSONPasswordKeeper(t *testing.T) {
 	}
 	os.Remove(testFileName)
 }
+
+func Test_AtomicWrite(t *testing.T) {
+	fmt.Println("Testing atomic writes of JSONPasswordKeeper")
+	defer os.Remove(testFileName)
+	defer os.Remove(testFileName + backupSuffix)
+	pk, err := NewJSONPasswordKeeper(testFileName, WithBackup())
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed with error:", err)
+		t.FailNow()
+	}
+	pk.Put(testUserInfo)
+	// simulate crash after temporary file is written
+	renameFile = func(string, string) error { return fmt.Errorf("simulated crash") }
+	err = pk.Put(basicauth.Account{UserName: testInvalidUser})
+	renameFile = os.Rename
+	if err == nil {
+		fmt.Println("Put() did not return error when rename failed")
+		t.Fail()
+	}
+	if tmp, _ := filepath.Glob("." + testFileName + ".tmp*"); len(tmp) != 0 {
+		fmt.Println("temporary files left after failed write:", tmp)
+		t.Fail()
+	}
+	accounts, err := pk.(*JSONPasswordKeeper).readAccounts(testFileName)
+	if _, ok := accounts[testUser]; err != nil || !ok || len(accounts) != 1 {
+		fmt.Println("file damaged by failed write:", accounts, err)
+		t.Fail()
+	}
+}
+
+func Test_RecoverFromBackup(t *testing.T) {
+	fmt.Println("Testing recovery of JSONPasswordKeeper from backup")
+	defer os.Remove(testFileName)
+	defer os.Remove(testFileName + backupSuffix)
+	pk, err := NewJSONPasswordKeeper(testFileName, WithBackup())
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed with error:", err)
+		t.FailNow()
+	}
+	pk.Put(testUserInfo)
+	pk.Put(basicauth.Account{UserName: testInvalidUser})
+	// simulate partial write of the main file
+	data, _ := os.ReadFile(testFileName)
+	os.WriteFile(testFileName, data[:len(data)/2], 0600)
+	pk, err = OpenJSONPasswordKeeper(testFileName, WithBackup())
+	if err != nil {
+		fmt.Println("OpenJSONPasswordKeeper did not recover from backup:", err)
+		t.FailNow()
+	}
+	if _, err := pk.Get(testUser); err != nil {
+		fmt.Println("recovered keeper lacks user:", err)
+		t.Fail()
+	}
+	if _, err := pk.(*JSONPasswordKeeper).readAccounts(testFileName); err != nil {
+		fmt.Println("main file was not rewritten after recovery:", err)
+		t.Fail()
+	}
+	os.WriteFile(testFileName, data[:len(data)/2], 0600)
+	if _, err = OpenJSONPasswordKeeper(testFileName); err == nil {
+		fmt.Println("OpenJSONPasswordKeeper recovered from backup without WithBackup")
+		t.Fail()
+	}
+	os.Remove(testFileName)
+	if pk, err = OpenJSONPasswordKeeper(testFileName); err != nil {
+		fmt.Println("OpenJSONPasswordKeeper failed to create missing file:", err)
+		t.Fail()
+	} else if _, err := pk.Get(testUser); err == nil {
+		fmt.Println("OpenJSONPasswordKeeper restored missing file from backup without WithBackup")
+		t.Fail()
+	}
+	os.Remove(testFileName)
+	if pk, err = OpenJSONPasswordKeeper(testFileName, WithBackup()); err != nil {
+		fmt.Println("OpenJSONPasswordKeeper did not recover missing file:", err)
+		t.Fail()
+	} else if _, err := pk.Get(testUser); err != nil {
+		fmt.Println("recovered keeper lacks user:", err)
+		t.Fail()
+	}
+}
+
+func Test_WriteBehind(t *testing.T) {
+	fmt.Println("Testing write-behind mode of JSONPasswordKeeper")
+	defer os.Remove(testFileName)
+	pk, err := NewJSONPasswordKeeper(testFileName, WithWriteBehind(time.Hour, 3))
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed with error:", err)
+		t.FailNow()
+	}
+	ondisk := func() int {
+		accounts, _ := pk.(*JSONPasswordKeeper).readAccounts(testFileName)
+		return len(accounts)
+	}
+	pk.Put(basicauth.Account{UserName: "one"})
+	pk.Put(basicauth.Account{UserName: "two"})
+	if n := ondisk(); n != 0 {
+		fmt.Println("changes written before reaching max dirty, users on disk:", n)
+		t.Fail()
+	}
+	pk.Put(basicauth.Account{UserName: "three"})
+	if n := ondisk(); n != 3 {
+		fmt.Println("changes not written after reaching max dirty, users on disk:", n)
+		t.Fail()
+	}
+	pk.Del("one")
+	if err := pk.(*JSONPasswordKeeper).Sync(); err != nil || ondisk() != 2 {
+		fmt.Println("Sync() did not write pending changes:", err)
+		t.Fail()
+	}
+	pk.Del("two")
+	if err := pk.Close(); err != nil || ondisk() != 1 {
+		fmt.Println("Close() did not write pending changes:", err)
+		t.Fail()
+	}
+	// failed open must not leave background writer running
+	broken := "test_broken.json"
+	defer os.Remove(broken)
+	os.WriteFile(broken, []byte(`{"broken": `), 0600)
+	goroutines := runtime.NumGoroutine()
+	if _, err := OpenJSONPasswordKeeper(broken, WithWriteBehind(time.Hour, 0)); err == nil {
+		fmt.Println("OpenJSONPasswordKeeper of broken file returned no error")
+		t.Fail()
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		fmt.Println("goroutines left after failed open:", n-goroutines)
+		t.Fail()
+	}
+}
+
+func Test_Watch(t *testing.T) {
+	fmt.Println("Testing watch mode of JSONPasswordKeeper")
+	defer os.Remove(testFileName)
+	pk, err := NewJSONPasswordKeeper(testFileName, WithWatch(10*time.Millisecond))
+	if err != nil {
+		fmt.Println("NewJSONPasswordKeeper failed with error:", err)
+		t.FailNow()
+	}
+	defer pk.Close()
+	pk.Put(testUserInfo)
+	waitFor := func(username string) bool {
+		for i := 0; i < 100; i++ {
+			if _, err := pk.Get(username); err == nil {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	os.WriteFile(testFileName, []byte(`{"edited": {"UserName": "edited"}}`), 0600)
+	if !waitFor("edited") {
+		fmt.Println("external edit was not loaded")
+		t.Fail()
+	}
+	os.WriteFile(testFileName, []byte(`{"broken": `), 0600)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := pk.Get("edited"); err != nil {
+		fmt.Println("state was not kept after broken edit:", err)
+		t.Fail()
+	}
+	// change made right after external edit must not overwrite it
+	os.WriteFile(testFileName, []byte(`{"edited": {"UserName": "edited"}, "another": {"UserName": "another"}}`), 0600)
+	pk.Put(basicauth.Account{UserName: "mine"})
+	accounts, _ := pk.(*JSONPasswordKeeper).readAccounts(testFileName)
+	if _, ok := accounts["another"]; !ok || len(accounts) != 3 {
+		fmt.Println("external edit was overwritten:", accounts)
+		t.Fail()
+	}
+	pk.Close()
+
+	// pending changes of write-behind mode are merged with external edit
+	pk, _ = OpenJSONPasswordKeeper(testFileName, WithWatch(time.Hour), WithWriteBehind(time.Hour, 0))
+	defer pk.Close()
+	pk.Put(basicauth.Account{UserName: "pending"})
+	pk.Del("mine")
+	os.WriteFile(testFileName, []byte(`{"edited": {"UserName": "edited"}, "mine": {"UserName": "mine"}, "external": {"UserName": "external"}}`), 0600)
+	if err := pk.(*JSONPasswordKeeper).Sync(); err != nil {
+		fmt.Println("Sync() after external edit returned:", err)
+		t.Fail()
+	}
+	accounts, _ = pk.(*JSONPasswordKeeper).readAccounts(testFileName)
+	_, pending := accounts["pending"]
+	_, mine := accounts["mine"]
+	_, external := accounts["external"]
+	if !pending || mine || !external || len(accounts) != 3 {
+		fmt.Println("pending changes were not merged with external edit:", accounts)
+		t.Fail()
+	}
+}
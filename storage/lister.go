@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"sort"
+
+	"github.com/dmfed/basicauth"
+)
+
+// listAccounts returns page of accounts from in-memory map
+// selected by q. It is used by JSONPasswordKeeper and JournalStorage.
+func listAccounts(accounts map[string]basicauth.Account, q basicauth.ListQuery) ([]basicauth.Account, string) {
+	names := make([]string, 0, len(accounts))
+	for name, account := range accounts {
+		if name > q.Cursor && q.Match(account) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	limit := q.PageSize()
+	next := ""
+	if len(names) > limit {
+		names = names[:limit]
+		next = names[limit-1]
+	}
+	page := make([]basicauth.Account, len(names))
+	for i, name := range names {
+		page[i] = CopyAccount(accounts[name])
+	}
+	return page, next
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dmfed/basicauth"
+)
+
+func Test_List(t *testing.T) {
+	fmt.Println("Testing List() of storages")
+	defer os.Remove("test_list.json")
+	defer os.Remove("test_list" + snapshotSuffix)
+	defer os.Remove("test_list" + journalSuffix)
+	defer os.Remove("test_list.db")
+	defer os.Remove("test_list_sql.db")
+	jsonst, _ := NewJSONPasswordKeeper("test_list.json")
+	journalst, _ := OpenJournalStorage("test_list")
+	boltst, _ := OpenBoltStorage("test_list.db")
+	db, _ := sql.Open("sqlite3", "test_list_sql.db")
+	sqlst, _ := OpenSQLStorage(db, SQLite)
+	storages := map[string]basicauth.UserAccountStorage{"json": jsonst, "journal": journalst, "bolt": boltst, "sql": sqlst}
+	for name, st := range storages {
+		for _, u := range []string{"a3", "b1", "a1", "a4", "a2"} {
+			st.Put(basicauth.Account{UserName: u, Disabled: u == "a2" || u == "b1"})
+		}
+		var got []string
+		q := basicauth.ListQuery{Prefix: "a", Limit: 3}
+		for {
+			page, next, err := st.(basicauth.Lister).List(q)
+			if err != nil {
+				fmt.Println(name, "List() failed with error:", err)
+				t.Fail()
+				break
+			}
+			for _, acc := range page {
+				got = append(got, acc.UserName)
+			}
+			if next == "" {
+				break
+			}
+			q.Cursor = next
+		}
+		if fmt.Sprint(got) != "[a1 a2 a3 a4]" {
+			fmt.Println(name, "List() with prefix returned:", got)
+			t.Fail()
+		}
+		page, next, _ := st.(basicauth.Lister).List(basicauth.ListQuery{OnlyDisabled: true})
+		if len(page) != 2 || page[0].UserName != "a2" || page[1].UserName != "b1" || next != "" {
+			fmt.Println(name, "List() of disabled accounts returned:", page, next)
+			t.Fail()
+		}
+		st.Close()
+	}
+}
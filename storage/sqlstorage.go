@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dmfed/basicauth"
+)
+
+// Dialect selects SQL flavour used by SQLStorage
+type Dialect int
+
+const (
+	// SQLite dialect (github.com/mattn/go-sqlite3, modernc.org/sqlite)
+	SQLite Dialect = iota
+	// PostgreSQL dialect (github.com/lib/pq, github.com/jackc/pgx)
+	PostgreSQL
+)
+
+// migrations are applied in order, each one exactly once. Index in
+// the slice plus one is the schema version recorded in basicauth_migrations.
+// Never change existing migrations, append new ones instead.
+var migrations = []func(d Dialect) string{
+	func(d Dialect) string {
+		return `CREATE TABLE basicauth_accounts (
+	username              TEXT PRIMARY KEY,
+	password_hash         TEXT NOT NULL DEFAULT '',
+	date_created          ` + d.timeType() + `,
+	date_changed          ` + d.timeType() + `,
+	last_login            ` + d.timeType() + `,
+	failed_login_attempts INTEGER NOT NULL DEFAULT 0,
+	must_change_password  BOOLEAN NOT NULL DEFAULT FALSE,
+	email                 TEXT NOT NULL DEFAULT '',
+	email_verified        BOOLEAN NOT NULL DEFAULT FALSE,
+	user_info             ` + d.jsonType() + `,
+	attributes            ` + d.jsonType() + `
+)`
+	},
+	func(d Dialect) string {
+		return `ALTER TABLE basicauth_accounts ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE`
+	},
+	func(d Dialect) string {
+		return `ALTER TABLE basicauth_accounts ADD COLUMN version BIGINT NOT NULL DEFAULT 0`
+	},
+}
+
+func (d Dialect) timeType() string {
+	if d == PostgreSQL {
+		return "TIMESTAMPTZ"
+	}
+	return "TIMESTAMP"
+}
+
+func (d Dialect) jsonType() string {
+	if d == PostgreSQL {
+		return "JSONB"
+	}
+	return "TEXT"
+}
+
+// rebind replaces ? placeholders with $1, $2... for PostgreSQL
+func (d Dialect) rebind(query string) string {
+	if d != PostgreSQL {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isUniqueViolation reports whether err is caused by unique or
+// primary key constraint. Checking error text keeps the storage
+// independent of particular driver.
+func isUniqueViolation(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") || // SQLite
+		strings.Contains(msg, "23505") || strings.Contains(msg, "duplicate key value") // PostgreSQL
+}
+
+// SQLStorage keeps accounts in relational database accessed with database/sql.
+// Frequently queried fields have their own columns, UserInfo and all other
+// fields of basicauth.Account are kept in JSON columns so that new fields
+// do not require schema changes.
+// It implements basicauth.UserAccountStorage
+type SQLStorage struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// OpenSQLStorage returns storage using db and applies pending schema
+// migrations. The caller is responsible for importing database driver.
+// Close closes db.
+func OpenSQLStorage(db *sql.DB, dialect Dialect) (basicauth.UserAccountStorage, error) {
+	if db == nil {
+		return nil, fmt.Errorf("error: db is nil")
+	}
+	ss := &SQLStorage{db, dialect}
+	if err := ss.migrate(); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// migrate applies migrations not yet recorded in basicauth_migrations
+func (ss *SQLStorage) migrate() error {
+	if _, err := ss.db.Exec(`CREATE TABLE IF NOT EXISTS basicauth_migrations (
+	version    INTEGER PRIMARY KEY,
+	applied_at ` + ss.dialect.timeType() + `
+)`); err != nil {
+		return err
+	}
+	var version int
+	if err := ss.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM basicauth_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for v := version + 1; v <= len(migrations); v++ {
+		tx, err := ss.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[v-1](ss.dialect)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("storage error: migration %v failed: %w", v, err)
+		}
+		if _, err := tx.Exec(ss.dialect.rebind(`INSERT INTO basicauth_migrations (version, applied_at) VALUES (?, ?)`), v, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const accountColumns = `username, password_hash, date_created, date_changed, last_login,
+	failed_login_attempts, must_change_password, disabled, email, email_verified, user_info, attributes, version`
+
+// accountValues returns values for accountColumns
+func accountValues(account basicauth.Account) ([]interface{}, error) {
+	info, err := json.Marshal(account.User)
+	if err != nil {
+		return nil, err
+	}
+	// attributes hold everything which has no column of its own
+	rest := account
+	rest.UserName, rest.PasswordHash, rest.Email, rest.Version = "", "", "", 0
+	rest.DateCreated, rest.DateChanged, rest.Lastlogin = time.Time{}, time.Time{}, time.Time{}
+	rest.FailedLoginAttempts, rest.MustChangePassword, rest.Disabled, rest.EmailVerified = 0, false, false, false
+	rest.User = basicauth.UserInfo{}
+	attrs, err := json.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{account.UserName, account.PasswordHash, account.DateCreated.UTC(), account.DateChanged.UTC(),
+		account.Lastlogin.UTC(), account.FailedLoginAttempts, account.MustChangePassword, account.Disabled,
+		account.Email, account.EmailVerified, string(info), string(attrs), account.Version}, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAccount(row rowScanner) (basicauth.Account, error) {
+	var (
+		account     basicauth.Account
+		info, attrs sql.NullString
+	)
+	err := row.Scan(&account.UserName, &account.PasswordHash, &account.DateCreated, &account.DateChanged,
+		&account.Lastlogin, &account.FailedLoginAttempts, &account.MustChangePassword, &account.Disabled,
+		&account.Email, &account.EmailVerified, &info, &attrs, &account.Version)
+	if err == sql.ErrNoRows {
+		return account, ErrNoSuchUser
+	}
+	if err != nil {
+		return account, err
+	}
+	columns := account
+	if attrs.Valid && attrs.String != "" {
+		if err := json.Unmarshal([]byte(attrs.String), &account); err != nil {
+			return account, err
+		}
+	}
+	account.UserName, account.PasswordHash, account.Email = columns.UserName, columns.PasswordHash, columns.Email
+	account.DateCreated, account.DateChanged, account.Lastlogin = columns.DateCreated, columns.DateChanged, columns.Lastlogin
+	account.FailedLoginAttempts, account.MustChangePassword, account.EmailVerified = columns.FailedLoginAttempts, columns.MustChangePassword, columns.EmailVerified
+	account.Disabled, account.Version = columns.Disabled, columns.Version
+	if info.Valid && info.String != "" {
+		if err := json.Unmarshal([]byte(info.String), &account.User); err != nil {
+			return account, err
+		}
+	}
+	return account, nil
+}
+
+// Get returns account if username is valid
+func (ss *SQLStorage) Get(username string) (basicauth.Account, error) {
+	return ss.GetContext(context.Background(), username)
+}
+
+// GetContext is Get which aborts the query when ctx is done
+func (ss *SQLStorage) GetContext(ctx context.Context, username string) (basicauth.Account, error) {
+	row := ss.db.QueryRowContext(ctx, ss.dialect.rebind(`SELECT `+accountColumns+` FROM basicauth_accounts WHERE username = ?`), username)
+	return scanAccount(row)
+}
+
+// Put adds account to storage
+func (ss *SQLStorage) Put(account basicauth.Account) error {
+	return ss.PutContext(context.Background(), account)
+}
+
+// PutContext is Put which aborts the query when ctx is done
+func (ss *SQLStorage) PutContext(ctx context.Context, account basicauth.Account) error {
+	values, err := accountValues(account)
+	if err != nil {
+		return err
+	}
+	_, err = ss.db.ExecContext(ctx, ss.dialect.rebind(`INSERT INTO basicauth_accounts (`+accountColumns+`)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`), values...)
+	if err != nil && isUniqueViolation(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+// Upd replaces existing account with supplied one if their versions match
+func (ss *SQLStorage) Upd(account basicauth.Account) error {
+	return ss.UpdContext(context.Background(), account)
+}
+
+// UpdContext is Upd which aborts the query when ctx is done
+func (ss *SQLStorage) UpdContext(ctx context.Context, account basicauth.Account) error {
+	values, err := accountValues(account)
+	if err != nil {
+		return err
+	}
+	// values start with username and end with version, both go to WHERE
+	args := append(values[1:len(values)-1], account.UserName, account.Version)
+	res, err := ss.db.ExecContext(ctx, ss.dialect.rebind(`UPDATE basicauth_accounts SET password_hash = ?, date_created = ?,
+	date_changed = ?, last_login = ?, failed_login_attempts = ?, must_change_password = ?, disabled = ?, email = ?,
+	email_verified = ?, user_info = ?, attributes = ?, version = version + 1 WHERE username = ? AND version = ?`), args...)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(res); err != ErrNoSuchUser {
+		return err
+	}
+	// tell missing account from changed one
+	var version int64
+	err = ss.db.QueryRowContext(ctx, ss.dialect.rebind(`SELECT version FROM basicauth_accounts WHERE username = ?`), account.UserName).Scan(&version)
+	if err == sql.ErrNoRows {
+		return ErrNoSuchUser
+	}
+	if err != nil {
+		return err
+	}
+	return basicauth.ErrConflict
+}
+
+// List implements basicauth.Lister
+func (ss *SQLStorage) List(q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	return ss.ListContext(context.Background(), q)
+}
+
+// ListContext implements basicauth.ContextLister
+func (ss *SQLStorage) ListContext(ctx context.Context, q basicauth.ListQuery) ([]basicauth.Account, string, error) {
+	query := `SELECT ` + accountColumns + ` FROM basicauth_accounts WHERE username > ?`
+	args := []interface{}{q.Cursor}
+	if q.Prefix != "" {
+		// not using LIKE as it ignores case in SQLite
+		query += ` AND SUBSTR(username, 1, ?) = ?`
+		args = append(args, utf8.RuneCountInString(q.Prefix), q.Prefix)
+	}
+	if q.OnlyDisabled {
+		query += ` AND disabled = ?`
+		args = append(args, true)
+	}
+	if q.OnlyMustChangePassword {
+		query += ` AND must_change_password = ?`
+		args = append(args, true)
+	}
+	if !q.LastLoginBefore.IsZero() {
+		query += ` AND last_login < ?`
+		args = append(args, q.LastLoginBefore.UTC())
+	}
+	limit := q.PageSize()
+	query += ` ORDER BY username LIMIT ?`
+	args = append(args, limit+1)
+	rows, err := ss.db.QueryContext(ctx, ss.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	var accounts []basicauth.Account
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(accounts) > limit {
+		accounts = accounts[:limit]
+		next = accounts[limit-1].UserName
+	}
+	return accounts, next, nil
+}
+
+// Del deletes account if username is valid
+func (ss *SQLStorage) Del(username string) error {
+	return ss.DelContext(context.Background(), username)
+}
+
+// DelContext is Del which aborts the query when ctx is done
+func (ss *SQLStorage) DelContext(ctx context.Context, username string) error {
+	res, err := ss.db.ExecContext(ctx, ss.dialect.rebind(`DELETE FROM basicauth_accounts WHERE username = ?`), username)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res)
+}
+
+func expectOneRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoSuchUser
+	}
+	return nil
+}
+
+// Close closes underlying database
+func (ss *SQLStorage) Close() error {
+	return ss.db.Close()
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func Test_SQLStorage(t *testing.T) {
+	fmt.Println("Testing SQLStorage on SQLite")
+	filename := "test_sql.db"
+	defer os.Remove(filename)
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		fmt.Println("sql.Open failed with error:", err)
+		t.FailNow()
+	}
+	st, err := OpenSQLStorage(db, SQLite)
+	if err != nil {
+		fmt.Println("OpenSQLStorage failed with error:", err)
+		t.FailNow()
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	account := basicauth.Account{
+		UserName:     testUser,
+		PasswordHash: testHash,
+		DateCreated:  now,
+		DateChanged:  now,
+		Email:        "jimi@example.com",
+		TOTPSecret:   "SECRET",
+		User:         basicauth.UserInfo{Name: "Jimi", Lastname: "Hendrix"},
+		APIKeys:      []basicauth.APIKey{{ID: "key1", Scopes: []string{"read"}}},
+	}
+	if err := st.Put(account); err != nil {
+		fmt.Println("Put() failed with error:", err)
+		t.Fail()
+	}
+	if err := st.Put(account); err != ErrUserExists {
+		fmt.Println("Put() with existing user returned:", err)
+		t.Fail()
+	}
+	got, err := st.Get(testUser)
+	if err != nil || !reflect.DeepEqual(got, account) {
+		fmt.Println("Get() want:", account, "got:", got, err)
+		t.Fail()
+	}
+	if _, err := st.Get(testInvalidUser); err != ErrNoSuchUser {
+		fmt.Println("Get() of non-existing user returned:", err)
+		t.Fail()
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := st.(basicauth.ContextStorage).GetContext(canceled, testUser); !errors.Is(err, context.Canceled) {
+		fmt.Println("GetContext() with canceled context returned:", err)
+		t.Fail()
+	}
+	account.FailedLoginAttempts = 3
+	if err := st.Upd(account); err != nil {
+		fmt.Println("Upd() failed with error:", err)
+		t.Fail()
+	}
+	if err := st.Upd(account); err != basicauth.ErrConflict {
+		fmt.Println("Upd() with stale version returned:", err)
+		t.Fail()
+	}
+	if got, _ := st.Get(account.UserName); got.Version != account.Version+1 || got.FailedLoginAttempts != 3 {
+		fmt.Println("Upd() did not increment version:", got.Version)
+		t.Fail()
+	}
+	if err := st.Upd(basicauth.Account{UserName: testInvalidUser}); err != ErrNoSuchUser {
+		fmt.Println("Upd() of non-existing user returned:", err)
+		t.Fail()
+	}
+	st.Close()
+
+	// migrations must not be applied twice
+	db, _ = sql.Open("sqlite3", filename)
+	st, err = OpenSQLStorage(db, SQLite)
+	if err != nil {
+		fmt.Println("reopening SQLStorage failed with error:", err)
+		t.FailNow()
+	}
+	defer st.Close()
+	if got, _ := st.Get(testUser); got.FailedLoginAttempts != 3 {
+		fmt.Println("updated account was not stored:", got)
+		t.Fail()
+	}
+	if err := st.Del(testUser); err != nil {
+		fmt.Println("Del() failed with error:", err)
+		t.Fail()
+	}
+	if err := st.Del(testUser); err != ErrNoSuchUser {
+		fmt.Println("Del() of deleted user returned:", err)
+		t.Fail()
+	}
+}
+
+func Test_DialectRebind(t *testing.T) {
+	if q := PostgreSQL.rebind("a = ? AND b = ?"); q != "a = $1 AND b = $2" {
+		fmt.Println("rebind for PostgreSQL returned:", q)
+		t.Fail()
+	}
+}
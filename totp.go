@@ -0,0 +1,271 @@
+package basicauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTOTPRequired is returned by Login when user has two-factor authentication
+	// enabled. Login must be completed with LoginTOTP.
+	ErrTOTPRequired = errors.New("auth error: one-time code is required to complete login")
+	// ErrInvalidTOTPCode is returned when one-time code does not check out or was already used
+	ErrInvalidTOTPCode = errors.New("auth error: invalid one-time code")
+	// ErrTOTPNotEnabled is returned when trying to use TOTP for user who has not enrolled
+	ErrTOTPNotEnabled = errors.New("auth error: two-factor authentication is not enabled for user")
+	// ErrTOTPAlreadyEnabled is returned when trying to enroll user who already has TOTP enabled
+	ErrTOTPAlreadyEnabled = errors.New("auth error: two-factor authentication is already enabled for user")
+)
+
+const (
+	totpDigits     = 6
+	totpPeriod     = 30 // seconds
+	totpSkew       = 1  // number of periods accepted before and after current one
+	totpSecretSize = 20
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns new random base32 encoded secret
+// suitable for use with TOTPCode.
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPCode returns one-time code for base32 encoded secret at time t
+// as defined by RFC 6238 (HMAC-SHA1, 6 digits, 30 seconds period).
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, totpStep(t)), nil
+}
+
+// TOTPProvisioningURI returns otpauth:// URI which can be rendered as QR code
+// and scanned by authenticator apps.
+func TOTPProvisioningURI(issuer, username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + username,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return totpEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// hotp implements RFC 4226 HOTP with dynamic truncation
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// validateTOTP checks code against secret at time t. Codes from steps
+// not later than laststep are rejected to prevent replay. Returns
+// the step matching the code.
+func validateTOTP(secret, code string, t time.Time, laststep int64) (int64, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return 0, err
+	}
+	current := totpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= laststep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) == 1 {
+			return step, nil
+		}
+	}
+	return 0, ErrInvalidTOTPCode
+}
+
+// EnrollTOTP generates new TOTP secret for user and returns otpauth:// URI to
+// be passed to authenticator app. Two-factor authentication is not enabled until
+// user confirms enrollment with ConfirmTOTP.
+func (app *appinterface) EnrollTOTP(username, password string) (uri string, err error) {
+	err = retryOnConflict(func() error {
+		uri, err = app.enrollTOTP(username, password)
+		return err
+	})
+	return uri, err
+}
+
+func (app *appinterface) enrollTOTP(username, password string) (string, error) {
+	account, err := app.Get(username)
+	if err != nil {
+		return "", err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return "", ErrInvalidPassword
+	}
+	if account.TOTPConfirmed {
+		return "", ErrTOTPAlreadyEnabled
+	}
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	account.TOTPSecret = secret
+	account.TOTPLastStep = 0
+	account.DateChanged = app.opts.now()
+	if err := app.Upd(account); err != nil {
+		return "", err
+	}
+	return TOTPProvisioningURI(app.opts.totpIssuer, account.UserName, secret), nil
+}
+
+// ConfirmTOTP checks code generated with secret issued by EnrollTOTP and
+// enables two-factor authentication for user if the code checks out.
+func (app *appinterface) ConfirmTOTP(username, password, code string) error {
+	return retryOnConflict(func() error { return app.confirmTOTP(username, password, code) })
+}
+
+func (app *appinterface) confirmTOTP(username, password, code string) error {
+	account, err := app.Get(username)
+	if err != nil {
+		return err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return ErrInvalidPassword
+	}
+	if account.TOTPSecret == "" {
+		return ErrTOTPNotEnabled
+	}
+	if account.TOTPConfirmed {
+		return ErrTOTPAlreadyEnabled
+	}
+	step, err := validateTOTP(account.TOTPSecret, code, app.opts.now(), account.TOTPLastStep)
+	if err != nil {
+		return ErrInvalidTOTPCode
+	}
+	account.TOTPConfirmed = true
+	account.TOTPLastStep = step
+	account.DateChanged = app.opts.now()
+	return app.Upd(account)
+}
+
+// DisableTOTP turns off two-factor authentication for user. Both current
+// password and valid one-time code are required.
+func (app *appinterface) DisableTOTP(username, password, code string) error {
+	return retryOnConflict(func() error { return app.disableTOTP(username, password, code) })
+}
+
+func (app *appinterface) disableTOTP(username, password, code string) error {
+	account, err := app.Get(username)
+	if err != nil {
+		return err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return ErrInvalidPassword
+	}
+	if !account.TOTPConfirmed {
+		return ErrTOTPNotEnabled
+	}
+	if _, err := validateTOTP(account.TOTPSecret, code, app.opts.now(), account.TOTPLastStep); err != nil {
+		return ErrInvalidTOTPCode
+	}
+	account.TOTPSecret = ""
+	account.TOTPConfirmed = false
+	account.TOTPLastStep = 0
+	account.RecoveryCodes = nil
+	account.DateChanged = app.opts.now()
+	return app.Upd(account)
+}
+
+// CheckUserTOTP returns nil if password and one-time code of user check out.
+// Each code is accepted only once. Recovery codes are not accepted, they
+// can only be used to complete login with LoginTOTP.
+func (app *appinterface) CheckUserTOTP(username, password, code string) error {
+	err := retryOnConflict(func() error { return app.checkUserTOTP(username, password, code) })
+	app.opts.emit(EventLogin, SourceApp, username, err)
+	return err
+}
+
+func (app *appinterface) checkUserTOTP(username, password, code string) error {
+	account, err := app.Get(username)
+	if err != nil {
+		return err
+	}
+	if app.lockedOut(account) {
+		return ErrAccountLocked
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return app.loginFailed(account, ErrInvalidPassword)
+	}
+	return app.checkTOTPCode(account, code, false)
+}
+
+// checkSecondFactor checks one-time code or unused recovery code of user
+// who has already passed password check and holds pending token of LoginTOTP.
+func (app *appinterface) checkSecondFactor(username, code string) error {
+	err := retryOnConflict(func() error {
+		account, err := app.Get(username)
+		if err != nil {
+			return err
+		}
+		return app.checkTOTPCode(account, code, true)
+	})
+	app.opts.emit(EventLogin, SourceApp, username, err)
+	return err
+}
+
+// checkTOTPCode checks one-time code of account. Recovery codes are only
+// tried if recovery is true. Failed codes count towards WithLockout limit,
+// which is reset after the code checks out.
+func (app *appinterface) checkTOTPCode(account Account, code string, recovery bool) error {
+	if !account.TOTPConfirmed {
+		return ErrTOTPNotEnabled
+	}
+	if app.lockedOut(account) {
+		return ErrAccountLocked
+	}
+	step, err := validateTOTP(account.TOTPSecret, code, app.opts.now(), account.TOTPLastStep)
+	if err == nil {
+		account.TOTPLastStep = step
+	} else if !recovery || !app.useRecoveryCode(&account, code) {
+		return app.loginFailed(account, ErrInvalidTOTPCode)
+	}
+	if app.opts.lockout > 0 {
+		account.FailedLoginAttempts = 0
+	}
+	return app.Upd(account)
+}
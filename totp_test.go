@@ -0,0 +1,38 @@
+package basicauth
+
+import (
+	"encoding/base32"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	fmt.Println("Testing TOTP codes against RFC 6238 vectors...")
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		code, err := TOTPCode(secret, time.Unix(unix, 0))
+		if err != nil || code != want {
+			fmt.Println("TOTPCode at", unix, "want:", want, "got:", code, err)
+			t.Fail()
+		}
+	}
+	now := time.Unix(1234567890, 0)
+	code, _ := TOTPCode(secret, now)
+	step, err := validateTOTP(secret, code, now.Add(time.Second*totpPeriod), 0)
+	if err != nil {
+		fmt.Println("validateTOTP rejected code from previous period:", err)
+		t.Fail()
+	}
+	if _, err := validateTOTP(secret, code, now, step); err == nil {
+		fmt.Println("validateTOTP accepted replayed code")
+		t.Fail()
+	}
+}
@@ -0,0 +1,219 @@
+package basicauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrInvalidUsername is matched (with errors.Is) by all errors
+// returned when username is rejected by UsernamePolicy.
+var ErrInvalidUsername = errors.New("auth error: invalid username")
+
+// UsernameError is returned when username is rejected by UsernamePolicy.
+type UsernameError struct {
+	UserName string
+	Reason   string
+}
+
+func (e *UsernameError) Error() string {
+	return fmt.Sprintf("auth error: invalid username %q: %v", e.UserName, e.Reason)
+}
+
+// Is makes errors.Is(err, ErrInvalidUsername) true for UsernameError.
+func (e *UsernameError) Is(target error) bool {
+	return target == ErrInvalidUsername
+}
+
+// UsernameNormalization selects Unicode normalization applied to usernames.
+type UsernameNormalization int
+
+const (
+	// NormalizeNone leaves username as is
+	NormalizeNone UsernameNormalization = iota
+	// NormalizeNFKC applies Unicode NFKC normalization which maps
+	// compatibility characters (such as fullwidth letters) to their
+	// canonical counterparts.
+	NormalizeNFKC
+	// NormalizePRECIS applies PRECIS UsernameCasePreserved profile
+	// (RFC 8265) or UsernameCaseMapped if FoldCase is set.
+	NormalizePRECIS
+)
+
+// UsernamePolicy defines how usernames are normalized and validated.
+// It is applied to every username entering AppInterface, AdminInterface,
+// LoginInterface and storages wrapped with NewPolicyStorage. Zero value
+// of UsernamePolicy only rejects empty usernames, whitespace and control
+// characters.
+type UsernamePolicy struct {
+	// FoldCase makes "Joe" and "joe" the same user
+	FoldCase bool
+	// Normalization is Unicode normalization applied before checks
+	Normalization UsernameNormalization
+	// MinLength and MaxLength limit number of characters (runes)
+	// in username. Zero means no limit.
+	MinLength int
+	MaxLength int
+	// Allowed reports whether rune may appear in username. If nil
+	// any rune except whitespace and control characters is allowed.
+	Allowed func(r rune) bool
+	// Reserved usernames are rejected. Comparison is done after
+	// normalization and is case insensitive.
+	Reserved []string
+}
+
+// DefaultUsernamePolicy returns policy folding case, applying NFKC normalization
+// and allowing letters, digits and ".", "_", "-", "@" in usernames of 1 to 64
+// characters. Common administrative names are reserved.
+func DefaultUsernamePolicy() *UsernamePolicy {
+	return &UsernamePolicy{
+		FoldCase:      true,
+		Normalization: NormalizeNFKC,
+		MinLength:     1,
+		MaxLength:     64,
+		Allowed: func(r rune) bool {
+			return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-@", r)
+		},
+		Reserved: []string{"admin", "administrator", "root", "system"},
+	}
+}
+
+// Apply returns normalized username or *UsernameError if username
+// does not conform to the policy.
+func (p *UsernamePolicy) Apply(username string) (string, error) {
+	if p == nil {
+		return username, nil
+	}
+	reject := func(reason string) (string, error) {
+		return "", &UsernameError{UserName: username, Reason: reason}
+	}
+	if !utf8.ValidString(username) {
+		return reject("not a valid UTF-8 string")
+	}
+	name, err := p.normalize(username)
+	if err != nil {
+		return reject(err.Error())
+	}
+	if name == "" {
+		return reject("username is empty")
+	}
+	length := utf8.RuneCountInString(name)
+	if p.MinLength > 0 && length < p.MinLength {
+		return reject(fmt.Sprintf("shorter than %v characters", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return reject(fmt.Sprintf("longer than %v characters", p.MaxLength))
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return reject("contains control characters")
+		}
+		if p.Allowed == nil && unicode.IsSpace(r) {
+			return reject("contains whitespace")
+		}
+		if p.Allowed != nil && !p.Allowed(r) {
+			return reject(fmt.Sprintf("character %q is not allowed", r))
+		}
+	}
+	for _, reserved := range p.Reserved {
+		if strings.EqualFold(name, reserved) {
+			return reject("username is reserved")
+		}
+	}
+	return name, nil
+}
+
+// normalize applies Unicode normalization and case folding of p to name
+func (p *UsernamePolicy) normalize(name string) (string, error) {
+	switch p.Normalization {
+	case NormalizeNFKC:
+		name = norm.NFKC.String(name)
+	case NormalizePRECIS:
+		profile := precis.UsernameCasePreserved
+		if p.FoldCase {
+			profile = precis.UsernameCaseMapped
+		}
+		var err error
+		if name, err = profile.String(name); err != nil {
+			return "", err
+		}
+	}
+	if p.FoldCase {
+		name = strings.ToLower(name)
+	}
+	return name, nil
+}
+
+// policyStorage applies UsernamePolicy to usernames
+// before passing them to underlying storage
+type policyStorage struct {
+	UserAccountStorage
+	policy *UsernamePolicy
+}
+
+// NewPolicyStorage returns UserAccountStorage which normalizes and validates
+// usernames with policy before passing calls to st.
+func NewPolicyStorage(st UserAccountStorage, policy *UsernamePolicy) UserAccountStorage {
+	if policy == nil {
+		return st
+	}
+	return &policyStorage{st, policy}
+}
+
+// GetContext, PutContext, DelContext and UpdContext apply policy and pass
+// ctx to underlying storage (see StorageWithContext)
+func (ps *policyStorage) GetContext(ctx context.Context, username string) (Account, error) {
+	return ps.bind(ctx).Get(username)
+}
+
+func (ps *policyStorage) PutContext(ctx context.Context, account Account) error {
+	return ps.bind(ctx).Put(account)
+}
+
+func (ps *policyStorage) DelContext(ctx context.Context, username string) error {
+	return ps.bind(ctx).Del(username)
+}
+
+func (ps *policyStorage) UpdContext(ctx context.Context, account Account) error {
+	return ps.bind(ctx).Upd(account)
+}
+
+func (ps *policyStorage) bind(ctx context.Context) *policyStorage {
+	return &policyStorage{StorageWithContext(ctx, ps.UserAccountStorage), ps.policy}
+}
+
+func (ps *policyStorage) Get(username string) (Account, error) {
+	name, err := ps.policy.Apply(username)
+	if err != nil {
+		return Account{}, err
+	}
+	return ps.UserAccountStorage.Get(name)
+}
+
+func (ps *policyStorage) Put(account Account) (err error) {
+	if account.UserName, err = ps.policy.Apply(account.UserName); err != nil {
+		return err
+	}
+	return ps.UserAccountStorage.Put(account)
+}
+
+func (ps *policyStorage) Del(username string) error {
+	name, err := ps.policy.Apply(username)
+	if err != nil {
+		return err
+	}
+	return ps.UserAccountStorage.Del(name)
+}
+
+func (ps *policyStorage) Upd(account Account) (err error) {
+	if account.UserName, err = ps.policy.Apply(account.UserName); err != nil {
+		return err
+	}
+	return ps.UserAccountStorage.Upd(account)
+}
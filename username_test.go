@@ -0,0 +1,61 @@
+package basicauth
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestUsernamePolicy(t *testing.T) {
+	fmt.Println("Testing UsernamePolicy...")
+	p := DefaultUsernamePolicy()
+	valid := map[string]string{
+		"Joe":              "joe",
+		"ｊｏｅ":              "joe",
+		"joe.doe@mail.org": "joe.doe@mail.org",
+	}
+	for in, want := range valid {
+		if got, err := p.Apply(in); err != nil || got != want {
+			fmt.Println("Apply", in, "want:", want, "got:", got, err)
+			t.Fail()
+		}
+	}
+	for _, in := range []string{"", "jo e", "joe\x07", "Admin", "joe!"} {
+		if _, err := p.Apply(in); !errors.Is(err, ErrInvalidUsername) {
+			fmt.Printf("Apply %q returned: %v\n", in, err)
+			t.Fail()
+		}
+	}
+	precis := &UsernamePolicy{FoldCase: true, Normalization: NormalizePRECIS}
+	if got, err := precis.Apply("ＪＯＥ"); err != nil || got != "joe" {
+		fmt.Println("Apply with PRECIS want: joe got:", got, err)
+		t.Fail()
+	}
+	var nilpolicy *UsernamePolicy
+	if got, _ := nilpolicy.Apply("Jo e"); got != "Jo e" {
+		fmt.Println("nil policy changed username:", got)
+		t.Fail()
+	}
+}
+
+// queryRecorder is a Lister which remembers the last query
+type queryRecorder struct {
+	UserAccountStorage
+	q ListQuery
+}
+
+func (qr *queryRecorder) List(q ListQuery) ([]Account, string, error) {
+	qr.q = q
+	return nil, "", nil
+}
+
+func TestPolicyStorageList(t *testing.T) {
+	fmt.Println("Testing List of policy storage...")
+	rec := &queryRecorder{}
+	st := NewPolicyStorage(rec, DefaultUsernamePolicy())
+	st.(Lister).List(ListQuery{Prefix: "ＪＯ", Cursor: "Joe"})
+	if rec.q.Prefix != "jo" || rec.q.Cursor != "joe" {
+		fmt.Println("List got query:", rec.q)
+		t.Fail()
+	}
+}
@@ -0,0 +1,136 @@
+package basicauth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	// ErrEmailNotVerified is returned when login requires verified email and user has not confirmed it
+	ErrEmailNotVerified = errors.New("auth error: email address is not verified")
+	// ErrInvalidVerificationCode is returned when verification code does not check out or has expired
+	ErrInvalidVerificationCode = errors.New("auth error: invalid or expired verification code")
+	// ErrNoEmail is returned when requesting verification for user without email address
+	ErrNoEmail = errors.New("auth error: user has no email address")
+	// ErrNoNotifier is returned when verification code can not be sent because no Notifier is configured
+	ErrNoNotifier = errors.New("auth error: no notifier configured")
+)
+
+const (
+	verificationCodeDigits      = 6
+	verificationCodeTTL         = time.Hour * 24
+	verificationCodeMaxAttempts = 5
+)
+
+// generateNumericCode returns random string of decimal digits
+func generateNumericCode(digits int) (string, error) {
+	max := big.NewInt(1)
+	max.Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
+
+// SetUserEmail sets user's email address. The address is considered
+// unverified until user confirms it with ConfirmEmail.
+func (app *appinterface) SetUserEmail(username, password, email string) error {
+	return retryOnConflict(func() error { return app.setUserEmail(username, password, email) })
+}
+
+func (app *appinterface) setUserEmail(username, password, email string) error {
+	account, err := app.Get(username)
+	if err != nil {
+		return err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return ErrInvalidPassword
+	}
+	account.Email = email
+	account.EmailVerified = false
+	account.EmailVerifiedAt = time.Time{}
+	clearVerificationCode(&account)
+	account.DateChanged = app.opts.now()
+	return app.Upd(account)
+}
+
+// RequestEmailVerification issues a new verification code for user's email
+// and sends it with configured Notifier. Any previously issued code is discarded.
+func (app *appinterface) RequestEmailVerification(username, password string) error {
+	return retryOnConflict(func() error { return app.requestEmailVerification(username, password) })
+}
+
+func (app *appinterface) requestEmailVerification(username, password string) error {
+	if app.opts.notifier == nil {
+		return ErrNoNotifier
+	}
+	account, err := app.Get(username)
+	if err != nil {
+		return err
+	}
+	if err := app.CompareUserPasswordWithHash(account.PasswordHash, password); err != nil {
+		return ErrInvalidPassword
+	}
+	if account.Email == "" {
+		return ErrNoEmail
+	}
+	code, err := generateNumericCode(verificationCodeDigits)
+	if err != nil {
+		return err
+	}
+	hash, err := app.HashPassword(code)
+	if err != nil {
+		return err
+	}
+	account.VerificationCodeHash = hash
+	account.VerificationCodeExpires = app.opts.now().Add(verificationCodeTTL)
+	account.VerificationAttempts = 0
+	if err := app.Upd(account); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("Hello, %v!\n\nYour verification code is: %v\nThe code is valid until %v.",
+		account.UserName, code, account.VerificationCodeExpires.Format(time.RFC1123))
+	return app.opts.notifier.Notify(account.Email, "Verify your email address", message)
+}
+
+// ConfirmEmail checks verification code issued with RequestEmailVerification
+// and marks user's email as verified if the code checks out.
+func (app *appinterface) ConfirmEmail(username, code string) error {
+	return retryOnConflict(func() error { return app.confirmEmail(username, code) })
+}
+
+func (app *appinterface) confirmEmail(username, code string) error {
+	account, err := app.Get(username)
+	if err != nil {
+		return err
+	}
+	if account.VerificationCodeHash == "" || app.opts.now().After(account.VerificationCodeExpires) {
+		return ErrInvalidVerificationCode
+	}
+	if err := app.CompareUserPasswordWithHash(account.VerificationCodeHash, code); err != nil {
+		account.VerificationAttempts++
+		if account.VerificationAttempts >= verificationCodeMaxAttempts {
+			clearVerificationCode(&account)
+		}
+		if e := app.Upd(account); e != nil {
+			return e
+		}
+		return ErrInvalidVerificationCode
+	}
+	t := app.opts.now()
+	account.EmailVerified = true
+	account.EmailVerifiedAt = t
+	account.DateChanged = t
+	clearVerificationCode(&account)
+	return app.Upd(account)
+}
+
+func clearVerificationCode(account *Account) {
+	account.VerificationCodeHash = ""
+	account.VerificationCodeExpires = time.Time{}
+	account.VerificationAttempts = 0
+}
@@ -0,0 +1,487 @@
+// Package webhook delivers basicauth events to HTTP endpoints.
+//
+// Dispatcher is a basicauth.EventSink. Every event is put into persistent
+// outbox and POSTed as JSON to configured endpoints. Requests are signed
+// with HMAC-SHA256 of timestamp and body using per-endpoint secret (see
+// Sign and VerifySignature). Failed deliveries are retried with exponential
+// backoff and moved to dead letters after the last attempt.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dmfed/basicauth"
+	"github.com/dmfed/basicauth/storage"
+)
+
+// Headers of webhook requests
+const (
+	HeaderDelivery  = "X-Basicauth-Delivery"
+	HeaderTimestamp = "X-Basicauth-Timestamp"
+	HeaderSignature = "X-Basicauth-Signature"
+)
+
+const (
+	defaultMaxAttempts   = 8
+	defaultBackoff       = time.Second
+	defaultMaxBackoff    = time.Hour
+	defaultTimeout       = time.Second * 10
+	defaultMaxDeliveries = 10000
+)
+
+// DefaultEvents are delivered to endpoints which do not list Events
+var DefaultEvents = []basicauth.EventType{basicauth.EventUserDeleted, basicauth.EventPasswordChanged, basicauth.EventPasswordReset}
+
+var (
+	// ErrNoSuchDelivery is returned when dead letter with given ID does not exist
+	ErrNoSuchDelivery = errors.New("webhook error: no such delivery")
+	// ErrBadSignature is returned by VerifySignature
+	ErrBadSignature = errors.New("webhook error: invalid signature")
+	// ErrStaleTimestamp is returned by VerifySignature for old or future requests
+	ErrStaleTimestamp = errors.New("webhook error: timestamp out of tolerance")
+)
+
+// Endpoint is a receiver of events. Events limits delivered event
+// types, empty Events means DefaultEvents.
+type Endpoint struct {
+	URL    string
+	Secret string
+	Events []basicauth.EventType
+}
+
+func (ep Endpoint) wants(t basicauth.EventType) bool {
+	events := ep.Events
+	if len(events) == 0 {
+		events = DefaultEvents
+	}
+	for _, et := range events {
+		if et == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload is JSON body of webhook request. ID is the same for all
+// attempts of a delivery, receivers use it to drop duplicates.
+type Payload struct {
+	ID    string
+	Event basicauth.Event
+}
+
+// Delivery is an event waiting to be delivered to endpoint URL
+// or a dead letter
+type Delivery struct {
+	ID          string
+	URL         string
+	Event       basicauth.Event
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+}
+
+type outbox struct {
+	Pending []Delivery
+	Dead    []Delivery
+}
+
+// Option configures Dispatcher
+type Option func(*Dispatcher)
+
+// WithBackoff sets delay before the first retry and maximum delay.
+// The delay doubles after every failed attempt.
+func WithBackoff(base, max time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.backoff, d.maxBackoff = base, max
+	}
+}
+
+// WithMaxAttempts sets number of attempts after which
+// delivery is moved to dead letters
+func WithMaxAttempts(n int) Option {
+	return func(d *Dispatcher) {
+		d.maxAttempts = n
+	}
+}
+
+// WithMaxDeliveries limits number of deliveries kept in outbox, pending
+// ones and dead letters together. When outbox is full the oldest dead
+// letters are discarded to make room. If all deliveries are pending new
+// events are dropped and the error is logged.
+func WithMaxDeliveries(n int) Option {
+	return func(d *Dispatcher) {
+		d.maxDeliveries = n
+	}
+}
+
+// WithHTTPClient replaces default client which gives up
+// on requests taking longer than 10 seconds
+func WithHTTPClient(c *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = c
+	}
+}
+
+// Dispatcher delivers events to endpoints in background
+type Dispatcher struct {
+	filename      string
+	endpoints     map[string]Endpoint
+	box           outbox
+	client        *http.Client
+	backoff       time.Duration
+	maxBackoff    time.Duration
+	maxAttempts   int
+	maxDeliveries int
+	now           func() time.Time
+	wake          chan struct{}
+	stop          chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
+	mutex         sync.Mutex
+}
+
+// OpenDispatcher opens (or creates) outbox kept in filename and starts
+// delivering pending events to endpoints. Pending deliveries to URLs
+// which are no longer configured are moved to dead letters.
+func OpenDispatcher(filename string, endpoints []Endpoint, opts ...Option) (*Dispatcher, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("empty filename provided. will do nothing")
+	}
+	d := &Dispatcher{
+		filename:      filename,
+		endpoints:     make(map[string]Endpoint),
+		client:        &http.Client{Timeout: defaultTimeout},
+		backoff:       defaultBackoff,
+		maxBackoff:    defaultMaxBackoff,
+		maxAttempts:   defaultMaxAttempts,
+		maxDeliveries: defaultMaxDeliveries,
+		now:           time.Now,
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, ep := range endpoints {
+		d.endpoints[ep.URL] = ep
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(d)
+		}
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &d.box); err != nil {
+			return nil, fmt.Errorf("webhook error: could not read outbox %v: %w", filename, err)
+		}
+	}
+	pending := d.box.Pending[:0]
+	for _, dl := range d.box.Pending {
+		if _, ok := d.endpoints[dl.URL]; ok {
+			pending = append(pending, dl)
+			continue
+		}
+		dl.LastError = "endpoint is not configured"
+		d.box.Dead = append(d.box.Dead, dl)
+	}
+	d.box.Pending = pending
+	if err := d.save(); err != nil {
+		return nil, err
+	}
+	go d.run()
+	return d, nil
+}
+
+// Emit puts event into outbox for every endpoint which wants it. Outbox
+// is written to disk before Emit returns, so that event survives restart,
+// which delays the action which caused the event. Use Endpoint.Events to
+// keep frequent events such as logins out of outbox.
+func (d *Dispatcher) Emit(e basicauth.Event) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	queued := false
+	for _, ep := range d.endpoints {
+		if !ep.wants(e.Type) {
+			continue
+		}
+		if !d.makeRoom() {
+			log.Printf("webhook: outbox %v is full, dropping event %v of %v for %v", d.filename, e.Type, e.UserName, ep.URL)
+			continue
+		}
+		d.box.Pending = append(d.box.Pending, Delivery{ID: newID(), URL: ep.URL, Event: e, NextAttempt: d.now()})
+		queued = true
+	}
+	if !queued {
+		return
+	}
+	if err := d.save(); err != nil {
+		log.Printf("webhook: error saving outbox %v: %v", d.filename, err)
+	}
+	d.notify()
+}
+
+// Pending returns deliveries waiting in outbox
+func (d *Dispatcher) Pending() []Delivery {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]Delivery(nil), d.box.Pending...)
+}
+
+// DeadLetters returns deliveries which failed all attempts
+func (d *Dispatcher) DeadLetters() []Delivery {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]Delivery(nil), d.box.Dead...)
+}
+
+// Retry moves dead letter back to outbox resetting its attempts
+func (d *Dispatcher) Retry(id string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	dl, ok := d.takeDead(id)
+	if !ok {
+		return ErrNoSuchDelivery
+	}
+	if _, ok := d.endpoints[dl.URL]; !ok {
+		d.box.Dead = append(d.box.Dead, dl)
+		return fmt.Errorf("webhook error: endpoint %v is not configured", dl.URL)
+	}
+	dl.Attempts, dl.NextAttempt = 0, d.now()
+	d.box.Pending = append(d.box.Pending, dl)
+	d.notify()
+	return d.save()
+}
+
+// Discard removes dead letter
+func (d *Dispatcher) Discard(id string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.takeDead(id); !ok {
+		return ErrNoSuchDelivery
+	}
+	return d.save()
+}
+
+// Close stops delivery. Pending events stay in outbox
+// and are delivered after the outbox is opened again.
+func (d *Dispatcher) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		<-d.done
+	})
+	return nil
+}
+
+// makeRoom discards the oldest dead letters if outbox is full and reports
+// whether another delivery fits in. Must be called with mutex held.
+func (d *Dispatcher) makeRoom() bool {
+	for len(d.box.Pending)+len(d.box.Dead) >= d.maxDeliveries {
+		if len(d.box.Dead) == 0 {
+			return false
+		}
+		log.Printf("webhook: outbox %v is full, discarding dead letter %v to %v", d.filename, d.box.Dead[0].ID, d.box.Dead[0].URL)
+		d.box.Dead = append(d.box.Dead[:0], d.box.Dead[1:]...)
+	}
+	return true
+}
+
+func (d *Dispatcher) takeDead(id string) (Delivery, bool) {
+	for i, dl := range d.box.Dead {
+		if dl.ID == id {
+			d.box.Dead = append(d.box.Dead[:i], d.box.Dead[i+1:]...)
+			return dl, true
+		}
+	}
+	return Delivery{}, false
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save writes outbox to disk. Must be called with mutex held.
+func (d *Dispatcher) save() error {
+	data, err := json.Marshal(d.box)
+	if err != nil {
+		return err
+	}
+	return storage.WriteFileAtomic(d.filename, data, 0600)
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-d.wake:
+		case <-d.stop:
+			return
+		}
+		next := d.deliverDue()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(next.Sub(d.now()))
+		}
+	}
+}
+
+// deliverDue attempts all due deliveries and returns time
+// of the earliest pending one (zero if outbox is empty)
+func (d *Dispatcher) deliverDue() time.Time {
+	d.mutex.Lock()
+	var due []Delivery
+	for _, dl := range d.box.Pending {
+		if !dl.NextAttempt.After(d.now()) {
+			due = append(due, dl)
+		}
+	}
+	d.mutex.Unlock()
+	for _, dl := range due {
+		select {
+		case <-d.stop:
+			return time.Time{}
+		default:
+		}
+		d.mutex.Lock()
+		ep, ok := d.endpoints[dl.URL]
+		d.mutex.Unlock()
+		var err error
+		if ok {
+			err = d.post(ep, dl)
+		}
+		d.finish(dl, err)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var next time.Time
+	for _, dl := range d.box.Pending {
+		if next.IsZero() || dl.NextAttempt.Before(next) {
+			next = dl.NextAttempt
+		}
+	}
+	return next
+}
+
+// finish removes delivered event from outbox or schedules its retry
+func (d *Dispatcher) finish(dl Delivery, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i, p := range d.box.Pending {
+		if p.ID != dl.ID {
+			continue
+		}
+		d.box.Pending = append(d.box.Pending[:i], d.box.Pending[i+1:]...)
+		if err != nil {
+			dl.Attempts++
+			dl.LastError = err.Error()
+			if dl.Attempts >= d.maxAttempts {
+				log.Printf("webhook: giving up delivery %v to %v: %v", dl.ID, dl.URL, err)
+				d.box.Dead = append(d.box.Dead, dl)
+			} else {
+				dl.NextAttempt = d.now().Add(d.delay(dl.Attempts))
+				d.box.Pending = append(d.box.Pending, dl)
+			}
+		}
+		if err := d.save(); err != nil {
+			log.Printf("webhook: error saving outbox %v: %v", d.filename, err)
+		}
+		return
+	}
+}
+
+// delay returns backoff after n failed attempts
+func (d *Dispatcher) delay(n int) time.Duration {
+	delay := d.backoff
+	for i := 1; i < n && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.maxBackoff {
+		delay = d.maxBackoff
+	}
+	return delay
+}
+
+func (d *Dispatcher) post(ep Endpoint, dl Delivery) error {
+	body, err := json.Marshal(Payload{ID: dl.ID, Event: dl.Event})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", ep.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderDelivery, dl.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(ep.Secret, timestamp, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint returned %v", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns value of signature header for body sent at timestamp
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks signature headers of webhook request with body.
+// Requests with timestamp more than tolerance away from now are rejected
+// to prevent replays.
+func VerifySignature(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp := header.Get(HeaderTimestamp)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+		return ErrStaleTimestamp
+	}
+	if !hmac.Equal([]byte(header.Get(HeaderSignature)), []byte(Sign(secret, timestamp, body))) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,206 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dmfed/basicauth"
+)
+
+// receiver is a webhook endpoint which fails until it is told to accept
+type receiver struct {
+	mutex    sync.Mutex
+	accept   bool
+	calls    int
+	payloads []Payload
+	bad      int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.calls++
+	if err := VerifySignature("secret", r.Header, body, time.Minute); err != nil {
+		rc.bad++
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !rc.accept {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var p Payload
+	json.Unmarshal(body, &p)
+	rc.payloads = append(rc.payloads, p)
+}
+
+func (rc *receiver) delivered() int {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return len(rc.payloads)
+}
+
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDispatcher(t *testing.T) {
+	fmt.Println("Testing webhook dispatcher...")
+	filename := "./test_outbox.json"
+	defer os.Remove(filename)
+	rc := &receiver{accept: true}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	endpoints := []Endpoint{{URL: ts.URL, Secret: "secret", Events: []basicauth.EventType{basicauth.EventUserDeleted, basicauth.EventPasswordChanged}}}
+	d, err := OpenDispatcher(filename, endpoints, WithBackoff(10*time.Millisecond, 40*time.Millisecond), WithMaxAttempts(3))
+	if err != nil {
+		fmt.Println("OpenDispatcher returned:", err)
+		t.FailNow()
+	}
+	d.Emit(basicauth.Event{Type: basicauth.EventLogin, UserName: "joe"}) // not subscribed
+	d.Emit(basicauth.Event{Type: basicauth.EventUserDeleted, UserName: "joe", Success: true})
+	if !waitFor(func() bool { return rc.delivered() == 1 && len(d.Pending()) == 0 }) {
+		fmt.Println("event was not delivered, calls:", rc.calls, "pending:", d.Pending())
+		t.FailNow()
+	}
+	if p := rc.payloads[0]; p.Event.UserName != "joe" || p.Event.Type != basicauth.EventUserDeleted || p.ID == "" || rc.bad != 0 {
+		fmt.Println("unexpected payload:", p, "bad signatures:", rc.bad)
+		t.Fail()
+	}
+
+	// failing endpoint: retries end up in dead letters
+	rc.mutex.Lock()
+	rc.accept, rc.calls = false, 0
+	rc.mutex.Unlock()
+	d.Emit(basicauth.Event{Type: basicauth.EventPasswordChanged, UserName: "ann"})
+	if !waitFor(func() bool { return len(d.DeadLetters()) == 1 }) {
+		fmt.Println("failed delivery did not become dead letter, pending:", d.Pending())
+		t.FailNow()
+	}
+	dead := d.DeadLetters()[0]
+	if dead.Attempts != 3 || rc.calls != 3 || dead.LastError == "" {
+		fmt.Println("dead letter after", rc.calls, "calls:", dead)
+		t.Fail()
+	}
+	d.Close()
+
+	// dead letters survive restart and can be retried
+	rc.mutex.Lock()
+	rc.accept = true
+	rc.mutex.Unlock()
+	d, _ = OpenDispatcher(filename, endpoints)
+	defer d.Close()
+	if err := d.Retry("nosuchid"); err != ErrNoSuchDelivery {
+		fmt.Println("Retry of unknown delivery returned:", err)
+		t.Fail()
+	}
+	if err := d.Retry(dead.ID); err != nil {
+		fmt.Println("Retry returned:", err)
+		t.Fail()
+	}
+	if !waitFor(func() bool { return rc.delivered() == 2 }) || rc.payloads[1].ID != dead.ID {
+		fmt.Println("retried dead letter was not delivered")
+		t.Fail()
+	}
+}
+
+func TestOutboxPersistence(t *testing.T) {
+	fmt.Println("Testing webhook outbox persistence...")
+	filename := "./test_outbox_restart.json"
+	defer os.Remove(filename)
+	rc := &receiver{}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	endpoints := []Endpoint{{URL: ts.URL, Secret: "secret"}}
+	d, _ := OpenDispatcher(filename, endpoints, WithBackoff(time.Hour, time.Hour))
+	d.Emit(basicauth.Event{Type: basicauth.EventLogin, UserName: "joe"}) // not in DefaultEvents
+	d.Emit(basicauth.Event{Type: basicauth.EventUserDeleted, UserName: "joe"})
+	waitFor(func() bool { return len(d.Pending()) == 1 && d.Pending()[0].Attempts == 1 })
+	d.Close()
+
+	rc.mutex.Lock()
+	rc.accept = true
+	rc.mutex.Unlock()
+	// pending delivery is kept across restart and delivered when due
+	d, _ = OpenDispatcher(filename, endpoints)
+	if len(d.Pending()) != 1 {
+		fmt.Println("outbox lost pending delivery on restart:", d.Pending())
+		t.Fail()
+	}
+	d.Close()
+	// deliveries to removed endpoints become dead letters
+	d, _ = OpenDispatcher(filename, nil)
+	defer d.Close()
+	if len(d.Pending()) != 0 || len(d.DeadLetters()) != 1 {
+		fmt.Println("delivery to removed endpoint:", d.Pending(), d.DeadLetters())
+		t.Fail()
+	}
+	if err := d.Discard(d.DeadLetters()[0].ID); err != nil || len(d.DeadLetters()) != 0 {
+		fmt.Println("Discard returned:", err)
+		t.Fail()
+	}
+}
+
+func TestOutboxLimit(t *testing.T) {
+	fmt.Println("Testing webhook outbox limit...")
+	filename := "./test_outbox_limit.json"
+	defer os.Remove(filename)
+	endpoints := []Endpoint{{URL: "http://127.0.0.1:1", Secret: "secret"}}
+	d, _ := OpenDispatcher(filename, endpoints, WithBackoff(time.Hour, time.Hour), WithMaxAttempts(1), WithMaxDeliveries(2))
+	defer d.Close()
+	d.Emit(basicauth.Event{Type: basicauth.EventUserDeleted, UserName: "joe"})
+	if !waitFor(func() bool { return len(d.DeadLetters()) == 1 }) {
+		fmt.Println("failed delivery did not become dead letter, pending:", d.Pending())
+		t.FailNow()
+	}
+	first := d.DeadLetters()[0]
+	d.Emit(basicauth.Event{Type: basicauth.EventUserDeleted, UserName: "ann"})
+	d.Emit(basicauth.Event{Type: basicauth.EventUserDeleted, UserName: "bob"})
+	waitFor(func() bool { return len(d.Pending()) == 0 })
+	dead := d.DeadLetters()
+	if len(dead) != 2 || dead[0].ID == first.ID {
+		fmt.Println("outbox over limit kept:", dead)
+		t.Fail()
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	fmt.Println("Testing webhook signatures...")
+	body := []byte(`{"ID":"1"}`)
+	now := fmt.Sprint(time.Now().Unix())
+	h := http.Header{}
+	h.Set(HeaderTimestamp, now)
+	h.Set(HeaderSignature, Sign("secret", now, body))
+	if err := VerifySignature("secret", h, body, time.Minute); err != nil {
+		fmt.Println("VerifySignature of valid request returned:", err)
+		t.Fail()
+	}
+	if err := VerifySignature("other", h, body, time.Minute); err != ErrBadSignature {
+		fmt.Println("VerifySignature with wrong secret returned:", err)
+		t.Fail()
+	}
+	if err := VerifySignature("secret", h, []byte(`{"ID":"2"}`), time.Minute); err != ErrBadSignature {
+		fmt.Println("VerifySignature of altered body returned:", err)
+		t.Fail()
+	}
+	old := fmt.Sprint(time.Now().Add(-time.Hour).Unix())
+	h.Set(HeaderTimestamp, old)
+	h.Set(HeaderSignature, Sign("secret", old, body))
+	if err := VerifySignature("secret", h, body, time.Minute); err != ErrStaleTimestamp {
+		fmt.Println("VerifySignature of replayed request returned:", err)
+		t.Fail()
+	}
+}